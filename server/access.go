@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reasons of plate checks.
+const (
+	reasonListed        = "listed"
+	reasonNotListed     = "not_listed"
+	reasonExpired       = "expired"
+	reasonNotYetValid   = "not_yet_valid"
+	reasonNoLongerValid = "no_longer_valid"
+	reasonListArchived  = "list_archived"
+)
+
+// plateCheck is the outcome of checking a plate against a list. Record is
+// the matching record, if any.
+type plateCheck struct {
+	Allowed bool    `json:"allowed"`
+	Reason  string  `json:"reason"`
+	Record  *Record `json:"record,omitempty"`
+}
+
+// checkPlate decides whether a plate is allowed by a list at now: it needs a
+// record that has not expired and whose validity window contains now. A
+// list may hold a plate more than once, e.g. an expired grant and its
+// renewal; any valid record allows it, otherwise the reason is that of the
+// record with the lowest id. The caller must hold the storage lock.
+func checkPlate(listID int64, plate string, now time.Time) plateCheck {
+	records := storage.plates.recordsIn(listID, plate)
+	if len(records) == 0 {
+		return plateCheck{Reason: reasonNotListed}
+	}
+	var denied plateCheck
+	for i := range records {
+		rec := &records[i]
+		check := plateCheck{Record: rec}
+		switch {
+		case rec.expired(now):
+			check.Reason = reasonExpired
+		case rec.ValidFrom != nil && now.Before(*rec.ValidFrom):
+			check.Reason = reasonNotYetValid
+		case rec.ValidUntil != nil && !now.Before(*rec.ValidUntil):
+			check.Reason = reasonNoLongerValid
+		default:
+			check.Allowed, check.Reason = true, reasonListed
+			return check
+		}
+		if i == 0 {
+			denied = check
+		}
+	}
+	return denied
+}
+
+// checkPlateHandler reports whether the plate parameter is currently allowed
+// by the list. Records without a validity window are always valid.
+func checkPlateHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	plate := normalizePlate(r.URL.Query().Get("plate"))
+	if plate == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing plate parameter")
+		return
+	}
+
+	storage.Lock()
+	_, isList := storage.Lists[id]
+	check := checkPlate(id, plate, time.Now())
+	storage.Unlock()
+
+	if !isList {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	writeEncoded(w, r, check)
+}
+
+// accessDecision answers a gate controller asking whether to let a plate in.
+type accessDecision struct {
+	Allow  bool    `json:"allow"`
+	Reason string  `json:"reason"`
+	Plate  string  `json:"plate"`
+	Record *Record `json:"record,omitempty"`
+}
+
+// accessHandler decides whether the plate parameter may pass the gate
+// guarded by the list listId: the plate must be listed, not expired and
+// within its validity window, and the list not archived. VehicleList.Status
+// is not checked: it is a client-defined code the server assigns no meaning
+// to, and archiving is how a list is taken out of service. Every decision
+// is logged to the audit log.
+func accessHandler(w http.ResponseWriter, r *http.Request) {
+	listID, err := strconv.ParseInt(r.URL.Query().Get("listId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid listId parameter")
+		return
+	}
+	plate := normalizePlate(r.URL.Query().Get("plate"))
+	if plate == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing plate parameter")
+		return
+	}
+	if !requestListAllowed(r, listID) {
+		writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+		return
+	}
+
+	now := time.Now()
+	storage.Lock()
+	list, isList := storage.Lists[listID]
+	check := checkPlate(listID, plate, now)
+	storage.Unlock()
+
+	if !isList {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	decision := accessDecision{Allow: check.Allowed, Reason: check.Reason, Plate: plate, Record: check.Record}
+	if list.Archived && decision.Allow {
+		decision.Allow, decision.Reason = false, reasonListArchived
+	}
+
+	session, _ := contextSession(r.Context())
+	appendMutation(mutationEvent{
+		Time:     now,
+		UserID:   session.ID,
+		User:     session.User,
+		Method:   r.Method,
+		Endpoint: r.URL.RequestURI(),
+		ListID:   listID,
+		Status:   http.StatusOK,
+		Decision: &decision,
+	})
+	writeEncoded(w, r, decision)
+}
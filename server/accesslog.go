@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is one line of the access log.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+	ClientIP  string    `json:"clientIp"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMS float64   `json:"latencyMs"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// accessLogger writes one JSON object per request, separately from the
+// application log, for ingestion by log collectors.
+type accessLogger struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func newAccessLogger(w io.Writer) *accessLogger {
+	return &accessLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *accessLogger) log(entry accessLogEntry) {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		log.Printf("Failed to write access log: %v", err)
+	}
+}
+
+// accessLogMiddleware records every request passing through next.
+func accessLogMiddleware(l *accessLogger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		l.log(accessLogEntry{
+			Time:      start.UTC(),
+			User:      r.Header.Get("User-ID"),
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			RequestID: requestID(r.Context()),
+		})
+	})
+}
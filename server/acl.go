@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+)
+
+// seedACL stores the list_acl of the config, keyed by username, as the
+// access control lists of the users' ids.
+func seedACL(acl map[string][]int64) {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.ACL = make(map[int64]map[int64]bool, len(acl))
+	for user, ids := range acl {
+		lists := make(map[int64]bool, len(ids))
+		for _, id := range ids {
+			lists[id] = true
+		}
+		storage.ACL[userID(user)] = lists
+	}
+}
+
+// listAllowed reports whether a session may read and change a list. Users
+// without an access control list may use every list, admins always do.
+func listAllowed(session Session, listID int64) bool {
+	storage.Lock()
+	defer storage.Unlock()
+	return listAllowedLocked(session, listID)
+}
+
+// listAllowedLocked is listAllowed for callers holding the storage lock.
+func listAllowedLocked(session Session, listID int64) bool {
+	if hasRole(session, roleAdmin) {
+		return true
+	}
+	lists, restricted := storage.ACL[session.ID]
+	return !restricted || lists[listID]
+}
+
+// requestListAllowed reports whether the session of r may use a list.
+// Requests without a session, such as shared links, are not restricted.
+func requestListAllowed(r *http.Request, listID int64) bool {
+	session, ok := contextSession(r.Context())
+	return !ok || listAllowed(session, listID)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// minAPIKeyLength keeps API keys hard to guess.
+const minAPIKeyLength = 16
+
+// APIKey authenticates a machine client, such as barrier hardware, that
+// can't log in interactively. It is sent in the X-API-Key header and acts
+// as User with Role, or the role userRole gives User when empty.
+type APIKey struct {
+	Key  string `yaml:"key"`
+	User string `yaml:"user"`
+	Role string `yaml:"role"`
+}
+
+// apiKeySession returns the session of the configured API key matching
+// key. All keys are compared in constant time.
+func apiKeySession(key string) (Session, bool) {
+	sum := sha256.Sum256([]byte(key))
+	var match *APIKey
+	keys := currentSettings().APIKeys
+	for i := range keys {
+		candidate := sha256.Sum256([]byte(keys[i].Key))
+		if subtle.ConstantTimeCompare(sum[:], candidate[:]) == 1 {
+			match = &keys[i]
+		}
+	}
+	if match == nil {
+		return Session{}, false
+	}
+	role := match.Role
+	if role == "" {
+		role = accountRole(match.User)
+	}
+	return Session{ID: userID(match.User), User: match.User, Role: role}, true
+}
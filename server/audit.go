@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit actions on records.
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// auditEvent is one change to a record. Record is the record after the
+// change, or as it was before a delete, so the trail survives the record.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	ListID   int64     `json:"listId"`
+	RecordID int64     `json:"recordId"`
+	User     string    `json:"user,omitempty"`
+	Record   Record    `json:"record"`
+}
+
+// maxAuditEvents bounds the trail of record changes to its latest events.
+// The trail is kept in memory only, so it is lost on restart.
+const maxAuditEvents = 50000
+
+// auditLog is the append-only, chronological trail of record changes.
+// Dropped counts the oldest events dropped past maxAuditEvents.
+var auditLog struct {
+	sync.Mutex
+	events  []auditEvent
+	dropped int
+}
+
+// recordAudit appends an event for rec to the audit trail.
+func recordAudit(user, action string, listID int64, rec Record) {
+	auditLog.Lock()
+	if len(auditLog.events) >= maxAuditEvents {
+		// Shift in place, as appendBounded does.
+		n := copy(auditLog.events, auditLog.events[len(auditLog.events)-maxAuditEvents+1:])
+		auditLog.dropped += len(auditLog.events) - n
+		auditLog.events = auditLog.events[:n]
+	}
+	auditLog.events = append(auditLog.events, auditEvent{
+		Time:     time.Now(),
+		Action:   action,
+		ListID:   listID,
+		RecordID: rec.ID,
+		User:     user,
+		Record:   rec,
+	})
+	auditLog.Unlock()
+}
+
+// recordChanged records a change to a record in the audit trail and
+// notifies the streams of the list and the record webhook, if any.
+func recordChanged(user, action string, listID int64, rec Record) {
+	recordAudit(user, action, listID, rec)
+	event := recordEvent{Type: action, ListID: listID, Record: rec}
+	changes.Publish(event)
+	if recordWebhook != nil {
+		recordWebhook.Send(event)
+	}
+}
+
+// auditLength returns the number of record changes so far, for auditSince.
+func auditLength() int {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	return auditLog.dropped + len(auditLog.events)
+}
+
+// auditSince returns the record changes made by user after the first n. A
+// request's changes are told apart by user only, so concurrent requests of
+// the same user may each list the other's changes too.
+func auditSince(n int, user string) []auditEvent {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	var changes []auditEvent
+	start := n - auditLog.dropped
+	if start < 0 {
+		start = 0
+	}
+	for _, event := range auditLog.events[start:] {
+		if event.User == user {
+			changes = append(changes, event)
+		}
+	}
+	return changes
+}
+
+// auditTrail returns the events of one record kept in the trail, oldest
+// first.
+func auditTrail(listID, recordID int64) []auditEvent {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	trail := []auditEvent{}
+	for _, event := range auditLog.events {
+		if event.ListID == listID && event.RecordID == recordID {
+			trail = append(trail, event)
+		}
+	}
+	return trail
+}
+
+// requestUser returns the username of the request's session, if any.
+func requestUser(r *http.Request) string {
+	session, _ := contextSession(r.Context())
+	return session.User
+}
+
+// recordAuditHandler returns the audit trail of the record named by the
+// recordId parameter, including records that were deleted since.
+func recordAuditHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	recordID, err := parseRecordID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	trail := auditTrail(id, recordID)
+	if len(trail) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": trail})
+}
+
+// mutationEvent is one state-changing API request. Before and After hold
+// the list it targeted, without its records, around the request; Changes
+// are the records it created, updated or deleted. Access decisions are
+// logged too, with the Decision.
+type mutationEvent struct {
+	Time     time.Time       `json:"time"`
+	UserID   int64           `json:"userId"`
+	User     string          `json:"user,omitempty"`
+	Method   string          `json:"method"`
+	Endpoint string          `json:"endpoint"`
+	ListID   int64           `json:"listId,omitempty"`
+	Status   int             `json:"status"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+	Changes  []auditEvent    `json:"changes,omitempty"`
+	Decision *accessDecision `json:"decision,omitempty"`
+}
+
+// maxMutationEvents bounds the mutation log kept in memory, and served by
+// the audit endpoint, to its latest events. With audit_path the file keeps
+// all of them.
+const maxMutationEvents = 10000
+
+// mutationLog is the append-only log of every state-changing request made
+// with a session. When audit_path is configured each event is also
+// appended to that file as a JSON line.
+var mutationLog struct {
+	sync.Mutex
+	events []mutationEvent
+	out    io.Writer
+}
+
+// openMutationLog restores the latest events saved at path and appends new
+// ones to it.
+func openMutationLog(path string) (*os.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var events []mutationEvent
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	lines.Buffer(nil, 16<<20)
+	for lines.Scan() {
+		var event mutationEvent
+		if err := json.Unmarshal(lines.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		events = appendBounded(events, event)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	mutationLog.Lock()
+	mutationLog.events = events
+	mutationLog.out = file
+	mutationLog.Unlock()
+	return file, nil
+}
+
+// credentialParams are query parameters carrying credentials, such as the
+// session token revoked by DELETE /api/v1/sessions.
+var credentialParams = []string{"token"}
+
+// auditEndpoint returns the path and query of u as logged, with the values
+// of credentialParams redacted.
+func auditEndpoint(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, name := range credentialParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// auditMutation serves a state-changing request and logs it. It is called
+// by tokenMiddleware, so no authenticated mutation bypasses it.
+func auditMutation(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	session, _ := contextSession(r.Context())
+	event := mutationEvent{
+		UserID:   session.ID,
+		User:     session.User,
+		Method:   r.Method,
+		Endpoint: auditEndpoint(r.URL),
+	}
+	listID, hasList := mutationListID(r)
+	if hasList {
+		event.ListID = listID
+		event.Before = listState(listID)
+	}
+	since := auditLength()
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	event.Time = time.Now()
+	event.Status = rec.status
+	if hasList {
+		event.After = listState(listID)
+	}
+	event.Changes = auditSince(since, session.User)
+	appendMutation(event)
+}
+
+func appendMutation(event mutationEvent) {
+	mutationLog.Lock()
+	defer mutationLog.Unlock()
+	mutationLog.events = appendBounded(mutationLog.events, event)
+	if mutationLog.out == nil {
+		return
+	}
+	line, _ := json.Marshal(event)
+	if _, err := mutationLog.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// appendBounded appends event to events, dropping the oldest events past
+// maxMutationEvents.
+func appendBounded(events []mutationEvent, event mutationEvent) []mutationEvent {
+	if len(events) >= maxMutationEvents {
+		// Shift in place rather than reslicing, which would keep the
+		// dropped events reachable through the backing array.
+		n := copy(events, events[len(events)-maxMutationEvents+1:])
+		events = events[:n]
+	}
+	return append(events, event)
+}
+
+// mutationListID returns the list a request targets, from the id path or
+// query parameter.
+func mutationListID(r *http.Request) (int64, bool) {
+	value := r.PathValue("id")
+	if value == "" {
+		value = r.URL.Query().Get("id")
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	return id, err == nil
+}
+
+// listState returns a list, without its records, as JSON, or nil when the
+// list doesn't exist.
+func listState(id int64) json.RawMessage {
+	storage.Lock()
+	list, isList := storage.Lists[id]
+	storage.Unlock()
+	if !isList {
+		return nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// auditHandler pages through the mutation log, oldest first, optionally
+// filtered by the userId and listId parameters.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	offset, count, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	filter := func(name string) (int64, bool, error) {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			return 0, false, nil
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, false, errors.New("Invalid " + name + " parameter")
+		}
+		return id, true, nil
+	}
+	userID, byUser, err := filter("userId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	listID, byList, err := filter("listId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	events := []mutationEvent{}
+	mutationLog.Lock()
+	for _, event := range mutationLog.events {
+		if (byUser && event.UserID != userID) || (byList && event.ListID != listID) {
+			continue
+		}
+		events = append(events, event)
+	}
+	mutationLog.Unlock()
+
+	total := len(events)
+	start, end := pageBounds(total, offset, count)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":   events[start:end],
+		"_metadata": newPageMetadata(r, offset, count, total),
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// backupVersion is the format version of backups. Restores reject other
+// versions.
+const backupVersion = 1
+
+// backup is the gob-encoded content of a backup: all lists and records.
+// Gob is far smaller and faster than JSON for large datasets.
+type backup struct {
+	Version   int
+	CreatedAt time.Time
+	Lists     map[int64]VehicleList
+	Records   map[int64][]Record
+}
+
+// backupHandler streams a gob-encoded backup of all lists and records. The
+// storage is copied under the lock first, so a slow download doesn't block
+// writers.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	b := backup{Version: backupVersion, CreatedAt: time.Now(), Lists: make(map[int64]VehicleList)}
+	storage.Lock()
+	for id, list := range storage.Lists {
+		b.Lists[id] = list
+	}
+	storage.Unlock()
+	// Lists and records are copied under separate locks; a list created in
+	// between is restored without records, which is still consistent.
+	b.Records = storage.snapshotRecords(func(int64) bool { return true })
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="amv-%s.gob"`, b.CreatedAt.UTC().Format("20060102T150405Z")))
+	if err := gob.NewEncoder(w).Encode(b); err != nil {
+		log.Printf("Failed to write backup: %v", err)
+	}
+}
+
+// restoreHandler replaces all lists and records with those of a backup
+// uploaded in the body. The backup is decoded and validated in full before
+// it is swapped in, so a corrupt upload leaves the storage untouched.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	var b backup
+	if err := gob.NewDecoder(r.Body).Decode(&b); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Corrupt backup: "+err.Error())
+		return
+	}
+	if err := validateBackup(&b); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid backup: "+err.Error())
+		return
+	}
+	if err := r.Context().Err(); err != nil {
+		writeContextError(w, err)
+		return
+	}
+
+	records := 0
+	storage.Lock()
+	storage.Lists = b.Lists
+	storage.Records = b.Records
+	for id := range storage.Lists {
+		if storage.Records[id] == nil {
+			storage.Records[id] = []Record{}
+		}
+	}
+	for _, list := range storage.Records {
+		records += len(list)
+	}
+	reserveStoredIDs()
+	rebuildPlateIndex()
+	storage.Unlock()
+
+	log.Printf("Restored %d lists and %d records from a backup of %s", len(b.Lists), records, b.CreatedAt.Format(time.RFC3339))
+	writeEncoded(w, r, map[string]int{"lists": len(b.Lists), "records": records})
+}
+
+// validateBackup checks a decoded backup, held to the rules of the API:
+// records belong to a list and their plates are unique in it. It normalizes
+// the records.
+func validateBackup(b *backup) error {
+	if b.Version != backupVersion {
+		return fmt.Errorf("unsupported version %d", b.Version)
+	}
+	if b.Lists == nil {
+		b.Lists = make(map[int64]VehicleList)
+	}
+	if b.Records == nil {
+		b.Records = make(map[int64][]Record)
+	}
+	for id, list := range b.Lists {
+		if list.ID != id {
+			return fmt.Errorf("list %d is stored under id %d", list.ID, id)
+		}
+		if errs := validateList(&list); errs != nil {
+			return fmt.Errorf("list %d: %v", id, errs)
+		}
+	}
+	seen := make(map[int64]bool)
+	for listID, records := range b.Records {
+		// Records without a list would restore a list that doesn't exist.
+		if _, isList := b.Lists[listID]; !isList {
+			return fmt.Errorf("records of unknown list %d", listID)
+		}
+		plates := make(map[string]bool)
+		for i := range records {
+			rec := &records[i]
+			if rec.ID == 0 || seen[rec.ID] {
+				return fmt.Errorf("list %d: record %d has a missing or duplicate id", listID, i)
+			}
+			seen[rec.ID] = true
+			if errs := validateRecord(rec); errs != nil {
+				return fmt.Errorf("list %d record %d: %v", listID, rec.ID, errs)
+			}
+			plate := normalizePlate(rec.Plate)
+			if plates[plate] {
+				return fmt.Errorf("list %d record %d: duplicate plate %s", listID, rec.ID, rec.Plate)
+			}
+			plates[plate] = true
+		}
+	}
+	return nil
+}
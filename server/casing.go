@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Casings of the JSON keys of lists and records, chosen by output_casing.
+const (
+	casingCamel = "camel"
+	casingSnake = "snake"
+)
+
+// The JSON keys of lists and records, and of the response entries embedding
+// them, follow output_casing. Their json tags are camelCase and stay the
+// only field names; snake_case is a remapping of the encoded keys. Request
+// bodies are always camelCase.
+
+// plainList and plainRecord encode without the casing, avoiding recursion.
+type (
+	plainList   VehicleList
+	plainRecord Record
+)
+
+// MarshalJSON encodes the list with the keys of output_casing.
+func (list VehicleList) MarshalJSON() ([]byte, error) {
+	return marshalCased(plainList(list))
+}
+
+// MarshalJSON encodes the record with the keys of output_casing.
+func (rec Record) MarshalJSON() ([]byte, error) {
+	return marshalCased(plainRecord(rec))
+}
+
+// Embedding a list or record promotes its MarshalJSON, which would drop
+// the other fields, so the entries embedding one encode all their parts.
+
+func (e listEntry) MarshalJSON() ([]byte, error) {
+	return marshalParts(e.VehicleList, struct {
+		RecordCount int `json:"recordCount"`
+	}{e.RecordCount})
+}
+
+func (e expandedListEntry) MarshalJSON() ([]byte, error) {
+	return marshalParts(e.listEntry, struct {
+		Records []Record `json:"records"`
+	}{e.Records})
+}
+
+func (e enrichedRecord) MarshalJSON() ([]byte, error) {
+	return marshalParts(e.Record, struct {
+		Derived map[string]string `json:"derived"`
+	}{e.Derived})
+}
+
+func (e exportedRecord) MarshalJSON() ([]byte, error) {
+	return marshalParts(struct {
+		ListID int64 `json:"listId"`
+	}{e.ListID}, e.Record)
+}
+
+func (m plateMatch) MarshalJSON() ([]byte, error) {
+	return marshalParts(m.Record, struct {
+		Distance int `json:"distance"`
+	}{m.Distance})
+}
+
+// marshalCased encodes v, a struct, with the top-level keys of
+// output_casing. Nested values keep the keys they encode with.
+func marshalCased(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || outputCasing() != casingSnake {
+		return data, err
+	}
+	return renameKeys(data, snakeCase, false)
+}
+
+// marshalParts encodes structs as the fields of a single object, in order.
+func marshalParts(parts ...interface{}) ([]byte, error) {
+	out := []byte{'{'}
+	for _, part := range parts {
+		data, err := marshalCased(part)
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.TrimSpace(data)
+		fields = fields[1 : len(fields)-1]
+		if len(fields) == 0 {
+			continue
+		}
+		if len(out) > 1 {
+			out = append(out, ',')
+		}
+		out = append(out, fields...)
+	}
+	return append(out, '}'), nil
+}
+
+// outputCasing returns the configured casing, camel before the settings are
+// loaded.
+func outputCasing() string {
+	if s := currentSettings(); s != nil && s.OutputCasing != "" {
+		return s.OutputCasing
+	}
+	return casingCamel
+}
+
+// outputFieldName returns the key the field name of a struct of type t is
+// encoded with.
+func outputFieldName(t reflect.Type, name string) string {
+	if t.Implements(marshalerType) && outputCasing() == casingSnake {
+		return snakeCase(name)
+	}
+	return name
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// outputKey returns the key a camelCase field of a list or record is encoded
+// with.
+func outputKey(name string) string {
+	if outputCasing() == casingSnake {
+		return snakeCase(name)
+	}
+	return name
+}
+
+// snakeCase converts a camelCase key, e.g. vehicleType to vehicle_type.
+func snakeCase(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// camelCase converts a snake_case key, e.g. vehicle_type to vehicleType.
+// camelCase keys are returned unchanged.
+func camelCase(key string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range key {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// renameKeys returns the JSON document data with the keys of its top-level
+// object, or of all its objects if deep, passed through rename. Order and
+// values are kept.
+func renameKeys(data []byte, rename func(string) string, deep bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := copyRenamed(dec, &out, rename, deep); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func copyRenamed(dec *json.Decoder, out *bytes.Buffer, rename func(string) string, deep bool) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		value, err := json.Marshal(token)
+		out.Write(value)
+		return err
+	}
+	out.WriteRune(rune(delim))
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if delim == '{' {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			name, _ := json.Marshal(rename(key.(string)))
+			out.Write(name)
+			out.WriteByte(':')
+		}
+		if deep {
+			err = copyRenamed(dec, out, rename, deep)
+		} else {
+			var value json.RawMessage
+			if err = dec.Decode(&value); err == nil {
+				out.Write(value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	end, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	out.WriteRune(rune(end.(json.Delim)))
+	return nil
+}
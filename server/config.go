@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config represents the configuration structure.
+type Config struct {
+	// BaseURL is the external URL of the server, used to generate links.
+	BaseURL string `yaml:"base_url"`
+	// BasePath prefixes every route, e.g. "/kpam" when a reverse proxy
+	// serves the API under a subpath. Empty serves it at the root.
+	BasePath string `yaml:"base_path"`
+	// OpsOutsideBasePath keeps /metrics at the root instead of under
+	// BasePath.
+	OpsOutsideBasePath bool `yaml:"ops_outside_base_path"`
+	// ListenAddr is the address to bind, e.g. ":1608". When empty the host
+	// and port of BaseURL are used.
+	ListenAddr  string        `yaml:"listen_addr"`
+	TokenExpiry time.Duration `yaml:"token_expiry"`
+	// BindSessions rejects tokens used from a client fingerprint other than
+	// the one seen at login. Off by default since it logs out mobile clients
+	// switching networks.
+	BindSessions bool `yaml:"bind_sessions"`
+	// CookieName, CookieDomain and CookiePath set the session cookie, so
+	// that apps sharing a domain don't overwrite each other's sessions. The
+	// CSRF cookie shares the domain and path.
+	CookieName   string `yaml:"cookie_name"`
+	CookieDomain string `yaml:"cookie_domain"`
+	CookiePath   string `yaml:"cookie_path"`
+	// TrustedProxies are the CIDRs or addresses of the reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers give the client address. Other
+	// peers are taken as the client.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// UniqueDisplayName rejects a list whose display name is already used by
+	// another list of the same owner.
+	UniqueDisplayName bool `yaml:"unique_display_name"`
+	// MetricsFlushInterval batches metric updates and applies them to the
+	// collector at this interval. Zero updates the collector directly.
+	MetricsFlushInterval time.Duration `yaml:"metrics_flush_interval"`
+	// AccessLog is the file receiving one JSON line per request. Empty
+	// disables the access log.
+	AccessLog string `yaml:"access_log"`
+	// ReservedPlates lists plates that may never be stored. Entries are exact
+	// plates or shell patterns such as "TEST*", compared after normalization.
+	ReservedPlates []string `yaml:"reserved_plates"`
+	// VehicleTypes restricts Record.VehicleType to the listed values. Empty
+	// accepts any type.
+	VehicleTypes []string `yaml:"vehicle_types"`
+	// MaxPlateLength is the longest plate accepted after normalization.
+	MaxPlateLength int `yaml:"max_plate_length"`
+	// MaxTagsPerRecord and MaxTagLength bound the tags of a record.
+	MaxTagsPerRecord int `yaml:"max_tags_per_record"`
+	MaxTagLength     int `yaml:"max_tag_length"`
+	// MaxRecordsPerList caps the records of a list to protect memory. Zero
+	// is unlimited.
+	MaxRecordsPerList int `yaml:"max_records_per_list"`
+	// MaxDisplayNameLength and MaxListNameLength bound the displayName and
+	// name of a list, in characters.
+	MaxDisplayNameLength int `yaml:"max_display_name_length"`
+	MaxListNameLength    int `yaml:"max_list_name_length"`
+	// MaxMatchDistance caps the maxDistance of near-match plate lookups.
+	MaxMatchDistance int `yaml:"max_match_distance"`
+	// VehicleTypeRules infer the vehicle type of new records that omit it
+	// from their plate; the first matching rule wins.
+	VehicleTypeRules []VehicleTypeRule `yaml:"vehicle_type_rules"`
+	// DerivedFields are computed from the plate of each record returned
+	// with ?enrich=true, for example a region code. They are never stored.
+	DerivedFields []DerivedFieldRule `yaml:"derived_fields"`
+	// DefaultVehicleType is used when no rule matches.
+	DefaultVehicleType string `yaml:"default_vehicle_type"`
+	// PlatePattern is an optional regular expression normalized plates must
+	// match.
+	PlatePattern string `yaml:"plate_pattern"`
+	// JanitorInterval is how often expired tokens and shares are purged.
+	JanitorInterval time.Duration `yaml:"janitor_interval"`
+	// CleanupWebhook receives a JSON cleanupEvent whenever the janitor
+	// purged expired tokens or shares.
+	CleanupWebhook string `yaml:"cleanup_webhook"`
+	// WebhookURL receives a JSON recordEvent whenever a record is created,
+	// updated or deleted. Deliveries are retried in the background.
+	WebhookURL string `yaml:"webhook_url"`
+	// AuditPath is the file every authenticated mutation is appended to,
+	// and restored from at startup. Empty keeps the audit log in memory.
+	AuditPath string `yaml:"audit_path"`
+	// PersistPath is the file lists and records are saved to after every
+	// change and restored from at startup. Empty keeps them in memory only.
+	PersistPath string `yaml:"persist_path"`
+	// SeedFile is a JSON file of lists and records, in the format of
+	// persist_path, loaded at startup when nothing else was, e.g. for demos.
+	SeedFile string `yaml:"seed_file"`
+	// PersistRetries is how many times a failed write is retried, waiting
+	// PersistRetryBackoff before the first retry and twice as long before
+	// each next one.
+	PersistRetries      int           `yaml:"persist_retries"`
+	PersistRetryBackoff time.Duration `yaml:"persist_retry_backoff"`
+	// TokenCompactionThreshold purges expired tokens immediately once the
+	// token map holds this many entries. Zero waits for the janitor.
+	TokenCompactionThreshold int `yaml:"token_compaction_threshold"`
+	// IdempotencyWindow is how long the response to a record POST with an
+	// Idempotency-Key is replayed to retries.
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+	// EnforceClientSeq rejects mutations whose X-Client-Seq header is not
+	// greater than the last one seen in the same session.
+	EnforceClientSeq bool `yaml:"enforce_client_seq"`
+	// JWTSecret signs session tokens. When empty a random secret is
+	// generated at startup, so tokens don't survive a restart.
+	JWTSecret string `yaml:"jwt_secret"`
+	// StatelessTokens issues compact binary tokens instead of JWTs. Both are
+	// signed with jwt_secret and verified without a storage lookup; tokens
+	// of either kind stay valid when the setting changes.
+	StatelessTokens bool `yaml:"stateless_tokens"`
+	// AdminUsers are the usernames given the admin role.
+	AdminUsers []string `yaml:"admin_users"`
+	// Roles maps usernames to their role, viewer or admin, overriding
+	// admin_users. Only admins may change lists and records.
+	Roles map[string]string `yaml:"roles"`
+	// DefaultRole is the role of users not in roles or admin_users.
+	DefaultRole string `yaml:"default_role"`
+	// Users are the accounts allowed to log in, e.g. service accounts. When
+	// empty any username and password is accepted, except for usernames
+	// given the admin role, which then can only use API keys.
+	Users []ServiceAccount `yaml:"users"`
+	// MinPasswordLength is the shortest password accepted by a password
+	// change.
+	MinPasswordLength int `yaml:"min_password_length"`
+	// MinPasswordClasses is how many of lowercase letters, uppercase letters,
+	// digits and other characters a changed password must mix.
+	MinPasswordClasses int `yaml:"min_password_classes"`
+	// LockoutThreshold is how many consecutive failed logins lock an account
+	// for lockout_duration. Failures older than lockout_duration are
+	// forgotten.
+	LockoutThreshold int           `yaml:"lockout_threshold"`
+	LockoutDuration  time.Duration `yaml:"lockout_duration"`
+	// APIKeys authenticate machine clients with the X-API-Key header.
+	APIKeys []APIKey `yaml:"api_keys"`
+	// ListACL restricts the listed usernames to the given list ids. Other
+	// users and admins may use every list.
+	ListACL map[string][]int64 `yaml:"list_acl"`
+	// OutputCasing is the casing of the JSON keys of lists and records in
+	// responses, camel (vehicleType) or snake (vehicle_type).
+	OutputCasing string `yaml:"output_casing"`
+	// SchemaRequiresAuth puts /api/v1/meta/schema behind a token.
+	SchemaRequiresAuth bool `yaml:"schema_requires_auth"`
+
+	// TLSCert and TLSKey are the certificate and private key files. When
+	// both are set the server listens with TLS.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// TLSRedirect additionally listens on port 80 and redirects all plain
+	// HTTP requests to the https URL.
+	TLSRedirect bool `yaml:"tls_redirect"`
+
+	// Server timeouts guarding against slow or idle clients. ReadTimeout and
+	// WriteTimeout bound reading a whole request and writing its response,
+	// IdleTimeout bounds keep-alive connections between requests and
+	// ReadHeaderTimeout bounds reading the request headers (slowloris).
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// HandlerTimeout answers 503 to requests not handled in time, except
+	// for the streaming endpoints. It should be below write_timeout for the
+	// 503 to reach the client. Zero disables it.
+	HandlerTimeout time.Duration `yaml:"handler_timeout"`
+}
+
+// Default server timeouts, used when the config leaves them unset.
+const (
+	defaultReadTimeout       = 15 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultReadHeaderTimeout = 5 * time.Second
+
+	defaultURL              = "http://localhost:1608"
+	defaultTokenExpiry      = 5 * time.Minute
+	defaultCookieName       = "s"
+	defaultCookiePath       = "/"
+	defaultMaxPlateLength   = 16
+	defaultMaxTagsPerRecord = 10
+	defaultMaxTagLength     = 32
+	defaultJanitorInterval  = time.Minute
+
+	defaultMaxDisplayNameLength = 100
+	defaultMaxListNameLength    = 64
+	defaultMaxMatchDistance     = 2
+
+	defaultMinPasswordLength  = 10
+	defaultMinPasswordClasses = 2
+	defaultLockoutThreshold   = 5
+	defaultLockoutDuration    = 15 * time.Minute
+
+	defaultIdempotencyWindow = 24 * time.Hour
+)
+
+// restartOnlyKeys are config keys only read at startup. Reloading the config
+// logs their changes but they take effect on the next restart.
+var restartOnlyKeys = map[string]bool{
+	"base_path":              true,
+	"ops_outside_base_path":  true,
+	"listen_addr":            true,
+	"metrics_flush_interval": true,
+	"access_log":             true,
+	"janitor_interval":       true,
+	"cleanup_webhook":        true,
+	"webhook_url":            true,
+	"persist_path":           true,
+	"seed_file":              true,
+	"audit_path":             true,
+	"list_acl":               true,
+	"users":                  true,
+	"persist_retries":        true,
+	"persist_retry_backoff":  true,
+	"jwt_secret":             true,
+	"schema_requires_auth":   true,
+	"tls_cert":               true,
+	"tls_key":                true,
+	"tls_redirect":           true,
+	"read_timeout":           true,
+	"write_timeout":          true,
+	"idle_timeout":           true,
+	"read_header_timeout":    true,
+	"handler_timeout":        true,
+}
+
+// secretKeys are config keys whose values are credentials. Reloading the
+// config logs that they changed but not their values.
+var secretKeys = map[string]bool{
+	"jwt_secret": true,
+	"api_keys":   true,
+	"users":      true,
+}
+
+// defaultConfig returns the configuration used when no config file is read.
+func defaultConfig() *Config {
+	config := &Config{}
+	config.setDefaults()
+	return config
+}
+
+// setDefaults fills the settings left unset with their defaults.
+func (c *Config) setDefaults() {
+	if c.BaseURL == "" {
+		c.BaseURL = defaultURL
+	}
+	if c.TokenExpiry == 0 {
+		c.TokenExpiry = defaultTokenExpiry
+	}
+	if c.CookieName == "" {
+		c.CookieName = defaultCookieName
+	}
+	if c.CookiePath == "" {
+		c.CookiePath = defaultCookiePath
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = roleViewer
+	}
+	if c.OutputCasing == "" {
+		c.OutputCasing = casingCamel
+	}
+	if c.MaxPlateLength == 0 {
+		c.MaxPlateLength = defaultMaxPlateLength
+	}
+	if c.MaxTagsPerRecord == 0 {
+		c.MaxTagsPerRecord = defaultMaxTagsPerRecord
+	}
+	if c.MaxTagLength == 0 {
+		c.MaxTagLength = defaultMaxTagLength
+	}
+	if c.MaxDisplayNameLength == 0 {
+		c.MaxDisplayNameLength = defaultMaxDisplayNameLength
+	}
+	if c.MaxListNameLength == 0 {
+		c.MaxListNameLength = defaultMaxListNameLength
+	}
+	if c.MaxMatchDistance == 0 {
+		c.MaxMatchDistance = defaultMaxMatchDistance
+	}
+	if c.MinPasswordLength == 0 {
+		c.MinPasswordLength = defaultMinPasswordLength
+	}
+	if c.MinPasswordClasses == 0 {
+		c.MinPasswordClasses = defaultMinPasswordClasses
+	}
+	if c.LockoutThreshold == 0 {
+		c.LockoutThreshold = defaultLockoutThreshold
+	}
+	if c.LockoutDuration == 0 {
+		c.LockoutDuration = defaultLockoutDuration
+	}
+	if c.PersistRetries == 0 {
+		c.PersistRetries = defaultPersistRetries
+	}
+	if c.PersistRetryBackoff == 0 {
+		c.PersistRetryBackoff = defaultPersistRetryBackoff
+	}
+	if c.JanitorInterval == 0 {
+		c.JanitorInterval = defaultJanitorInterval
+	}
+	if c.IdempotencyWindow == 0 {
+		c.IdempotencyWindow = defaultIdempotencyWindow
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+}
+
+// readConfig reads the config file at path. Unknown keys are rejected so
+// that a misspelled setting doesn't silently fall back to its default.
+func readConfig(path string) (*Config, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	dec := yaml.NewDecoder(bytes.NewReader(file))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil && err != io.EOF {
+		return nil, err
+	}
+	config.setDefaults()
+	return &config, nil
+}
+
+// loadConfig reads the config file at path, falling back to the defaults
+// when there is none, and applies the KPAM_URL override of the base URL.
+func loadConfig(path string) (*Config, error) {
+	config, err := readConfig(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No config file at %s, using defaults", path)
+		config, err = defaultConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if envURL := os.Getenv("KPAM_URL"); envURL != "" {
+		config.BaseURL = envURL
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// checkConfig fully validates the config file at path without starting the
+// server: besides Validate it compiles the patterns and checks that the
+// files and addresses it names can be used. It prints the outcome to out
+// and returns the process exit code.
+func checkConfig(path string, out io.Writer) int {
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(out, "%s is invalid:\n%v\n", path, err)
+		return 1
+	}
+
+	var errs []error
+	if _, err := newSettings(config); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateTLSFiles(config.TLSCert, config.TLSKey); err != nil {
+		errs = append(errs, fmt.Errorf("tls_cert: %v", err))
+	}
+	if addr, err := listenAddress(config.ListenAddr, config.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr: %v", err))
+	} else if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr: %v", err))
+	}
+	if config.SeedFile != "" {
+		if _, err := os.Stat(config.SeedFile); err != nil {
+			errs = append(errs, fmt.Errorf("seed_file: %v", err))
+		}
+	}
+	for key, file := range map[string]string{"access_log": config.AccessLog, "persist_path": config.PersistPath, "audit_path": config.AuditPath} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(filepath.Dir(file)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s: %s is not a directory", key, filepath.Dir(file)))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		fmt.Fprintf(out, "%s is invalid:\n%v\n", path, err)
+		return 1
+	}
+	fmt.Fprintf(out, "%s is valid\n", path)
+	return 0
+}
+
+// Validate reports every problem found in the config, one per line, naming
+// the offending key.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{key}, args...)...))
+	}
+
+	if u, err := url.Parse(c.BaseURL); err != nil {
+		invalid("base_url", "%v", err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("base_url", "%q must be an absolute http or https URL", c.BaseURL)
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/") || strings.ContainsAny(c.BasePath, " {}")) {
+		invalid("base_path", "%q must start with / and not end with /", c.BasePath)
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil {
+			invalid("webhook_url", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("webhook_url", "%q must be an absolute http or https URL", c.WebhookURL)
+		}
+	}
+	if c.TokenExpiry <= 0 {
+		invalid("token_expiry", "must be positive, got %v", c.TokenExpiry)
+	}
+	if strings.ContainsAny(c.CookieName, "()<>@,;:\\\"/[]?={} \t") || c.CookieName == csrfCookie {
+		invalid("cookie_name", "%q is not a valid cookie name", c.CookieName)
+	}
+	if strings.ContainsAny(c.CookieDomain, "; \t") {
+		invalid("cookie_domain", "%q is not a valid domain", c.CookieDomain)
+	}
+	if !strings.HasPrefix(c.CookiePath, "/") || strings.ContainsAny(c.CookiePath, "; \t") {
+		invalid("cookie_path", "%q must start with /", c.CookiePath)
+	}
+	if c.MetricsFlushInterval < 0 {
+		invalid("metrics_flush_interval", "must not be negative, got %v", c.MetricsFlushInterval)
+	}
+	if c.MaxPlateLength <= 0 {
+		invalid("max_plate_length", "must be positive, got %d", c.MaxPlateLength)
+	}
+	if c.MaxTagsPerRecord <= 0 {
+		invalid("max_tags_per_record", "must be positive, got %d", c.MaxTagsPerRecord)
+	}
+	if c.MaxTagLength <= 0 {
+		invalid("max_tag_length", "must be positive, got %d", c.MaxTagLength)
+	}
+	if c.MaxRecordsPerList < 0 {
+		invalid("max_records_per_list", "must not be negative, got %d", c.MaxRecordsPerList)
+	}
+	if c.MaxDisplayNameLength <= 0 {
+		invalid("max_display_name_length", "must be positive, got %d", c.MaxDisplayNameLength)
+	}
+	if c.MaxListNameLength <= 0 {
+		invalid("max_list_name_length", "must be positive, got %d", c.MaxListNameLength)
+	}
+	if c.MaxMatchDistance <= 0 || c.MaxMatchDistance > 4 {
+		invalid("max_match_distance", "must be between 1 and 4, got %d", c.MaxMatchDistance)
+	}
+	for _, pattern := range c.ReservedPlates {
+		if _, err := path.Match(normalizePlate(pattern), ""); err != nil {
+			invalid("reserved_plates", "bad pattern %q", pattern)
+		}
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		invalid("trusted_proxies", "%v", err)
+	}
+	if c.PlatePattern != "" {
+		if _, err := regexp.Compile(c.PlatePattern); err != nil {
+			invalid("plate_pattern", "%v", err)
+		}
+	}
+	for i, rule := range c.VehicleTypeRules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			invalid("vehicle_type_rules", "rule %d: %v", i, err)
+		}
+		if rule.Type == "" {
+			invalid("vehicle_type_rules", "rule %d has no type", i)
+		} else if len(c.VehicleTypes) > 0 && !containsString(c.VehicleTypes, rule.Type) {
+			invalid("vehicle_type_rules", "rule %d: type %q is not in vehicle_types", i, rule.Type)
+		}
+	}
+	for i, rule := range c.DerivedFields {
+		if rule.Field == "" {
+			invalid("derived_fields", "rule %d has no field", i)
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			invalid("derived_fields", "rule %d: %v", i, err)
+		}
+	}
+	if c.DefaultVehicleType != "" && len(c.VehicleTypes) > 0 && !containsString(c.VehicleTypes, c.DefaultVehicleType) {
+		invalid("default_vehicle_type", "%q is not in vehicle_types", c.DefaultVehicleType)
+	}
+	if c.OutputCasing != casingCamel && c.OutputCasing != casingSnake {
+		invalid("output_casing", "must be camel or snake, got %q", c.OutputCasing)
+	}
+	if _, ok := roleRank[c.DefaultRole]; !ok {
+		invalid("default_role", "unknown role %q", c.DefaultRole)
+	}
+	for user, role := range c.Roles {
+		if _, ok := roleRank[role]; !ok {
+			invalid("roles", "unknown role %q for %s", role, user)
+		}
+	}
+	seenKeys := make(map[string]bool)
+	seenUsers := make(map[string]bool)
+	for i, user := range c.Users {
+		if strings.TrimSpace(user.Username) == "" {
+			invalid("users", "user %d has no username", i)
+		} else if seenUsers[user.Username] {
+			invalid("users", "user %s is a duplicate", user.Username)
+		}
+		seenUsers[user.Username] = true
+		if user.Password == "" {
+			invalid("users", "user %s has no password", user.Username)
+		}
+		if _, ok := roleRank[user.Role]; user.Role != "" && !ok {
+			invalid("users", "unknown role %q for user %s", user.Role, user.Username)
+		}
+	}
+	// bcrypt ignores anything past 72 bytes.
+	if c.MinPasswordLength <= 0 || c.MinPasswordLength > maxPasswordLength {
+		invalid("min_password_length", "must be between 1 and %d, got %d", maxPasswordLength, c.MinPasswordLength)
+	}
+	if c.MinPasswordClasses <= 0 || c.MinPasswordClasses > 4 {
+		invalid("min_password_classes", "must be between 1 and 4, got %d", c.MinPasswordClasses)
+	}
+	if c.LockoutThreshold <= 0 {
+		invalid("lockout_threshold", "must be positive, got %d", c.LockoutThreshold)
+	}
+	if c.LockoutDuration <= 0 {
+		invalid("lockout_duration", "must be positive, got %v", c.LockoutDuration)
+	}
+	for i, key := range c.APIKeys {
+		if len(key.Key) < minAPIKeyLength {
+			invalid("api_keys", "key %d is shorter than %d characters", i, minAPIKeyLength)
+		} else if seenKeys[key.Key] {
+			invalid("api_keys", "key %d is a duplicate", i)
+		}
+		seenKeys[key.Key] = true
+		if key.User == "" {
+			invalid("api_keys", "key %d has no user", i)
+		}
+		if _, ok := roleRank[key.Role]; key.Role != "" && !ok {
+			invalid("api_keys", "unknown role %q for key %d", key.Role, i)
+		}
+	}
+	if c.PersistRetries < 0 {
+		invalid("persist_retries", "must not be negative, got %d", c.PersistRetries)
+	}
+	if c.PersistRetryBackoff <= 0 {
+		invalid("persist_retry_backoff", "must be positive, got %v", c.PersistRetryBackoff)
+	}
+	if c.JanitorInterval <= 0 {
+		invalid("janitor_interval", "must be positive, got %v", c.JanitorInterval)
+	}
+	if c.IdempotencyWindow <= 0 {
+		invalid("idempotency_window", "must be positive, got %v", c.IdempotencyWindow)
+	}
+	if c.TokenCompactionThreshold < 0 {
+		invalid("token_compaction_threshold", "must not be negative, got %d", c.TokenCompactionThreshold)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		invalid("tls_cert", "tls_cert and tls_key must be set together")
+	}
+	if c.TLSRedirect && c.TLSCert == "" {
+		invalid("tls_redirect", "requires tls_cert and tls_key")
+	}
+	for key, timeout := range map[string]time.Duration{
+		"read_timeout":        c.ReadTimeout,
+		"write_timeout":       c.WriteTimeout,
+		"idle_timeout":        c.IdleTimeout,
+		"read_header_timeout": c.ReadHeaderTimeout,
+	} {
+		if timeout <= 0 {
+			invalid(key, "must be positive, got %v", timeout)
+		}
+	}
+	if c.HandlerTimeout < 0 {
+		invalid("handler_timeout", "must not be negative, got %v", c.HandlerTimeout)
+	}
+	return errors.Join(errs...)
+}
+
+// settings is the running configuration along with its compiled patterns.
+// Handlers read it through currentSettings and must not modify it; a reload
+// replaces it as a whole.
+type settings struct {
+	Config
+	platePattern      *regexp.Regexp
+	trustedProxies    []netip.Prefix
+	vehicleTypeRules  []VehicleTypeRule
+	derivedFieldRules []DerivedFieldRule
+}
+
+var (
+	settingsMu sync.RWMutex
+	active     = mustSettings(defaultConfig())
+)
+
+// newSettings compiles the patterns of config.
+func newSettings(config *Config) (*settings, error) {
+	s := &settings{Config: *config}
+	if config.PlatePattern != "" {
+		re, err := regexp.Compile(config.PlatePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plate_pattern: %v", err)
+		}
+		s.platePattern = re
+	}
+	rules, err := compileVehicleTypeRules(config.VehicleTypeRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vehicle_type_rules: %v", err)
+	}
+	s.vehicleTypeRules = rules
+	derived, err := compileDerivedFieldRules(config.DerivedFields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid derived_fields: %v", err)
+	}
+	s.derivedFieldRules = derived
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted_proxies: %v", err)
+	}
+	s.trustedProxies = proxies
+	return s, nil
+}
+
+func mustSettings(config *Config) *settings {
+	s, err := newSettings(config)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// currentSettings returns the running configuration.
+func currentSettings() *settings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return active
+}
+
+// setSettings replaces the running configuration and returns the previous one.
+func setSettings(s *settings) *settings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	prev := active
+	active = s
+	return prev
+}
+
+// watchConfig reloads the config file at path whenever the process receives
+// SIGHUP. Requests in flight keep the settings they started with.
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(path); err != nil {
+				log.Printf("Config reload failed, keeping current settings: %v", err)
+			}
+		}
+	}()
+}
+
+// reloadConfig reads the config file at path and applies it to the running
+// server. An invalid file leaves the current settings untouched.
+func reloadConfig(path string) error {
+	config, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	if envURL := os.Getenv("KPAM_URL"); envURL != "" {
+		config.BaseURL = envURL
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	s, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+	prev := setSettings(s)
+	changes := configChanges(&prev.Config, config)
+	if len(changes) == 0 {
+		log.Printf("Config reloaded from %s, no changes", path)
+		return nil
+	}
+	log.Printf("Config reloaded from %s: %s", path, strings.Join(changes, ", "))
+	return nil
+}
+
+// configChanges describes the settings differing between prev and next, by
+// config key. The values of secretKeys are not printed.
+func configChanges(prev, next *Config) []string {
+	var changes []string
+	ov, nv := reflect.ValueOf(*prev), reflect.ValueOf(*next)
+	for i := 0; i < ov.NumField(); i++ {
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		key := strings.Split(ov.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		change := fmt.Sprintf("%s %v -> %v", key, a, b)
+		if secretKeys[key] {
+			change = key + " changed"
+		}
+		if restartOnlyKeys[key] {
+			change += " (on restart)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errInvalidCursor rejects cursors that were not returned as a nextCursor
+// for the same sort order.
+var errInvalidCursor = errors.New("Invalid cursor parameter")
+
+// pageCursor is the position after the last record of a page. Unlike an
+// offset it stays put when records are inserted or deleted before it.
+type pageCursor struct {
+	Sort string `json:"s,omitempty"`
+	Dir  string `json:"d,omitempty"`
+	ID   int64  `json:"id"`
+	Key  string `json:"k,omitempty"` // Sort key of the record, unless sorting by id
+}
+
+// encodeCursor returns the opaque form of c given to clients.
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// cursorAt returns the cursor after rec in the order given by sortKey.
+func cursorAt(rec Record, sortKey, dir string) pageCursor {
+	c := pageCursor{Sort: sortKey, Dir: dir, ID: rec.ID}
+	switch sortKey {
+	case "plate":
+		c.Key = rec.Plate
+	case "vehicleType":
+		c.Key = rec.VehicleType
+	}
+	return c
+}
+
+// record returns a record sorting where the cursor points.
+func (c pageCursor) record() Record {
+	return Record{ID: c.ID, Plate: c.Key, VehicleType: c.Key}
+}
+
+// cursorPage returns the page of records, sorted by less, following the
+// cursor parameter of r, or the first page for an empty cursor. limit pages
+// as with offsets, which may not be combined with a cursor.
+func cursorPage(r *http.Request, records []Record, less func(a, b Record) bool) ([]Record, pageMetadata, error) {
+	query := r.URL.Query()
+	if query.Has("offset") {
+		return nil, pageMetadata{}, errors.New("The cursor and offset parameters are exclusive")
+	}
+	_, limit, err := parsePagination(r)
+	if err != nil {
+		return nil, pageMetadata{}, err
+	}
+	sortKey, dir := query.Get("sort"), query.Get("dir")
+
+	start := 0
+	if value := query.Get("cursor"); value != "" {
+		after, err := decodeCursor(value)
+		if err != nil || after.Sort != sortKey || after.Dir != dir {
+			return nil, pageMetadata{}, errInvalidCursor
+		}
+		start = sort.Search(len(records), func(i int) bool { return less(after.record(), records[i]) })
+	}
+	end := min(start+limit, len(records))
+	page := records[start:end]
+
+	meta := pageMetadata{
+		Limit:      limit,
+		TotalCount: len(records),
+		HasNext:    end < len(records),
+		HasPrev:    start > 0,
+	}
+	if meta.HasNext {
+		meta.NextCursor = encodeCursor(cursorAt(page[len(page)-1], sortKey, dir))
+		query.Set("cursor", meta.NextCursor)
+		query.Set("limit", strconv.Itoa(limit))
+		meta.NextURL = strings.TrimSuffix(currentSettings().BaseURL, "/") + r.URL.Path + "?" + query.Encode()
+	}
+	return page, meta, nil
+}
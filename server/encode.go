@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// acceptsYAML reports whether the Accept header asks for YAML before JSON.
+func acceptsYAML(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.TrimSpace(mediaType) {
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// encodeBody encodes a response body as JSON, or as YAML for clients asking
+// for it, and returns it along with its Content-Type.
+func encodeBody(r *http.Request, v interface{}) ([]byte, string, error) {
+	if !acceptsYAML(r) {
+		body, err := json.Marshal(v)
+		return append(body, '\n'), "application/json", err
+	}
+	body, err := marshalYAML(v)
+	return body, "application/yaml", err
+}
+
+// marshalYAML encodes v as YAML with the field names and values of its JSON
+// form, so both representations describe the same document.
+func marshalYAML(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(yamlNumbers(generic))
+}
+
+// yamlNumbers replaces the json.Numbers of a generic JSON value with Go
+// numbers, keeping int64 ids exact; YAML would quote them as strings.
+func yamlNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = yamlNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = yamlNumbers(value)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// writeEncoded writes v encoded with encodeBody.
+func writeEncoded(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, contentType, err := encodeBody(r, v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
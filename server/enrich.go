@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DerivedFieldRule computes the derived field Field of records whose plate
+// matches the regular expression Pattern. Value is expanded with the
+// submatches of the plate, e.g. "$1 $2" or "DE-${region}".
+type DerivedFieldRule struct {
+	Field   string `yaml:"field"`
+	Pattern string `yaml:"pattern"`
+	Value   string `yaml:"value"`
+
+	re *regexp.Regexp
+}
+
+// enrichedRecord is a record along with the fields derived from it at
+// response time.
+type enrichedRecord struct {
+	Record
+	Derived map[string]string `json:"derived"`
+}
+
+// compileDerivedFieldRules prepares the rules for deriveFields.
+func compileDerivedFieldRules(rules []DerivedFieldRule) ([]DerivedFieldRule, error) {
+	compiled := make([]DerivedFieldRule, len(rules))
+	for i, rule := range rules {
+		if rule.Field == "" {
+			return nil, fmt.Errorf("derived field rule %d has no field", i)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("derived field rule %d: %v", i, err)
+		}
+		compiled[i] = DerivedFieldRule{Field: rule.Field, Pattern: rule.Pattern, Value: rule.Value, re: re}
+	}
+	return compiled, nil
+}
+
+// deriveFields evaluates the derived field rules against a plate. For each
+// field the first matching rule wins; fields without a match are omitted.
+func deriveFields(plate string) map[string]string {
+	derived := make(map[string]string)
+	for _, rule := range currentSettings().derivedFieldRules {
+		if _, done := derived[rule.Field]; done {
+			continue
+		}
+		match := rule.re.FindStringSubmatchIndex(plate)
+		if match == nil {
+			continue
+		}
+		derived[rule.Field] = string(rule.re.ExpandString(nil, rule.Value, plate, match))
+	}
+	return derived
+}
+
+// enrichRecords returns copies of records with their derived fields. The
+// stored records are left untouched.
+func enrichRecords(records []Record) []enrichedRecord {
+	enriched := make([]enrichedRecord, len(records))
+	for i, rec := range records {
+		enriched[i] = enrichedRecord{Record: rec, Derived: deriveFields(rec.Plate)}
+	}
+	return enriched
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportedRecord is one NDJSON line of the records export.
+type exportedRecord struct {
+	ListID int64 `json:"listId"`
+	Record
+}
+
+// clone returns a copy of the record sharing no memory with it.
+func (rec Record) clone() Record {
+	rec.Tags = append([]string(nil), rec.Tags...)
+	for _, t := range []**time.Time{&rec.ExpiresAt, &rec.ValidFrom, &rec.ValidUntil} {
+		if *t != nil {
+			copied := **t
+			*t = &copied
+		}
+	}
+	return rec
+}
+
+// snapshotRecords deep copies the records of the lists for which keep
+// returns true. The lock is only held for the copy, so exports can stream
+// from it to a slow client without blocking writers, and no update can
+// tear what they stream.
+func (s *MemoryStorage) snapshotRecords(keep func(listID int64) bool) map[int64][]Record {
+	s.Lock()
+	defer s.Unlock()
+	snapshot := make(map[int64][]Record)
+	for id, records := range s.Records {
+		if !keep(id) {
+			continue
+		}
+		copied := make([]Record, len(records))
+		for i, rec := range records {
+			copied[i] = rec.clone()
+		}
+		snapshot[id] = copied
+	}
+	return snapshot
+}
+
+// exportAllHandler streams the unexpired records of all lists, or of the
+// lists named in the comma-separated ids parameter, as NDJSON, from a
+// snapshot.
+func exportAllHandler(w http.ResponseWriter, r *http.Request) {
+	var filter map[int64]bool
+	if ids := r.URL.Query().Get("ids"); ids != "" {
+		filter = make(map[int64]bool)
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_request", "Invalid ids parameter")
+				return
+			}
+			filter[id] = true
+		}
+	}
+
+	snapshot := storage.snapshotRecords(func(id int64) bool { return filter == nil || filter[id] })
+
+	ids := make([]int64, 0, len(snapshot))
+	for id := range snapshot {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		for _, rec := range snapshot[id] {
+			if rec.expired(now) {
+				continue
+			}
+			if err := r.Context().Err(); err != nil {
+				log.Printf("Export of records stopped: %v", err)
+				return
+			}
+			if err := enc.Encode(exportedRecord{ListID: id, Record: rec}); err != nil {
+				log.Printf("Failed to export records: %v", err)
+				return
+			}
+		}
+	}
+}
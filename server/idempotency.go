@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// idempotentResponse is the response remembered for an Idempotency-Key.
+// It is pending while the first request with the key is being served.
+type idempotentResponse struct {
+	Request [sha256.Size]byte // Hash of the request the key was first used for
+	Pending bool
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Expiry  time.Time
+}
+
+// idempotencyRecorder passes a response through while keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent makes next safe to retry with an Idempotency-Key header. The
+// first response for a key is kept for idempotency_window and replayed to
+// retries instead of serving them again. Keys are scoped to the user, and
+// reusing one for a different request is rejected. Server errors and
+// panics are not kept, so such requests can be retried for real.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid Idempotency-Key header")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		request := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+		scope := strconv.FormatInt(requestUserID(r), 10) + ":" + key
+
+		now := time.Now()
+		storage.Lock()
+		stored, ok := storage.Idempotency[scope]
+		if ok && now.Before(stored.Expiry) {
+			storage.Unlock()
+			switch {
+			case stored.Request != request:
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable", "Idempotency-Key reused for a different request")
+			case stored.Pending:
+				writeError(w, http.StatusConflict, "conflict", "Request with this Idempotency-Key in progress")
+			default:
+				for name, values := range stored.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+			}
+			return
+		}
+		storage.Idempotency[scope] = idempotentResponse{
+			Request: request,
+			Pending: true,
+			Expiry:  now.Add(currentSettings().IdempotencyWindow),
+		}
+		storage.Unlock()
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		served := false
+		defer func() {
+			// A panicking handler would otherwise leave the key pending for
+			// the whole window; the panic goes on to net/http.
+			if !served {
+				storage.Lock()
+				delete(storage.Idempotency, scope)
+				storage.Unlock()
+			}
+		}()
+		next(rec, r)
+		served = true
+
+		storage.Lock()
+		defer storage.Unlock()
+		if rec.status >= http.StatusInternalServerError {
+			delete(storage.Idempotency, scope)
+			return
+		}
+		stored = storage.Idempotency[scope]
+		stored.Pending = false
+		stored.Status = rec.status
+		stored.Header = w.Header().Clone()
+		stored.Body = rec.body.Bytes()
+		storage.Idempotency[scope] = stored
+	}
+}
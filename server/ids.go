@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator allocates the ids of new lists and records.
+type IDGenerator interface {
+	// NextID returns an id never returned or reserved before.
+	NextID() int64
+	// Reserve marks an id as taken, e.g. one loaded from disk or chosen by
+	// a client, so it is never returned by NextID.
+	Reserve(id int64)
+}
+
+// counterIDs hands out increasing ids from an atomic counter. Unlike ids
+// read from the clock, concurrent requests never get the same id.
+type counterIDs struct {
+	last atomic.Int64
+}
+
+// newCounterIDs starts the counter at the current time, so ids keep
+// increasing across restarts even without persisted state to reserve.
+func newCounterIDs() *counterIDs {
+	c := &counterIDs{}
+	c.last.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *counterIDs) NextID() int64 {
+	return c.last.Add(1)
+}
+
+func (c *counterIDs) Reserve(id int64) {
+	for {
+		last := c.last.Load()
+		if id <= last || c.last.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+// ids allocates the ids of lists and records. Tests may swap it.
+var ids IDGenerator = newCounterIDs()
+
+// reserveStoredIDs reserves the ids of all lists and records. The caller
+// must hold the storage lock.
+func reserveStoredIDs() {
+	for id, records := range storage.Records {
+		ids.Reserve(id)
+		for _, rec := range records {
+			ids.Reserve(rec.ID)
+		}
+	}
+	for id := range storage.Lists {
+		ids.Reserve(id)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// compactionCooldown is the minimum time between two on-demand token
+// compactions, so a flood of valid logins above the threshold does not
+// rescan the token map on every request.
+const compactionCooldown = 10 * time.Second
+
+// lastCompaction is when compactTokens last ran; guarded by storage.
+var lastCompaction time.Time
+
+// cleanupEvent reports the outcome of one janitor pass.
+type cleanupEvent struct {
+	Time            time.Time `json:"time"`
+	PurgedTokens    int       `json:"purgedTokens"`
+	PurgedShares    int       `json:"purgedShares"`
+	PurgedRecords   int       `json:"purgedRecords"`
+	RemainingTokens int       `json:"remainingTokens"`
+}
+
+// onCleanup, when set, receives the event of every janitor pass. It is
+// called from the janitor goroutine without the storage lock held.
+var onCleanup func(cleanupEvent)
+
+// startJanitor periodically purges expired entries from storage.
+func startJanitor(interval time.Duration) {
+	go func() {
+		for now := range time.Tick(interval) {
+			janitorPass(now)
+		}
+	}()
+}
+
+// janitorPass purges the entries expired at now, counts the purged tokens
+// in amv_janitor_purged_tokens_total and notifies onCleanup.
+func janitorPass(now time.Time) cleanupEvent {
+	storage.Lock()
+	tokens, shares := purgeExpired(now)
+	records := purgeExpiredRecords(now)
+	event := cleanupEvent{Time: now, PurgedTokens: tokens, PurgedShares: shares, PurgedRecords: len(records), RemainingTokens: len(storage.Tokens)}
+	storage.Unlock()
+
+	for _, purged := range records {
+		recordChanged("", auditDelete, purged.listID, purged.record)
+	}
+	if len(records) > 0 && persist != nil {
+		persist.MarkDirty()
+	}
+	countMetric("amv_janitor_runs_total")
+	metrics.Add("amv_janitor_purged_tokens_total", int64(tokens))
+	if tokens+shares+len(records) > 0 {
+		log.Printf("Janitor purged %d tokens, %d shares and %d records, %d tokens remain", tokens, shares, len(records), event.RemainingTokens)
+	}
+	if onCleanup != nil {
+		onCleanup(event)
+	}
+	return event
+}
+
+// cleanupWebhook returns an onCleanup callback posting each event that
+// purged something to url as JSON.
+func cleanupWebhook(url string) func(cleanupEvent) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(event cleanupEvent) {
+		if event.PurgedTokens+event.PurgedShares+event.PurgedRecords == 0 {
+			return
+		}
+		body, _ := json.Marshal(event)
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Cleanup webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Cleanup webhook returned %s", resp.Status)
+		}
+	}
+}
+
+// purgeExpired removes tokens, shares, revocations, idempotency keys and
+// failed login counts expired at now and returns how many tokens and shares
+// were removed. The caller must hold the storage lock.
+func purgeExpired(now time.Time) (tokens, shares int) {
+	for token, session := range storage.Tokens {
+		if now.After(session.Expiry) {
+			delete(storage.Tokens, token)
+			tokens++
+		}
+	}
+	for token, share := range storage.Shares {
+		if now.After(share.Expiry) {
+			delete(storage.Shares, token)
+			shares++
+		}
+	}
+	// Expired tokens are rejected anyway, no need to remember revoking them.
+	for id, expiry := range storage.Revoked {
+		if now.After(expiry) {
+			delete(storage.Revoked, id)
+		}
+	}
+	for key, response := range storage.Idempotency {
+		if now.After(response.Expiry) {
+			delete(storage.Idempotency, key)
+		}
+	}
+	for username, failures := range storage.LoginFailures {
+		if now.After(failures.Expiry) && now.After(failures.LockedUntil) {
+			delete(storage.LoginFailures, username)
+		}
+	}
+	return tokens, shares
+}
+
+// purgedRecord is a record removed by purgeExpiredRecords.
+type purgedRecord struct {
+	listID int64
+	record Record
+}
+
+// purgeExpiredRecords removes the records expired at now and returns them.
+// The caller must hold the storage lock.
+func purgeExpiredRecords(now time.Time) []purgedRecord {
+	var purged []purgedRecord
+	for listID, records := range storage.Records {
+		kept := records[:0]
+		for _, rec := range records {
+			if rec.expired(now) {
+				purged = append(purged, purgedRecord{listID: listID, record: rec})
+				storage.plates.remove(listID, rec.ID)
+				continue
+			}
+			kept = append(kept, rec)
+		}
+		storage.Records[listID] = kept
+	}
+	return purged
+}
+
+// compactTokens purges expired tokens ahead of the next janitor run when the
+// token map grew past the token compaction threshold. The caller must hold
+// the storage lock.
+func compactTokens(now time.Time) {
+	threshold := currentSettings().TokenCompactionThreshold
+	if threshold <= 0 || len(storage.Tokens) < threshold {
+		return
+	}
+	if now.Sub(lastCompaction) < compactionCooldown {
+		return
+	}
+	lastCompaction = now
+	purged, _ := purgeExpired(now)
+	log.Printf("Token map over %d entries, compacted %d expired tokens", threshold, purged)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenClaims are the claims of a session token. They carry everything
+// tokenMiddleware needs, so a token is validated without a storage lookup,
+// except the role: it is resolved when the token is used, so that a change
+// of roles, admin_users or default_role applies to issued tokens too.
+type tokenClaims struct {
+	Subject     string `json:"sub"`
+	User        string `json:"name,omitempty"`
+	ExpiresAt   int64  `json:"exp"`
+	IssuedAt    int64  `json:"iat"`
+	ID          string `json:"jti"`
+	Fingerprint string `json:"fp,omitempty"`
+	CSRF        string `json:"csrf,omitempty"`
+}
+
+// jwtHeader is the fixed, pre-encoded header of all issued tokens.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// jwtSecret signs session tokens. Without jwt_secret in the config a random
+// secret is used, which invalidates all tokens on restart.
+var jwtSecret = randomBytes(32)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+	errRevokedToken = errors.New("token revoked")
+)
+
+// generateToken returns an HMAC-SHA256 signed token for the session, a
+// compact one with stateless_tokens and a JWT otherwise.
+func generateToken(session Session) string {
+	if currentSettings().StatelessTokens {
+		return generateCompactToken(session)
+	}
+	claims := tokenClaims{
+		Subject:     strconv.FormatInt(session.ID, 10),
+		User:        session.User,
+		ExpiresAt:   session.Expiry.Unix(),
+		IssuedAt:    time.Now().Unix(),
+		ID:          randomToken(),
+		Fingerprint: session.Fingerprint,
+		CSRF:        session.CSRF,
+	}
+	payload, _ := json.Marshal(claims)
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signJWT(unsigned)
+}
+
+// parseToken verifies the token signature and returns its claims. It does
+// not check expiry or revocation, see authenticate.
+func parseToken(token string) (tokenClaims, error) {
+	if strings.HasPrefix(token, compactPrefix) {
+		return parseCompactToken(token)
+	}
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signJWT(parts[0]+"."+parts[1]))) {
+		return claims, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+// authenticate validates a token and returns the session it describes.
+func authenticate(token string) (Session, error) {
+	claims, err := parseToken(token)
+	if err != nil {
+		return Session{}, err
+	}
+	expiry := time.Unix(claims.ExpiresAt, 0)
+	if time.Now().After(expiry) {
+		return Session{}, errExpiredToken
+	}
+	storage.Lock()
+	_, revoked := storage.Revoked[claims.ID]
+	storage.Unlock()
+	if revoked {
+		return Session{}, errRevokedToken
+	}
+
+	id, _ := strconv.ParseInt(claims.Subject, 10, 64)
+	return Session{
+		Expiry:      expiry,
+		ID:          id,
+		User:        claims.User,
+		Fingerprint: claims.Fingerprint,
+		CSRF:        claims.CSRF,
+		Role:        accountRole(claims.User),
+	}, nil
+}
+
+// revokeToken drops the token's session and, since the token would stay
+// valid on its own until it expires, adds it to the revocation set. The
+// caller must hold the storage lock.
+func revokeToken(token string) {
+	delete(storage.Tokens, token)
+	if claims, err := parseToken(token); err == nil {
+		storage.Revoked[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	}
+}
+
+// randomToken returns 32 bytes from crypto/rand, base64url encoded. Unlike
+// timestamps it can neither be guessed nor collide under rapid logins.
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(32))
+}
+
+func signJWT(unsigned string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
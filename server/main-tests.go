@@ -1,15 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
 )
 
 func TestLoginHandler(t *testing.T) {
@@ -32,129 +49,4878 @@ func TestLoginHandler(t *testing.T) {
 	}
 }
 
-func TestVehicleListsHandler(t *testing.T) {
-	// Mock storage
-	storage.Lists = map[int64]VehicleList{
-		1: {ID: 1, DisplayName: "Test List", Name: "testList"},
+func TestLoginServiceAccounts(t *testing.T) {
+	prevCost := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	defer func() { bcryptCost = prevCost }()
+	if err := seedUsers([]ServiceAccount{
+		{Username: "gate-1", Password: "s3cret-gate", Role: roleAdmin},
+		{Username: "kiosk", Password: "kiosk-pass"},
+	}); err != nil {
+		t.Fatalf("failed to seed users: %v", err)
 	}
+	defer seedUsers(nil)
 
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
-	w := httptest.NewRecorder()
+	login := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		loginHandler(w, req)
+		return w
+	}
 
-	vehicleListsHandler(w, req)
+	w := login(`{"username":"gate-1","password":"s3cret-gate"}`)
+	var response map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response["role"] != roleAdmin {
+		t.Errorf("expected the service account to log in as admin, got %v %v", w.Code, response)
+	}
+	if w := login(`{"username":"gate-1","password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for a wrong password, got %v", w.Code)
+	}
+	if w := login(`{"username":"intruder","password":"s3cret-gate"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an unknown user, got %v", w.Code)
+	}
 
-	resp := w.Result()
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected status OK, got %v", resp.StatusCode)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+	w = httptest.NewRecorder()
+	usersHandler(w, req)
+	if strings.Contains(w.Body.String(), "$2a$") || strings.Contains(w.Body.String(), "Hash") {
+		t.Errorf("expected no password hashes, got %s", w.Body.String())
+	}
+	var users struct {
+		Entries []userInfo `json:"entries"`
+	}
+	json.NewDecoder(w.Body).Decode(&users)
+	want := []userInfo{{Username: "gate-1", Role: roleAdmin}, {Username: "kiosk", Role: roleViewer}}
+	if !reflect.DeepEqual(users.Entries, want) {
+		t.Errorf("expected users %v, got %v", want, users.Entries)
 	}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		t.Errorf("failed to decode response: %v", err)
+	// Compact tokens carry no role; the account's role is looked up, over
+	// the roles config.
+	withSettings(t, func(s *settings) {
+		s.StatelessTokens = true
+		s.Roles = map[string]string{"gate-1": roleViewer}
+	})
+	for _, user := range []string{"gate-1", "kiosk"} {
+		token := generateToken(Session{ID: userID(user), User: user, Expiry: time.Now().Add(time.Minute), Role: want[0].Role})
+		session, err := authenticate(token)
+		if wantRole := map[string]string{"gate-1": roleAdmin, "kiosk": roleViewer}[user]; err != nil || session.Role != wantRole {
+			t.Errorf("%s: expected a compact token with role %s, got %q: %v", user, wantRole, session.Role, err)
+		}
 	}
+}
 
-	entries := result["entries"].([]interface{})
-	if len(entries) != 1 {
-		t.Errorf("expected 1 list, got %d", len(entries))
+func TestPasswordHandler(t *testing.T) {
+	prevCost := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	defer func() { bcryptCost = prevCost }()
+	if err := seedUsers([]ServiceAccount{{Username: "alice", Password: "Initial-pass1"}}); err != nil {
+		t.Fatalf("failed to seed users: %v", err)
+	}
+	defer seedUsers(nil)
+	now := time.Now()
+	storage.Tokens = map[string]Session{
+		"alice-current": {ID: userID("alice"), User: "alice", Expiry: now.Add(time.Minute)},
+		"alice-other":   {ID: userID("alice"), User: "alice", Expiry: now.Add(time.Minute)},
+		"bob-session":   {ID: userID("bob"), User: "bob", Expiry: now.Add(time.Minute)},
+	}
+	caller := storage.Tokens["alice-current"]
+
+	change := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/password", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer alice-current")
+		req = req.WithContext(contextWithSession(req.Context(), caller))
+		w := httptest.NewRecorder()
+		passwordHandler(w, req)
+		return w
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"currentPassword":"Initial-pass1","newPassword":"Short1"}`, http.StatusBadRequest},
+		{`{"currentPassword":"Initial-pass1","newPassword":"alllowercaseletters"}`, http.StatusBadRequest},
+		{`{"currentPassword":"Initial-pass1","newPassword":"Initial-pass1"}`, http.StatusBadRequest},
+		{`{"newPassword":"Rotated-pass2"}`, http.StatusBadRequest},
+		{`{"currentPassword":"wrong","newPassword":"Rotated-pass2"}`, http.StatusUnauthorized},
+	} {
+		if w := change(tt.body); w.Code != tt.want {
+			t.Errorf("%s: expected status %v, got %v", tt.body, tt.want, w.Code)
+		}
+	}
+
+	w := change(`{"currentPassword":"Initial-pass1","newPassword":"Rotated-pass2","revokeOtherSessions":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	if _, ok := authenticateUser("alice", "Initial-pass1"); ok {
+		t.Error("expected the old password to be rejected")
+	}
+	if _, ok := authenticateUser("alice", "Rotated-pass2"); !ok {
+		t.Error("expected the new password to be accepted")
+	}
+	_, current := storage.Tokens["alice-current"]
+	_, other := storage.Tokens["alice-other"]
+	_, theirs := storage.Tokens["bob-session"]
+	if !current || other || !theirs {
+		t.Errorf("expected only the other session of the caller to be revoked, got current %v other %v theirs %v", current, other, theirs)
+	}
+
+	// Wrong current passwords lock the account like failed logins.
+	withSettings(t, func(s *settings) {
+		s.LockoutThreshold = 2
+		s.LockoutDuration = time.Minute
+	})
+	storage.LoginFailures = map[string]loginFailures{}
+	for i := 0; i < 2; i++ {
+		if w := change(`{"currentPassword":"wrong","newPassword":"Rotated-pass3"}`); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status Unauthorized, got %v", w.Code)
+		}
+	}
+	w = change(`{"currentPassword":"Rotated-pass2","newPassword":"Rotated-pass3"}`)
+	if w.Code != http.StatusLocked || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected status Locked with Retry-After, got %v %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"Rotated-pass2"}`))
+	w = httptest.NewRecorder()
+	loginHandler(w, req)
+	if w.Code != http.StatusLocked {
+		t.Errorf("expected logins to be locked too, got %v", w.Code)
 	}
 }
 
-func TestRecordMiddleware(t *testing.T) {
-	// Mock request
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
-	w := httptest.NewRecorder()
+func TestLoginLockout(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.LockoutThreshold = 3
+		s.LockoutDuration = time.Minute
+	})
+	prevCost := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	defer func() { bcryptCost = prevCost }()
+	if err := seedUsers([]ServiceAccount{{Username: "gate-1", Password: "s3cret-gate"}}); err != nil {
+		t.Fatalf("failed to seed users: %v", err)
+	}
+	defer seedUsers(nil)
+	storage.LoginFailures = map[string]loginFailures{}
 
-	called := false
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		called = true
-		id := contextID(r.Context())
-		if id != 1 {
-			t.Errorf("expected id 1, got %d", id)
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"username":"gate-1","password":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		loginHandler(w, req)
+		return w
+	}
+
+	// A success resets the count, so the lock needs 3 failures in a row.
+	login("wrong")
+	login("wrong")
+	if w := login("s3cret-gate"); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := login("wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("attempt %d: expected status Unauthorized, got %v", i, w.Code)
+		}
+	}
+	w := login("s3cret-gate")
+	if w.Code != http.StatusLocked {
+		t.Fatalf("expected status Locked with the right password, got %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// Once the cooldown is over the account recovers.
+	failures := storage.LoginFailures["gate-1"]
+	failures.LockedUntil = time.Now().Add(-time.Second)
+	storage.LoginFailures["gate-1"] = failures
+	if w := login("s3cret-gate"); w.Code != http.StatusOK {
+		t.Errorf("expected status OK after the cooldown, got %v", w.Code)
+	}
+	if _, ok := storage.LoginFailures["gate-1"]; ok {
+		t.Error("expected the failures to be forgotten after a login")
+	}
+}
+
+func TestOpenLoginRefusesAdmins(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.AdminUsers = []string{"admin"}
+		s.Roles = map[string]string{"boss": roleAdmin}
+	})
+	seedUsers(nil)
+	storage.LoginFailures = map[string]loginFailures{}
+
+	tests := []struct {
+		username string
+		status   int
+	}{
+		{"admin", http.StatusUnauthorized},
+		{"boss", http.StatusUnauthorized},
+		{"alice", http.StatusOK},
+	}
+	for _, tt := range tests {
+		body := `{"username":"` + tt.username + `","password":"anything"}`
+		w := httptest.NewRecorder()
+		loginHandler(w, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d without users, got %v", tt.username, tt.status, w.Code)
 		}
+	}
+}
+
+func TestSessionCookieSettings(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.CookieName = "amv_session"
+		s.CookieDomain = "example.com"
+		s.CookiePath = "/amv"
 	})
 
-	recordMiddleware(handler).ServeHTTP(w, req)
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"test","password":"password"}`))
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
 
-	if !called {
-		t.Error("middleware did not call next handler")
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Domain != "example.com" || c.Path != "/amv" {
+			t.Errorf("expected cookie %s on example.com/amv, got %s%s", c.Name, c.Domain, c.Path)
+		}
+		if c.Name == "amv_session" {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatalf("expected an amv_session cookie, got %v", w.Result().Cookies())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+	req.AddCookie(session)
+	if token, _ := requestToken(req); token != session.Value {
+		t.Errorf("expected the token from the amv_session cookie, got %q", token)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+	req.AddCookie(&http.Cookie{Name: "s", Value: session.Value})
+	if token, _ := requestToken(req); token != "" {
+		t.Errorf("expected the default cookie to be ignored, got %q", token)
 	}
 }
 
-func TestHandleGetRecord(t *testing.T) {
-	// Mock storage
-	id := int64(1)
-	record := Record{ID: 100, Plate: "ABC123", VehicleType: "Car"}
-	storage.Records = map[int64][]Record{
-		id: {record},
+func TestTokenMiddlewareBindSessions(t *testing.T) {
+	withSettings(t, func(s *settings) { s.BindSessions = true })
+
+	login := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader([]byte(`{"username":"test","password":"password"}`)))
+	login.RemoteAddr = "192.0.2.10:5000"
+	login.Header.Set("User-Agent", "test-agent")
+	w := httptest.NewRecorder()
+	loginHandler(w, login)
+	cookie := w.Result().Cookies()[0]
+
+	handler := tokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		userAgent  string
+		want       int
+	}{
+		{"same network", "192.0.2.99:6000", "test-agent", http.StatusOK},
+		{"other network", "198.51.100.10:5000", "test-agent", http.StatusUnauthorized},
+		{"other agent", "192.0.2.10:5000", "other-agent", http.StatusUnauthorized},
 	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("User-Agent", tt.userAgent)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
 
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
-	req = req.WithContext(contextWithID(req.Context(), id))
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: expected status %v, got %v", tt.name, tt.want, w.Code)
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		addr, base, want string
+	}{
+		{":9000", "http://localhost:1608", ":9000"},
+		{"", "http://localhost:1608", "localhost:1608"},
+		{"", "https://amv.example.com", "amv.example.com:443"},
+		{"", "http://amv.example.com/app", "amv.example.com:80"},
+	}
+	for _, tt := range tests {
+		got, err := listenAddress(tt.addr, tt.base)
+		if err != nil || got != tt.want {
+			t.Errorf("listenAddress(%q, %q) = %q, %v; want %q", tt.addr, tt.base, got, err, tt.want)
+		}
+	}
+
+	if _, err := listenAddress("", "localhost"); err == nil {
+		t.Error("expected an error for a base URL without host")
+	}
+}
+
+func TestTokenCompaction(t *testing.T) {
+	withSettings(t, func(s *settings) { s.TokenCompactionThreshold = 100 })
+	defer func() { lastCompaction = time.Time{} }()
+
+	login := func() {
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader([]byte(`{"username":"test","password":"password"}`)))
+		loginHandler(httptest.NewRecorder(), req)
+	}
+
+	storage.Tokens = make(map[string]Session)
+	for i := 0; i < 50; i++ {
+		storage.Tokens[strconv.Itoa(i)] = Session{Expiry: time.Now().Add(-time.Minute)}
+	}
+	login()
+	if n := len(storage.Tokens); n != 51 {
+		t.Errorf("expected no compaction below the threshold, got %d tokens", n)
+	}
+
+	for i := 50; i < 150; i++ {
+		storage.Tokens[strconv.Itoa(i)] = Session{Expiry: time.Now().Add(-time.Minute)}
+	}
+	login()
+	if n := len(storage.Tokens); n != 2 {
+		t.Errorf("expected expired tokens to be purged, got %d tokens", n)
+	}
+
+	// A second flood within the cooldown waits for the janitor.
+	for i := 0; i < 150; i++ {
+		storage.Tokens[strconv.Itoa(i)] = Session{Expiry: time.Now().Add(-time.Minute)}
+	}
+	login()
+	if n := len(storage.Tokens); n != 153 {
+		t.Errorf("expected no compaction within the cooldown, got %d tokens", n)
+	}
+}
+
+func TestJanitorCleanupEvent(t *testing.T) {
+	now := time.Now()
+	storage.Tokens = map[string]Session{
+		"expired1": {Expiry: now.Add(-time.Minute)},
+		"expired2": {Expiry: now.Add(-time.Second)},
+		"valid":    {Expiry: now.Add(time.Minute)},
+	}
+
+	var events []cleanupEvent
+	onCleanup = func(event cleanupEvent) { events = append(events, event) }
+	defer func() { onCleanup = nil }()
+	purged := metrics.Value("amv_janitor_purged_tokens_total")
+
+	janitorPass(now)
+
+	if len(events) != 1 {
+		t.Fatalf("expected one cleanup event, got %d", len(events))
+	}
+	if events[0].PurgedTokens != 2 || events[0].RemainingTokens != 1 {
+		t.Errorf("expected 2 purged and 1 remaining token, got %+v", events[0])
+	}
+	if got := metrics.Value("amv_janitor_purged_tokens_total"); got != purged+2 {
+		t.Errorf("expected purged tokens to be counted, got %v", got-purged)
+	}
+
+	var received cleanupEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	cleanupWebhook(server.URL)(events[0])
+	if received.PurgedTokens != 2 {
+		t.Errorf("expected the webhook to receive the event, got %+v", received)
+	}
+}
+
+func TestValidateTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(cert, []byte("cert"), 0o600)
+	os.WriteFile(key, []byte("key"), 0o600)
+
+	if err := validateTLSFiles("", ""); err != nil {
+		t.Errorf("expected plain HTTP to be valid, got %v", err)
+	}
+	if err := validateTLSFiles(cert, key); err != nil {
+		t.Errorf("expected existing files to be valid, got %v", err)
+	}
+	if err := validateTLSFiles(cert, ""); err == nil {
+		t.Error("expected an error for a cert without key")
+	}
+	if err := validateTLSFiles(cert, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://amv.example.com/api/v1/vehiclelists?offset=20", nil)
 	w := httptest.NewRecorder()
 
-	handleGetRecord(w, req)
+	httpsRedirectHandler("https://amv.example.com:8443").ServeHTTP(w, req)
 
-	resp := w.Result()
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected status OK, got %v", resp.StatusCode)
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("expected status Moved Permanently, got %v", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://amv.example.com:8443/api/v1/vehiclelists?offset=20" {
+		t.Errorf("unexpected redirect location %q", loc)
 	}
+}
 
-	var result map[string][]Record
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		t.Errorf("failed to decode response: %v", err)
+func TestTokenMiddlewareCSRF(t *testing.T) {
+
+	login := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader([]byte(`{"username":"test","password":"password"}`)))
+	w := httptest.NewRecorder()
+	loginHandler(w, login)
+	var body struct {
+		CSRFToken string `json:"csrfToken"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	var session, csrf *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		switch c.Name {
+		case "s":
+			session = c
+		case "csrf":
+			csrf = c
+		}
+	}
+	if session == nil || csrf == nil || csrf.Value != body.CSRFToken || csrf.HttpOnly {
+		t.Fatalf("expected session and readable CSRF cookies matching the body, got %v", w.Result().Cookies())
 	}
 
-	if len(result["entries"]) != 1 || result["entries"][0].ID != record.ID {
-		t.Errorf("unexpected record returned: %v", result["entries"])
+	handler := tokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		method string
+		bearer bool
+		header string
+		want   int
+	}{
+		{"get", http.MethodGet, false, "", http.StatusOK},
+		{"post without token", http.MethodPost, false, "", http.StatusForbidden},
+		{"delete with wrong token", http.MethodDelete, false, "nope", http.StatusForbidden},
+		{"put with token", http.MethodPut, false, body.CSRFToken, http.StatusOK},
+		{"bearer post", http.MethodPost, true, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelists", nil)
+		if tt.bearer {
+			req.Header.Set("Authorization", "Bearer "+session.Value)
+		} else {
+			req.AddCookie(session)
+		}
+		if tt.header != "" {
+			req.Header.Set("X-CSRF-Token", tt.header)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: expected status %v, got %v", tt.name, tt.want, w.Code)
+		}
 	}
 }
 
-func TestHandlePostRecord(t *testing.T) {
-	// Mock storage
-	id := int64(1)
-	storage.Records = map[int64][]Record{
-		id: {},
+func TestTokenMiddlewareClientSeq(t *testing.T) {
+	withSettings(t, func(s *settings) { s.EnforceClientSeq = true })
+
+	session := Session{Expiry: time.Now().Add(time.Minute), ID: 1}
+	token := generateToken(session)
+	storage.Tokens = map[string]Session{token: session}
+	handler := tokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		seq  string
+		want int
+	}{
+		{"1", http.StatusOK},
+		{"3", http.StatusOK},
+		{"2", http.StatusConflict},
+		{"3", http.StatusConflict},
+		{"", http.StatusOK},
+		{"x", http.StatusBadRequest},
+		{"4", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if tt.seq != "" {
+			req.Header.Set("X-Client-Seq", tt.seq)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("seq %q: expected status %v, got %v", tt.seq, tt.want, w.Code)
+		}
 	}
+}
 
-	reqBody := `{"id":101,"plate":"XYZ789","vehicleType":"Truck"}`
-	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", bytes.NewReader([]byte(reqBody)))
-	req = req.WithContext(contextWithID(req.Context(), id))
+func TestRefreshHandler(t *testing.T) {
+
+	session := Session{Expiry: time.Now().Add(time.Second), ID: 7, CSRF: "c"}
+	oldToken := generateToken(session)
+	session.Expiry = time.Now().Add(-time.Second)
+	expiredToken := generateToken(session)
+	storage.Tokens = map[string]Session{oldToken: session, expiredToken: session}
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "s", Value: oldToken})
 	w := httptest.NewRecorder()
 
-	handlePostRecord(w, req)
+	refreshHandler(w, req)
 
-	resp := w.Result()
-	if resp.StatusCode != http.StatusCreated {
-		t.Errorf("expected status Created, got %v", resp.StatusCode)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != "s" || cookie.Value == oldToken {
+		t.Fatalf("expected a new session cookie, got %v", cookie)
+	}
+	if _, exists := storage.Tokens[oldToken]; exists {
+		t.Error("old token was not deleted")
+	}
+	if _, err := authenticate(oldToken); err != errRevokedToken {
+		t.Errorf("expected the old token to be revoked, got %v", err)
+	}
+	session, exists := storage.Tokens[cookie.Value]
+	if !exists || session.ID != 7 || time.Until(session.Expiry) < 30*time.Second {
+		t.Errorf("new token not stored with a fresh expiry: %+v", session)
 	}
 
-	// Verify record added
-	if len(storage.Records[id]) != 1 || storage.Records[id][0].Plate != "XYZ789" {
-		t.Errorf("record not added correctly: %v", storage.Records[id])
+	req = httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "s", Value: expiredToken})
+	w = httptest.NewRecorder()
+
+	refreshHandler(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an expired token, got %v", w.Code)
 	}
 }
 
-func TestHandleDeleteRecord(t *testing.T) {
+func TestAuthenticateJWT(t *testing.T) {
+	session := Session{Expiry: time.Now().Add(time.Minute), ID: 42, User: "test"}
+	token := generateToken(session)
+
+	got, err := authenticate(token)
+	if err != nil || got.ID != 42 || got.User != "test" {
+		t.Fatalf("expected a valid token for user 42, got %+v, %v", got, err)
+	}
+
+	// Swap in claims for another user, keeping the original signature.
+	parts := strings.Split(token, ".")
+	forged := strings.Split(generateToken(Session{Expiry: session.Expiry, ID: 1}), ".")
+	tampered := parts[0] + "." + forged[1] + "." + parts[2]
+	if _, err := authenticate(tampered); err != errInvalidToken {
+		t.Errorf("expected a tampered token to be invalid, got %v", err)
+	}
+
+	expired := generateToken(Session{Expiry: time.Now().Add(-time.Second), ID: 42})
+	if _, err := authenticate(expired); err != errExpiredToken {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	logoutHandler(httptest.NewRecorder(), req)
+	if _, err := authenticate(token); err != errRevokedToken {
+		t.Errorf("expected a logged out token to be revoked, got %v", err)
+	}
+}
+
+func TestWhoamiHandler(t *testing.T) {
+	withSettings(t, func(s *settings) { s.AdminUsers = []string{"test"} })
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	token := generateToken(Session{Expiry: expiry, ID: 42, User: "test", Role: roleAdmin})
+	handler := tokenMiddleware(http.HandlerFunc(whoamiHandler))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var got whoami
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if w.Code != http.StatusOK || got.UserID != 42 || got.User != "test" || got.Role != roleAdmin {
+		t.Fatalf("expected user 42 as admin, got %v %+v", w.Code, got)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expiry) {
+		t.Errorf("expected expiry %v, got %v", expiry, got.ExpiresAt)
+	}
+	if got.ExpiresIn == nil || *got.ExpiresIn <= 0 || *got.ExpiresIn > 60 {
+		t.Errorf("expected at most a minute left, got %v", got.ExpiresIn)
+	}
+
+	// A demoted admin loses the role on tokens already issued.
+	withSettings(t, func(s *settings) { s.AdminUsers = nil })
+	if session, err := authenticate(token); err != nil || session.Role == roleAdmin {
+		t.Errorf("expected the token to lose the admin role, got %q: %v", session.Role, err)
+	}
+
+	expired := generateToken(Session{Expiry: time.Now().Add(-time.Second), ID: 42})
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+expired)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an expired token, got %v", w.Code)
+	}
+}
+
+func TestAuthenticateCompact(t *testing.T) {
+	withSettings(t, func(s *settings) { s.StatelessTokens = true })
+
+	session := Session{
+		Expiry:      time.Now().Add(time.Minute),
+		ID:          42,
+		User:        "test",
+		Fingerprint: "00112233445566778899aabbccddeeff",
+		CSRF:        "ffeeddccbbaa99887766554433221100",
+	}
+	token := generateToken(session)
+	if !strings.HasPrefix(token, compactPrefix) {
+		t.Fatalf("expected a compact token, got %q", token)
+	}
+
+	got, err := authenticate(token)
+	if err != nil || got.ID != 42 || got.User != "test" || got.Fingerprint != session.Fingerprint || got.CSRF != session.CSRF {
+		t.Fatalf("expected a valid token for user 42, got %+v, %v", got, err)
+	}
+	if !got.Expiry.Equal(time.Unix(session.Expiry.Unix(), 0)) {
+		t.Errorf("expected expiry %v, got %v", session.Expiry, got.Expiry)
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, compactPrefix))
+	data[7] ^= 1 // user id 42 -> 43
+	if _, err := authenticate(compactPrefix + base64.RawURLEncoding.EncodeToString(data)); err != errInvalidToken {
+		t.Errorf("expected a tampered token to be invalid, got %v", err)
+	}
+
+	expired := generateToken(Session{Expiry: time.Now().Add(-time.Second), ID: 42})
+	if _, err := authenticate(expired); err != errExpiredToken {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+
+	storage.Lock()
+	revokeToken(token)
+	storage.Unlock()
+	if _, err := authenticate(token); err != errRevokedToken {
+		t.Errorf("expected a revoked token to be rejected, got %v", err)
+	}
+}
+
+func TestGenerateTokenUnique(t *testing.T) {
+	session := Session{Expiry: time.Now().Add(time.Minute), ID: 42}
+	seen := make(map[string]bool)
+	ids := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		token := generateToken(session)
+		if seen[token] {
+			t.Fatalf("duplicate token after %d calls", i)
+		}
+		seen[token] = true
+
+		claims, err := parseToken(token)
+		if err != nil {
+			t.Fatalf("failed to parse token: %v", err)
+		}
+		if raw, err := base64.RawURLEncoding.DecodeString(claims.ID); err != nil || len(raw) != 32 || ids[claims.ID] {
+			t.Fatalf("token id %q is not 32 unique random bytes", claims.ID)
+		}
+		ids[claims.ID] = true
+	}
+}
+
+func TestVehicleListsHandler(t *testing.T) {
 	// Mock storage
-	id := int64(1)
-	record := Record{ID: 100, Plate: "ABC123", VehicleType: "Car"}
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Test List", Name: "testList"},
+	}
 	storage.Records = map[int64][]Record{
-		id: {record},
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
 	}
 
-	req := httptest.NewRequest(http.MethodDelete, "/api/v1/vehiclelist/record?id=1&recordId=100", nil)
-	req = req.WithContext(contextWithID(req.Context(), id))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
 	w := httptest.NewRecorder()
 
-	handleDeleteRecord(w, req)
+	vehicleListsHandler(w, req)
 
 	resp := w.Result()
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("expected status OK, got %v", resp.StatusCode)
 	}
 
-	// Verify record deleted
-	if len(storage.Records[id]) != 0 {
-		t.Errorf("record not deleted correctly: %v", storage.Records[id])
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Errorf("failed to decode response: %v", err)
+	}
+
+	entries := result["entries"].([]interface{})
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 list, got %d", len(entries))
+	}
+	if count := entries[0].(map[string]interface{})["recordCount"]; count != 2.0 {
+		t.Errorf("expected recordCount 2, got %v", count)
+	}
+}
+
+func TestHeadCounts(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Test List"},
+		2: {ID: 2, DisplayName: "Empty List"},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
+	}
+
+	req := httptest.NewRequest(http.MethodHead, "/api/v1/vehiclelists", nil)
+	w := httptest.NewRecorder()
+	vehicleListsHandler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Total-Count") != "2" || w.Body.Len() != 0 {
+		t.Errorf("expected 2 lists and no body, got %v %q %q", w.Code, w.Header().Get("X-Total-Count"), w.Body.String())
+	}
+
+	for id, want := range map[int64]string{1: "2", 2: "0"} {
+		req = httptest.NewRequest(http.MethodHead, "/api/v1/vehiclelist/record?id="+strconv.FormatInt(id, 10), nil)
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w = httptest.NewRecorder()
+		recordHandler(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("X-Total-Count") != want {
+			t.Errorf("list %d: expected %s records, got %v %q", id, want, w.Code, w.Header().Get("X-Total-Count"))
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodHead, "/api/v1/vehiclelist/record?id=3", nil)
+	req = req.WithContext(contextWithID(req.Context(), 3))
+	w = httptest.NewRecorder()
+	recordHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown list, got %v", w.Code)
+	}
+}
+
+func TestVehicleListsV2Handler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Test List", Name: "testList"},
+		2: {ID: 2, DisplayName: "Empty List", Name: "emptyList", Order: 1},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
+	}
+
+	get := func(query string) []map[string]json.RawMessage {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/vehiclelists"+query, nil)
+		w := httptest.NewRecorder()
+		vehicleListsV2Handler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status OK, got %v", w.Code)
+		}
+		var result struct {
+			Entries []map[string]json.RawMessage `json:"entries"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(result.Entries) != 2 {
+			t.Fatalf("expected 2 lists, got %d", len(result.Entries))
+		}
+		return result.Entries
+	}
+
+	// Without expand the lists look like v1.
+	for _, entry := range get("") {
+		if _, ok := entry["records"]; ok {
+			t.Error("expected no records without expand")
+		}
+	}
+
+	entries := get("?expand=records")
+	var records []Record
+	json.Unmarshal(entries[0]["records"], &records)
+	if len(records) != 2 || records[0].Plate != "ABC123" {
+		t.Errorf("expected the 2 records of the first list, got %v", records)
+	}
+	if string(entries[1]["records"]) != "[]" {
+		t.Errorf("expected an empty records array, got %s", entries[1]["records"])
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/vehiclelists?expand=owner", nil)
+	w := httptest.NewRecorder()
+	vehicleListsV2Handler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an unknown expand, got %v", w.Code)
+	}
+}
+
+func TestVehicleListsHandlerSort(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, Name: "b", Order: 2},
+		2: {ID: 2, Name: "c", Order: 0},
+		3: {ID: 3, Name: "a", Order: 1},
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{2, 3, 1}},
+		{"?sort=name", []int64{3, 1, 2}},
+		{"?sort=name&dir=desc", []int64{2, 1, 3}},
+		{"?sort=order&limit=2&offset=1", []int64{3, 1}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists"+tt.query, nil)
+		w := httptest.NewRecorder()
+
+		vehicleListsHandler(w, req)
+
+		var result struct {
+			Entries []VehicleList `json:"entries"`
+		}
+		if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.query, err)
+		}
+		var got []int64
+		for _, l := range result.Entries {
+			got = append(got, l.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: expected %v, got %v", tt.query, tt.want, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+				break
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists?sort=color", nil)
+	w := httptest.NewRecorder()
+	vehicleListsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for unknown sort key, got %v", w.Code)
+	}
+}
+
+func TestVehicleListsHandlerStatus(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, Status: 0, Order: 2},
+		2: {ID: 2, Status: 1, Order: 1},
+		3: {ID: 3, Status: 2, Order: 0},
+		4: {ID: 4, Status: 1, Order: 3},
+	}
+
+	tests := []struct {
+		query string
+		code  int
+		want  []int64
+	}{
+		{"?status=1", http.StatusOK, []int64{2, 4}},
+		{"?status=0,2", http.StatusOK, []int64{3, 1}},
+		{"?status=1&sort=order&dir=desc&limit=1", http.StatusOK, []int64{4}},
+		{"?status=1,x", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists"+tt.query, nil)
+		w := httptest.NewRecorder()
+
+		vehicleListsHandler(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("%q: expected status %v, got %v", tt.query, tt.code, w.Code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var result struct{ Entries []VehicleList }
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%q: failed to decode response: %v", tt.query, err)
+		}
+		var got []int64
+		for _, list := range result.Entries {
+			got = append(got, list.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestVehicleListsHandlerModifiedSince(t *testing.T) {
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, UpdatedAt: since.Add(-time.Hour)},
+		2: {ID: 2, UpdatedAt: since.Add(time.Hour)},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists?modifiedSince="+since.Format(time.RFC3339), nil)
+	w := httptest.NewRecorder()
+	vehicleListsHandler(w, req)
+
+	var result struct{ Entries []VehicleList }
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result.Entries) != 1 || result.Entries[0].ID != 2 {
+		t.Errorf("expected only list 2, got %+v", result.Entries)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists?modifiedSince=yesterday", nil)
+	w = httptest.NewRecorder()
+	vehicleListsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an invalid time, got %v", w.Code)
+	}
+
+	// Updates move a list past the sync point.
+	req = httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelists?id=1", bytes.NewReader([]byte(`{"displayName":"Renamed"}`)))
+	w = httptest.NewRecorder()
+	vehicleListsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	if !storage.Lists[1].UpdatedAt.After(since) {
+		t.Errorf("expected updatedAt to be set on update, got %v", storage.Lists[1].UpdatedAt)
+	}
+}
+
+func TestCopyListHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff", Color: "#ff0000", Owner: 7},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123", Tags: []string{"ev"}}, {ID: 101, Plate: "XYZ789"}},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/copy?id=1", nil)
+	req.Header.Set("User-ID", "8")
+	w := httptest.NewRecorder()
+	recordMiddleware(http.HandlerFunc(copyListHandler)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status Created, got %v", w.Code)
+	}
+	var list VehicleList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if list.ID == 1 || list.DisplayName != "Copy of Staff" || list.Color != "#ff0000" || list.Owner != 8 {
+		t.Errorf("unexpected copy: %+v", list)
+	}
+	copied := storage.Records[list.ID]
+	if len(copied) != 2 || copied[0].Plate != "ABC123" || copied[1].Plate != "XYZ789" {
+		t.Fatalf("expected the records to be copied, got %v", copied)
+	}
+	if copied[0].ID == 100 || copied[0].ID == copied[1].ID {
+		t.Errorf("expected new record ids, got %v", copied)
+	}
+	copied[0].Tags[0] = "changed"
+	if storage.Records[1][0].Tags[0] != "ev" {
+		t.Error("expected the copied records not to share tags with the original")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/copy?id=2", nil)
+	w = httptest.NewRecorder()
+	recordMiddleware(http.HandlerFunc(copyListHandler)).ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found, got %v", w.Code)
+	}
+
+	// A copy is held to the rules of a created list.
+	maxDisplayName := currentSettings().MaxDisplayNameLength
+	withSettings(t, func(s *settings) { s.MaxDisplayNameLength = len("Copy of Staff") - 1 })
+	lists := len(storage.Lists)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/copy?id=1", nil)
+	w = httptest.NewRecorder()
+	recordMiddleware(http.HandlerFunc(copyListHandler)).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for a display name too long, got %v", w.Code)
+	}
+	withSettings(t, func(s *settings) {
+		s.MaxDisplayNameLength = maxDisplayName
+		s.MaxRecordsPerList = 1
+	})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/copy?id=1", nil)
+	w = httptest.NewRecorder()
+	recordMiddleware(http.HandlerFunc(copyListHandler)).ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict for a list over capacity, got %v", w.Code)
+	}
+	if len(storage.Lists) != lists {
+		t.Errorf("expected no list to be created, got %d lists", len(storage.Lists))
+	}
+}
+
+func TestListArchiveHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff"},
+		2: {ID: 2, DisplayName: "Visitors"},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}},
+	}
+
+	post := func(handler http.Handler, query string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/archive"+query, nil)
+		w := httptest.NewRecorder()
+		recordMiddleware(handler).ServeHTTP(w, req)
+		return w.Code
+	}
+	listIDs := func(query string) []int64 {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists"+query, nil)
+		w := httptest.NewRecorder()
+		vehicleListsHandler(w, req)
+		var result struct{ Entries []VehicleList }
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		var ids []int64
+		for _, list := range result.Entries {
+			ids = append(ids, list.ID)
+		}
+		return ids
+	}
+
+	if code := post(listArchiveHandler(true), "?id=1"); code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", code)
+	}
+	if code := post(listArchiveHandler(true), "?id=3"); code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown list, got %v", code)
+	}
+	if ids := listIDs(""); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("expected the archived list to be hidden, got %v", ids)
+	}
+	if ids := listIDs("?includeArchived=true"); len(ids) != 2 {
+		t.Errorf("expected both lists with includeArchived, got %v", ids)
+	}
+	if len(storage.Records[1]) != 1 {
+		t.Errorf("expected the records of an archived list to be kept, got %v", storage.Records[1])
+	}
+
+	if code := post(listArchiveHandler(false), "?id=1"); code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", code)
+	}
+	if ids := listIDs(""); len(ids) != 2 {
+		t.Errorf("expected the unarchived list to be listed again, got %v", ids)
+	}
+}
+
+func TestUniqueDisplayName(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		withSettings(t, func(s *settings) { s.UniqueDisplayName = enabled })
+		storage.Lists = map[int64]VehicleList{
+			1: {ID: 1, DisplayName: "Staff Cars", Owner: 7},
+			2: {ID: 2, DisplayName: "Visitors", Owner: 7},
+		}
+		want := http.StatusCreated
+		if enabled {
+			want = http.StatusConflict
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists", bytes.NewReader([]byte(`{"displayName":"staff  cars"}`)))
+		req.Header.Set("User-ID", "7")
+		w := httptest.NewRecorder()
+
+		vehicleListsHandler(w, req)
+
+		if w.Code != want {
+			t.Errorf("create (enabled=%v): expected status %v, got %v", enabled, want, w.Code)
+		}
+
+		want = http.StatusOK
+		if enabled {
+			want = http.StatusConflict
+		}
+		req = httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelists?id=2", bytes.NewReader([]byte(`{"displayName":"Staff Cars"}`)))
+		req.Header.Set("User-ID", "7")
+		w = httptest.NewRecorder()
+
+		vehicleListsHandler(w, req)
+
+		if w.Code != want {
+			t.Errorf("rename (enabled=%v): expected status %v, got %v", enabled, want, w.Code)
+		}
+	}
+
+	// Other owners may reuse the name.
+	withSettings(t, func(s *settings) { s.UniqueDisplayName = true })
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists", bytes.NewReader([]byte(`{"displayName":"Staff Cars"}`)))
+	req.Header.Set("User-ID", "8")
+	w := httptest.NewRecorder()
+
+	vehicleListsHandler(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status Created for another owner, got %v", w.Code)
+	}
+}
+
+func TestVehicleListsHandlerValidation(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxDisplayNameLength = 10 })
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff"},
+	}
+
+	tests := []struct {
+		method string
+		body   string
+		field  string
+	}{
+		{http.MethodPost, `{"displayName":"Visitors","color":"#1e90FF"}`, ""},
+		{http.MethodPost, `{"displayName":"Visitors of the week"}`, "displayName"},
+		{http.MethodPost, `{"displayName":"Visitors","name":"` + strings.Repeat("n", 65) + `"}`, "name"},
+		{http.MethodPost, `{"displayName":"Visitors","color":"red"}`, "color"},
+		{http.MethodPost, `{"displayName":"Visitors","color":"#12345"}`, "color"},
+		{http.MethodPut, `{"displayName":"Staff","color":"#GGGGGG"}`, "color"},
+		{http.MethodPut, `{"displayName":"Staff and visitors"}`, "displayName"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelists?id=1", bytes.NewReader([]byte(tt.body)))
+		w := httptest.NewRecorder()
+
+		vehicleListsHandler(w, req)
+
+		if tt.field == "" {
+			if w.Code >= http.StatusBadRequest {
+				t.Errorf("%s %s: expected success, got %v", tt.method, tt.body, w.Code)
+			}
+			continue
+		}
+		var body apiError
+		json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != http.StatusBadRequest || len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != tt.field {
+			t.Errorf("%s %s: expected status Bad Request for %s, got %v %+v", tt.method, tt.body, tt.field, w.Code, body)
+		}
+	}
+	if storage.Lists[1].DisplayName != "Staff" || storage.Lists[1].Color != "" {
+		t.Errorf("expected rejected updates to leave the list alone, got %+v", storage.Lists[1])
+	}
+}
+
+func TestVehicleListsHandlerUniqueName(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff", Name: "staffCars"},
+		2: {ID: 2, DisplayName: "Visitors", Name: "visitors"},
+	}
+	storage.Records = map[int64][]Record{}
+
+	send := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		vehicleListsHandler(w, req)
+		return w.Code
+	}
+	if code := send(http.MethodPost, "/api/v1/vehiclelists", `{"displayName":"More staff","name":"StaffCars"}`); code != http.StatusConflict {
+		t.Errorf("expected status Conflict for a taken name, got %v", code)
+	}
+	if code := send(http.MethodPut, "/api/v1/vehiclelists?id=2", `{"displayName":"Visitors","name":"STAFFCARS"}`); code != http.StatusConflict {
+		t.Errorf("expected status Conflict when renaming to a taken name, got %v", code)
+	}
+	if code := send(http.MethodPut, "/api/v1/vehiclelists?id=1", `{"displayName":"Staff","name":"staffcars"}`); code != http.StatusOK {
+		t.Errorf("expected a list to keep its own name, got %v", code)
+	}
+	if storage.Lists[2].Name != "visitors" {
+		t.Errorf("expected the rejected rename to be ignored, got %q", storage.Lists[2].Name)
+	}
+
+	// Copies get a free name.
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/copy?id=2", nil)
+	req = req.WithContext(contextWithID(req.Context(), 2))
+	w := httptest.NewRecorder()
+	copyListHandler(w, req)
+	var list VehicleList
+	json.NewDecoder(w.Body).Decode(&list)
+	if w.Code != http.StatusCreated || list.Name != "visitors-copy" {
+		t.Errorf("expected a copy named visitors-copy, got %v %q", w.Code, list.Name)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/by-name?name=VISITORS", nil)
+	w = httptest.NewRecorder()
+	listByNameHandler(w, req)
+	list = VehicleList{}
+	json.NewDecoder(w.Body).Decode(&list)
+	if w.Code != http.StatusOK || list.ID != 2 {
+		t.Errorf("expected list 2 by name, got %v %+v", w.Code, list)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/by-name?name=trucks", nil)
+	w = httptest.NewRecorder()
+	listByNameHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown name, got %v", w.Code)
+	}
+}
+
+func TestVehicleListsHandlerETag(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Test List", Name: "testList"},
+	}
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		vehicleListsHandler(w, req)
+		return w
+	}
+
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected status OK with an ETag, got %v %q", w.Code, etag)
+	}
+
+	w = get(etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected an empty Not Modified, got %v %q", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelists?id=1", bytes.NewReader([]byte(`{"displayName":"Renamed"}`)))
+	vehicleListsHandler(httptest.NewRecorder(), req)
+
+	w = get(etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("expected a new ETag after update, got %v %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Test List", Name: "testList", Owner: 7},
+	}
+
+	for _, tt := range []struct {
+		version   string
+		wantOwner bool
+		wantCode  int
+	}{
+		{"", true, http.StatusOK},
+		{"2", true, http.StatusOK},
+		{"1", false, http.StatusOK},
+		{"99", false, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+		if tt.version != "" {
+			req.Header.Set("X-Schema-Version", tt.version)
+		}
+		w := httptest.NewRecorder()
+
+		vehicleListsHandler(w, req)
+
+		if w.Code != tt.wantCode {
+			t.Errorf("version %q: expected status %v, got %v", tt.version, tt.wantCode, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var result struct {
+			Entries []map[string]interface{} `json:"entries"`
+		}
+		json.NewDecoder(w.Body).Decode(&result)
+		entry := result.Entries[0]
+		if _, hasOwner := entry["owner"]; hasOwner != tt.wantOwner {
+			t.Errorf("version %q: expected owner present=%v, got %v", tt.version, tt.wantOwner, entry)
+		}
+		if entry["displayName"] != "Test List" {
+			t.Errorf("version %q: expected displayName to be kept, got %v", tt.version, entry)
+		}
+	}
+}
+
+func TestVehicleListsOrderHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, Order: 0},
+		2: {ID: 2, Order: 1},
+	}
+
+	reqBody := `[{"id":1,"order":5},{"id":3,"order":6}]`
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelists/order", bytes.NewReader([]byte(reqBody)))
+	w := httptest.NewRecorder()
+
+	vehicleListsOrderHandler(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found, got %v", w.Code)
+	}
+	if storage.Lists[1].Order != 0 {
+		t.Errorf("list reordered despite unknown id: %v", storage.Lists[1])
+	}
+
+	reqBody = `[{"id":1,"order":5},{"id":2,"order":6}]`
+	req = httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelists/order", bytes.NewReader([]byte(reqBody)))
+	w = httptest.NewRecorder()
+
+	vehicleListsOrderHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status OK, got %v", w.Code)
+	}
+	if storage.Lists[1].Order != 5 || storage.Lists[2].Order != 6 {
+		t.Errorf("lists not reordered: %v", storage.Lists)
+	}
+}
+
+func TestReconcilePlates(t *testing.T) {
+	local := []Record{
+		{ID: 1, Plate: "ABC123"},
+		{ID: 2, Plate: "xyz 789"},
+		{ID: 3, Plate: "LOCAL1"},
+	}
+	upstream := []string{"abc-123", "XYZ789", "NEW1", "NEW2"}
+
+	missing, extra := reconcilePlates(local, upstream)
+
+	if len(missing) != 2 || missing[0] != "NEW1" || missing[1] != "NEW2" {
+		t.Errorf("unexpected missing plates: %v", missing)
+	}
+	if len(extra) != 1 || extra[0] != "LOCAL1" {
+		t.Errorf("unexpected extra plates: %v", extra)
+	}
+}
+
+func TestSharedHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Test List", Name: "testList"},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/vehiclelists/{id}/share", shareHandler)
+	mux.HandleFunc("GET /shared/{token}", sharedHandler)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelists/1/share?ttl=1h", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status Created, got %v", w.Code)
+	}
+	var share struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&share)
+
+	req = httptest.NewRequest(http.MethodGet, "/shared/"+share.Token, nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var result map[string][]Record
+	json.NewDecoder(w.Body).Decode(&result)
+	if w.Code != http.StatusOK || len(result["entries"]) != 1 {
+		t.Errorf("expected shared records, got %v %v", w.Code, result)
+	}
+
+	expired, _ := newShare(1, -time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "/shared/"+expired, nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an expired share, got %v", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/shared/"+share.Token+"x", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for a tampered share, got %v", w.Code)
+	}
+}
+
+func TestSchemaHandler(t *testing.T) {
+	withSettings(t, func(s *settings) { s.VehicleTypes, s.MaxPlateLength = []string{"Car", "Truck"}, 10 })
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/meta/schema", nil)
+	w := httptest.NewRecorder()
+
+	schemaHandler(w, req)
+
+	var result struct {
+		VehicleTypes []string       `json:"vehicleTypes"`
+		Limits       map[string]int `json:"limits"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result.VehicleTypes) != 2 || result.VehicleTypes[0] != "Car" || result.VehicleTypes[1] != "Truck" {
+		t.Errorf("unexpected vehicle types: %v", result.VehicleTypes)
+	}
+	if result.Limits["maxPlateLength"] != 10 {
+		t.Errorf("expected maxPlateLength 10, got %v", result.Limits)
+	}
+
+	if errs := validateRecord(&Record{Plate: "ABC123", VehicleType: "Bus"}); len(errs) != 1 || errs[0].Field != "vehicleType" {
+		t.Errorf("expected an unknown vehicle type to be rejected, got %v", errs)
+	}
+	if errs := validateRecord(&Record{Plate: "ABCDEFGHIJK"}); len(errs) != 1 || errs[0].Field != "plate" {
+		t.Errorf("expected an over-length plate to be rejected, got %v", errs)
+	}
+}
+
+func TestVehicleListHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff", Owner: 7},
+	}
+	handler := recordMiddleware(http.HandlerFunc(vehicleListHandler))
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?id=1", http.StatusOK},
+		{"?id=2", http.StatusNotFound},
+		{"?id=abc", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist"+tt.query, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%q: expected status %v, got %v", tt.query, tt.want, w.Code)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var list VehicleList
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if list != storage.Lists[1] {
+			t.Errorf("expected %+v, got %+v", storage.Lists[1], list)
+		}
+	}
+}
+
+func TestRecordMiddleware(t *testing.T) {
+	// Mock request
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
+	w := httptest.NewRecorder()
+
+	called := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		id, ok := contextID(r.Context())
+		if !ok || id != 1 {
+			t.Errorf("expected id 1, got %d", id)
+		}
+	})
+
+	recordMiddleware(handler).ServeHTTP(w, req)
+
+	if !called {
+		t.Error("middleware did not call next handler")
+	}
+}
+
+func TestContextIDKey(t *testing.T) {
+	// Another package storing a list id under the bare string key.
+	ctx := context.WithValue(context.Background(), "id", int64(5))
+	if id, ok := contextID(ctx); ok {
+		t.Errorf("expected a foreign \"id\" key to be ignored, got %d", id)
+	}
+	if id, ok := contextID(contextWithID(ctx, 7)); !ok || id != 7 {
+		t.Errorf("expected id 7, got %d", id)
+	}
+}
+
+func TestMissingListID(t *testing.T) {
+	// Mock storage
+	storage.Records = map[int64][]Record{
+		0: {{ID: 100, Plate: "ABC123"}},
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{"get", http.MethodGet, handleGetRecord},
+		{"post", http.MethodPost, handlePostRecord},
+		{"put", http.MethodPut, handlePutRecord},
+		{"delete", http.MethodDelete, handleDeleteRecord},
+		{"bulk", http.MethodPost, bulkRecordHandler},
+		{"export", http.MethodGet, exportRecordHandler},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelist/record?recordId=100", strings.NewReader(`{"plate":"XYZ789"}`))
+		w := httptest.NewRecorder()
+
+		tt.handler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status Bad Request without a list id, got %v", tt.name, w.Code)
+		}
+	}
+	if len(storage.Records[0]) != 1 {
+		t.Errorf("expected list 0 to be untouched, got %v", storage.Records[0])
+	}
+}
+
+func TestHandleGetRecord(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	record := Record{ID: 100, Plate: "ABC123", VehicleType: "Car"}
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {record},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	handleGetRecord(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK, got %v", resp.StatusCode)
+	}
+
+	var result map[string][]Record
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Errorf("failed to decode response: %v", err)
+	}
+
+	if len(result["entries"]) != 1 || result["entries"][0].ID != record.ID {
+		t.Errorf("unexpected record returned: %v", result["entries"])
+	}
+}
+
+func TestHandleGetRecordSort(t *testing.T) {
+	// Mock storage, in neither id nor plate order as after moves
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {
+			{ID: 102, Plate: "AAA111", VehicleType: "Truck"},
+			{ID: 100, Plate: "CCC333", VehicleType: "Car"},
+			{ID: 101, Plate: "BBB222", VehicleType: "Car"},
+		},
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{100, 101, 102}},
+		{"&sort=id&dir=desc", []int64{102, 101, 100}},
+		{"&sort=plate", []int64{102, 101, 100}},
+		{"&sort=plate&dir=desc", []int64{100, 101, 102}},
+		{"&sort=vehicleType", []int64{100, 101, 102}},
+		{"&sort=vehicleType&dir=desc", []int64{102, 100, 101}},
+		{"&sort=plate&offset=1&limit=1", []int64{101}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1"+tt.query, nil)
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+
+		handleGetRecord(w, req)
+
+		var result struct {
+			Entries []Record `json:"entries"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.query, err)
+		}
+		var got []int64
+		for _, rec := range result.Entries {
+			got = append(got, rec.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+	if storage.Records[id][0].ID != 102 {
+		t.Error("expected sorting to leave the stored order alone")
+	}
+
+	for _, query := range []string{"&sort=updatedAt", "&dir=up"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1"+query, nil)
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handleGetRecord(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status Bad Request, got %v", query, w.Code)
+		}
+	}
+}
+
+func TestHandleGetRecordCursor(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "E5"}, {ID: 101, Plate: "D4"}, {ID: 102, Plate: "C3"}, {ID: 103, Plate: "B2"}, {ID: 104, Plate: "A1"}},
+	}
+
+	get := func(query string) ([]int64, pageMetadata, int) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1"+query, nil)
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handleGetRecord(w, req)
+		var result struct {
+			Entries  []Record     `json:"entries"`
+			Metadata pageMetadata `json:"_metadata"`
+		}
+		json.NewDecoder(w.Body).Decode(&result)
+		var got []int64
+		for _, rec := range result.Entries {
+			got = append(got, rec.ID)
+		}
+		return got, result.Metadata, w.Code
+	}
+
+	for _, sortQuery := range []string{"", "&sort=plate&dir=desc"} {
+		storage.Records[id] = storage.Records[id][:5]
+		var seen []int64
+		cursor := ""
+		for page := 0; ; page++ {
+			got, meta, code := get(sortQuery + "&limit=2&cursor=" + cursor)
+			if code != http.StatusOK {
+				t.Fatalf("%q: expected status OK, got %v", sortQuery, code)
+			}
+			seen = append(seen, got...)
+			// Records inserted before the cursor mid-scan are neither
+			// returned nor shift the following pages.
+			if page == 0 {
+				storage.Records[id] = append(storage.Records[id], Record{ID: 99, Plate: "F6"})
+			}
+			if !meta.HasNext {
+				if meta.NextCursor != "" {
+					t.Errorf("%q: expected no cursor on the last page", sortQuery)
+				}
+				break
+			}
+			if !strings.Contains(meta.NextURL, "cursor="+meta.NextCursor) {
+				t.Errorf("%q: expected the next URL to carry the cursor, got %q", sortQuery, meta.NextURL)
+			}
+			cursor = meta.NextCursor
+		}
+		if want := []int64{100, 101, 102, 103, 104}; !reflect.DeepEqual(seen, want) {
+			t.Errorf("%q: expected every record once, got %v", sortQuery, seen)
+		}
+	}
+
+	// Offset paging still works, and would shift with the same insert.
+	if got, _, _ := get("&offset=2&limit=2"); !reflect.DeepEqual(got, []int64{101, 102}) {
+		t.Errorf("expected offset paging by id, got %v", got)
+	}
+
+	_, meta, _ := get("&limit=2&cursor=")
+	for _, query := range []string{"&cursor=!!", "&cursor=" + meta.NextCursor + "&sort=plate", "&cursor=&offset=2"} {
+		if _, _, code := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status Bad Request, got %v", query, code)
+		}
+	}
+}
+
+func TestHandleGetRecordEmptyList(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Empty"},
+		2: {ID: 2, DisplayName: "No records entry"},
+	}
+	storage.Records = map[int64][]Record{
+		1: nil,
+		4: {{ID: 400, Plate: "ORPHAN1"}}, // Records without a list
+	}
+
+	tests := []struct {
+		id   int64
+		want int
+	}{
+		{1, http.StatusOK},
+		{2, http.StatusOK},
+		{3, http.StatusNotFound},
+		{4, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record", nil)
+		req = req.WithContext(contextWithID(req.Context(), tt.id))
+		w := httptest.NewRecorder()
+
+		handleGetRecord(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("list %d: expected status %v, got %v", tt.id, tt.want, w.Code)
+			continue
+		}
+		if tt.want == http.StatusOK {
+			if body := strings.TrimSpace(w.Body.String()); body != `{"entries":[]}` {
+				t.Errorf("list %d: expected empty entries, got %s", tt.id, body)
+			}
+		}
+	}
+
+	// Records can't be written to a list that doesn't exist either.
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=999", strings.NewReader(`{"plate":"NEW999"}`))
+	req = req.WithContext(contextWithID(req.Context(), 999))
+	w := httptest.NewRecorder()
+	handlePostRecord(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for a record of an unknown list, got %v", w.Code)
+	}
+	if _, err := insertRecords(context.Background(), 999, []Record{{Plate: "NEW999"}}, "", false); err != errListNotFound {
+		t.Errorf("expected a bulk insert into an unknown list to fail, got %v", err)
+	}
+	if _, created := storage.Records[999]; created {
+		t.Error("expected no records entry for the unknown list")
+	}
+}
+
+func TestHandleGetRecordHTML(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {
+			{ID: 100, Plate: "ABC123", VehicleType: "Car"},
+			{ID: 101, Plate: "XYZ789", VehicleType: "Truck"},
+			{ID: 102, Plate: "QWE456", VehicleType: "Bus"},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1&format=html&limit=2", nil)
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	handleGetRecord(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK, got %v", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected HTML content type, got %q", ct)
+	}
+
+	body := w.Body.String()
+	if rows := strings.Count(body, "<tr><td>"); rows != 2 {
+		t.Errorf("expected 2 record rows, got %d", rows)
+	}
+	if !strings.Contains(body, `rel="next"`) || !strings.Contains(body, "offset=2") {
+		t.Errorf("expected a next page link, got %s", body)
+	}
+	if strings.Contains(body, `rel="prev"`) {
+		t.Errorf("unexpected previous page link on the first page")
+	}
+}
+
+func TestHandleGetRecordEnrich(t *testing.T) {
+	rules := []DerivedFieldRule{
+		{Field: "region", Pattern: "^(B|M)[A-Z]", Value: "DE-$1"},
+		{Field: "formattedPlate", Pattern: "^([A-Z]+)([0-9]+)$", Value: "$1 $2"},
+	}
+	compiled, err := compileDerivedFieldRules(rules)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+	withSettings(t, func(s *settings) { s.derivedFieldRules = compiled })
+
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "BXY123"}, {ID: 101, Plate: "12345"}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1&enrich=true", nil)
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	handleGetRecord(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var response map[string][]enrichedRecord
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	entries := response["entries"]
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if got := entries[0].Derived; got["region"] != "DE-B" || got["formattedPlate"] != "BXY 123" {
+		t.Errorf("expected derived region and formatted plate, got %v", got)
+	}
+	if got := entries[1].Derived; len(got) != 0 {
+		t.Errorf("expected no derived fields for an unrecognized plate, got %v", got)
+	}
+	if storage.Records[id][0].Plate != "BXY123" {
+		t.Errorf("expected stored records to be untouched, got %+v", storage.Records[id][0])
+	}
+}
+
+func TestHandlePostRecord(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {},
+	}
+
+	reqBody := `{"id":101,"plate":"XYZ789","vehicleType":"Truck"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", bytes.NewReader([]byte(reqBody)))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	handlePostRecord(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected status Created, got %v", resp.StatusCode)
+	}
+
+	// Verify record added
+	if len(storage.Records[id]) != 1 || storage.Records[id][0].Plate != "XYZ789" {
+		t.Errorf("record not added correctly: %v", storage.Records[id])
+	}
+
+	// An id already in the list is refused, not duplicated.
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", strings.NewReader(`{"id":101,"plate":"QWE456"}`))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w = httptest.NewRecorder()
+	handlePostRecord(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict for a duplicate id, got %v", w.Code)
+	}
+	if len(storage.Records[id]) != 1 {
+		t.Errorf("expected the duplicate not to be added, got %v", storage.Records[id])
+	}
+}
+
+func TestBulkDeleteRecordHandler(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}, {ID: 102, Plate: "QWE456"}},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/delete?id=1", strings.NewReader(`[100,102,999]`))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	bulkDeleteRecordHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var result bulkDeleteResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.Deleted != 2 || result.NotFound != 1 {
+		t.Errorf("expected 2 deleted and 1 not found, got %+v", result)
+	}
+	if records := storage.Records[id]; len(records) != 1 || records[0].ID != 101 {
+		t.Errorf("expected only record 101 to remain, got %v", records)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/delete?id=2", strings.NewReader(`[100]`))
+	req = req.WithContext(contextWithID(req.Context(), 2))
+	w = httptest.NewRecorder()
+	bulkDeleteRecordHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown list, got %v", w.Code)
+	}
+}
+
+func TestClearRecordsHandler(t *testing.T) {
+	withSettings(t, func(s *settings) { s.AdminUsers = []string{"admin"} })
+
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}, 2: {ID: 2}}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
+		2: {{ID: 200, Plate: "QWE456"}},
+	}
+	rebuildPlateIndex()
+	handler := requireRole(roleAdmin, recordMiddleware(http.HandlerFunc(clearRecordsHandler)))
+
+	clear := func(user, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/vehiclelist/record/all"+query, nil)
+		req = req.WithContext(contextWithSession(req.Context(), Session{User: user, Role: userRole(user)}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := clear("viewer", "?id=1"); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden for a non-admin, got %v", w.Code)
+	}
+	if w := clear("admin", "?id=3"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown list, got %v", w.Code)
+	}
+
+	w := clear("admin", "?id=1")
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || w.Code != http.StatusOK || result.Deleted != 2 {
+		t.Fatalf("expected 2 records deleted, got %v %+v %v", w.Code, result, err)
+	}
+	if records, ok := storage.Records[1]; !ok || len(records) != 0 || len(storage.Records[2]) != 1 {
+		t.Errorf("expected only list 1 to be emptied, got %v", storage.Records)
+	}
+	if storage.plates.inList("ABC123", 1) {
+		t.Error("expected the cleared plates to leave the index")
+	}
+	trail := auditTrail(1, 101)
+	if len(trail) == 0 || trail[len(trail)-1].Action != auditDelete || trail[len(trail)-1].User != "admin" {
+		t.Errorf("expected a delete audit entry by admin, got %+v", trail)
+	}
+}
+
+func TestMoveRecordHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}, 2: {ID: 2}}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123", VehicleType: "Car", Tags: []string{"staff"}}, {ID: 101, Plate: "XYZ789"}},
+		2: {{ID: 200, Plate: "XYZ 789"}},
+	}
+	rebuildPlateIndex()
+
+	move := func(query string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/move"+query, nil)
+		w := httptest.NewRecorder()
+		moveRecordHandler(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?from=1&to=3&recordId=100", http.StatusNotFound},
+		{"?from=3&to=1&recordId=100", http.StatusNotFound},
+		{"?from=1&to=2&recordId=999", http.StatusNotFound},
+		{"?from=1&to=2&recordId=101", http.StatusConflict},
+		{"?from=x&to=2&recordId=100", http.StatusBadRequest},
+		{"?from=1&to=2&recordId=100", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := move(tt.query); got != tt.want {
+			t.Errorf("%q: expected status %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	if records := storage.Records[1]; len(records) != 1 || records[0].ID != 101 {
+		t.Errorf("expected record 100 to leave list 1, got %v", records)
+	}
+	records := storage.Records[2]
+	if len(records) != 2 {
+		t.Fatalf("expected record 100 in list 2, got %v", records)
+	}
+	if moved := records[1]; moved.ID != 100 || moved.VehicleType != "Car" || len(moved.Tags) != 1 {
+		t.Errorf("expected the record fields to be preserved, got %+v", moved)
+	}
+}
+
+func TestDuplicatePlates(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", Version: 1}, {ID: 101, Plate: "XYZ789", Version: 1}},
+	}
+	rebuildPlateIndex()
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		query   string
+		body    string
+		want    int
+	}{
+		{handlePostRecord, http.MethodPost, "", `{"plate":"abc 123"}`, http.StatusConflict},
+		{handlePutRecord, http.MethodPut, "&recordId=100", `{"plate":"XYZ789","version":1}`, http.StatusConflict},
+		{handlePatchRecord, http.MethodPatch, "&recordId=100", `{"plate":"XYZ-789"}`, http.StatusConflict},
+		{handlePutRecord, http.MethodPut, "&recordId=100", `{"plate":"ABC123","vehicleType":"Van","version":1}`, http.StatusOK},
+		{handlePatchRecord, http.MethodPatch, "&recordId=101", `{"plate":"XYZ 789"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelist/record?id=1"+tt.query, strings.NewReader(tt.body))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		tt.handler(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %v, got %v", tt.method, tt.body, tt.want, w.Code)
+		}
+	}
+	if n := len(storage.Records[id]); n != 2 {
+		t.Errorf("expected no duplicate to be stored, got %d records", n)
+	}
+}
+
+func TestBulkRecordHandler(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	reqBody := `[{"plate":"xyz 789","vehicleType":"Truck"},{"plate":"ABC-123"},{"plate":""},{"plate":"XYZ789"}]`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/bulk?id=1", bytes.NewReader([]byte(reqBody)))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	bulkRecordHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected status Created, got %v", resp.StatusCode)
+	}
+
+	var result bulkResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.Created != 1 || result.Skipped != 3 || len(result.Errors) != 3 {
+		t.Errorf("unexpected summary: %+v", result)
+	}
+	if result.Errors[0].Index != 1 || result.Errors[1].Index != 2 || result.Errors[2].Index != 3 {
+		t.Errorf("unexpected error indexes: %+v", result.Errors)
+	}
+
+	records := storage.Records[id]
+	if len(records) != 2 || records[1].Plate != "XYZ789" || records[1].ID == 0 {
+		t.Errorf("records not added correctly: %v", records)
+	}
+}
+
+func TestImportRecordHandler(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	reqBody := "plate,vehicleType\nxyz 789,Truck\n\nABC-123,Car\nQWE456\n\"bad,plate\n"
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/import?id=1", bytes.NewReader([]byte(reqBody)))
+	req.Header.Set("Content-Type", "text/csv")
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	importRecordHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected status Created, got %v", resp.StatusCode)
+	}
+
+	var result importResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.Created != 2 || result.Rejected != 2 {
+		t.Errorf("unexpected summary: %+v", result)
+	}
+	if len(result.Errors) != 2 || result.Errors[0].Line != 4 || result.Errors[1].Line != 6 {
+		t.Errorf("unexpected rejected lines: %+v", result.Errors)
+	}
+	if len(storage.Records[id]) != 3 {
+		t.Errorf("records not imported correctly: %v", storage.Records[id])
+	}
+}
+
+func TestMaxRecordsPerList(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxRecordsPerList = 3 })
+
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123"}},
+	}
+	rebuildPlateIndex()
+
+	post := func(plate string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", strings.NewReader(`{"plate":"`+plate+`"}`))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handlePostRecord(w, req)
+		return w
+	}
+	bulk := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/bulk?id=1", strings.NewReader(body))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		bulkRecordHandler(w, req)
+		return w
+	}
+
+	// Rejected rows don't count against the limit.
+	if w := bulk(`[{"plate":"B1"},{"plate":"ABC123"},{"plate":"B2"},{"plate":"B3"}]`); w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict for 4 records, got %v", w.Code)
+	}
+	if w := bulk(`[{"plate":"B1"},{"plate":"ABC123"}]`); w.Code != http.StatusCreated {
+		t.Errorf("expected status Created up to the limit, got %v", w.Code)
+	}
+	if w := post("C1"); w.Code != http.StatusCreated {
+		t.Errorf("expected status Created for the last record, got %v", w.Code)
+	}
+	w := post("C2")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status Conflict past the limit, got %v", w.Code)
+	}
+	var body apiError
+	json.NewDecoder(w.Body).Decode(&body)
+	if !strings.Contains(body.Error.Message, "3 of at most 3") {
+		t.Errorf("expected the count and limit in the message, got %q", body.Error.Message)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/import?id=1", strings.NewReader("D1\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w = httptest.NewRecorder()
+	importRecordHandler(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict for an import past the limit, got %v", w.Code)
+	}
+	if len(storage.Records[id]) != 3 {
+		t.Errorf("expected the list to stay at 3 records, got %v", storage.Records[id])
+	}
+}
+
+func TestExportRecordHandler(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Records = map[int64][]Record{
+		id: {
+			{ID: 100, Plate: "ABC123", VehicleType: "Car"},
+			{ID: 101, Plate: "XYZ789", VehicleType: "Truck"},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/export?id=1", nil)
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	exportRecordHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK, got %v", resp.StatusCode)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+		t.Errorf("expected an attachment, got %q", cd)
+	}
+	want := "plate,vehicleType\nABC123,Car\nXYZ789,Truck\n"
+	if body := w.Body.String(); body != want {
+		t.Errorf("unexpected CSV: %q", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/export?id=2", nil)
+	req = req.WithContext(contextWithID(req.Context(), 2))
+	w = httptest.NewRecorder()
+
+	exportRecordHandler(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found, got %v", w.Code)
+	}
+}
+
+// writingRecorder runs write before passing on the first write of a
+// response, like a writer racing a streaming export.
+type writingRecorder struct {
+	*httptest.ResponseRecorder
+	write func()
+}
+
+func (w *writingRecorder) Write(b []byte) (int, error) {
+	if w.write != nil {
+		w.write()
+		w.write = nil
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestExportRecordSnapshot(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Records = map[int64][]Record{id: {}}
+	for i := 0; i < 500; i++ {
+		storage.Records[id] = append(storage.Records[id], Record{ID: int64(i), Plate: "P" + strconv.Itoa(i), Tags: []string{"old"}})
+	}
+
+	for _, format := range []string{"csv", "ndjson"} {
+		// The export streams while a writer changes the list. Were the lock
+		// held during the stream, the write would deadlock.
+		done := make(chan *writingRecorder)
+		go func() {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/export?id=1&format="+format, nil)
+			req = req.WithContext(contextWithID(req.Context(), id))
+			w := &writingRecorder{ResponseRecorder: httptest.NewRecorder(), write: func() {
+				storage.Lock()
+				storage.Records[id][499].Tags[0] = "new"
+				storage.Records[id] = append(storage.Records[id], Record{ID: 1000, Plate: "LATE1"})
+				storage.Unlock()
+			}}
+			exportRecordHandler(w, req)
+			done <- w
+		}()
+		var w *writingRecorder
+		select {
+		case w = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: export deadlocked with a concurrent write", format)
+		}
+
+		body := w.Body.String()
+		if strings.Contains(body, "LATE1") || strings.Contains(body, "new") {
+			t.Errorf("%s: expected the export to leave out the concurrent write", format)
+		}
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		if want := 500; format == "csv" && len(lines) != want+1 || format == "ndjson" && len(lines) != want {
+			t.Errorf("%s: expected %d records, got %d lines", format, want, len(lines))
+		}
+		storage.Records[id] = storage.Records[id][:500]
+		storage.Records[id][499].Tags[0] = "old"
+	}
+}
+
+// cancellingReader cancels a request the first time its body is read, like
+// a client hanging up during an upload.
+type cancellingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.Reader.Read(p)
+}
+
+func TestRequestCancellation(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{id: {}}
+
+	// An import whose client hung up stores nothing.
+	ctx, cancel := context.WithCancel(contextWithID(context.Background(), id))
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/import?id=1", &cancellingReader{strings.NewReader("A1\nB2\nC3\n"), cancel})
+	req.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	importRecordHandler(w, req.WithContext(ctx))
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("import: expected status 499, got %v", w.Code)
+	}
+
+	// So does a bulk insert cancelled or timed out before storing.
+	deadline, stop := context.WithDeadline(contextWithID(context.Background(), id), time.Now())
+	defer stop()
+	for ctx, want := range map[context.Context]int{ctx: statusClientClosedRequest, deadline: http.StatusServiceUnavailable} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/bulk?id=1", strings.NewReader(`[{"plate":"A1"},{"plate":"B2"}]`))
+		w := httptest.NewRecorder()
+		bulkRecordHandler(w, req.WithContext(ctx))
+		if w.Code != want {
+			t.Errorf("bulk: expected status %d, got %v", want, w.Code)
+		}
+	}
+	if n := len(storage.Records[id]); n != 0 {
+		t.Errorf("expected no record stored by cancelled requests, got %d", n)
+	}
+
+	// An export stops streaming once its client hung up.
+	for i := 0; i < 100; i++ {
+		storage.Records[id] = append(storage.Records[id], Record{ID: int64(i + 1), Plate: "P" + strconv.Itoa(i)})
+	}
+	ctx, cancel = context.WithCancel(contextWithID(context.Background(), id))
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/export?id=1&format=ndjson", nil)
+	rec := &writingRecorder{ResponseRecorder: httptest.NewRecorder(), write: cancel}
+	exportRecordHandler(rec, req.WithContext(ctx))
+	if lines := strings.Count(rec.Body.String(), "\n"); lines != 1 {
+		t.Errorf("expected the export to stop after the first record, got %d lines", lines)
+	}
+
+	// Slow handlers get a JSON 503 once the handler timeout passed.
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		writeContextError(w, r.Context().Err())
+	})
+	w = httptest.NewRecorder()
+	timeoutHandler(slow, 10*time.Millisecond).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/records", nil))
+	var body apiError
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusServiceUnavailable || body.Error.Code != "timeout" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON 503 timeout, got %v %q %+v", w.Code, w.Header().Get("Content-Type"), body)
+	}
+}
+
+func TestExportRecordGzip(t *testing.T) {
+	// Mock storage
+	storage.Records = map[int64][]Record{
+		1: {
+			{ID: 100, Plate: "ABC123", VehicleType: "Car"},
+			{ID: 101, Plate: "XYZ789", VehicleType: "Truck"},
+		},
+	}
+	handler := gzipMiddleware(recordMiddleware(http.HandlerFunc(exportRecordHandler)))
+
+	export := func(accept string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/export?id=1", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+	decompress := func(resp *http.Response) []byte {
+		if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("expected gzip content encoding, got %q", ce)
+		}
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to open gzip body: %v", err)
+		}
+		body, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("failed to decompress body: %v", err)
+		}
+		return body
+	}
+
+	resp := export("text/csv")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("expected content type text/csv, got %q", ct)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(decompress(resp))).ReadAll()
+	if err != nil {
+		t.Fatalf("expected valid CSV, got %v", err)
+	}
+	if len(rows) != 3 || rows[1][0] != "ABC123" || rows[2][1] != "Truck" {
+		t.Errorf("unexpected CSV rows: %v", rows)
+	}
+
+	resp = export("application/x-ndjson")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected content type application/x-ndjson, got %q", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(string(decompress(resp))), "\n")
+	var rec Record
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &rec) != nil || rec.Plate != "XYZ789" {
+		t.Errorf("unexpected NDJSON: %q", lines)
+	}
+
+	if resp := export("application/xml"); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("expected status Not Acceptable, got %v", resp.StatusCode)
+	}
+}
+
+func TestHandlePutRecord(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	reqBody := `{"plate":"ABC123","vehicleType":"Truck"}`
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelist/record?id=1&recordId=100", bytes.NewReader([]byte(reqBody)))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	handlePutRecord(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status OK, got %v", w.Code)
+	}
+	if rec := storage.Records[id][0]; rec.ID != 100 || rec.VehicleType != "Truck" || rec.Version != 1 {
+		t.Errorf("record not updated correctly: %v", rec)
+	}
+}
+
+func TestHandlePatchRecord(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car", Tags: []string{"staff"}, Version: 2, ExpiresAt: &expiry}},
+	}
+	rebuildPlateIndex()
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/vehiclelist/record?id=1&recordId=100", strings.NewReader(body))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handlePatchRecord(w, req)
+		return w
+	}
+
+	w := patch(`{"vehicleType":"Truck"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	rec := storage.Records[id][0]
+	if rec.VehicleType != "Truck" || rec.Plate != "ABC123" || !reflect.DeepEqual(rec.Tags, []string{"staff"}) || rec.ExpiresAt == nil || rec.Version != 3 {
+		t.Errorf("expected only the vehicle type to change, got %+v", rec)
+	}
+
+	if w := patch(`{"plate":"xyz 789","expiresAt":null,"version":3}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	rec = storage.Records[id][0]
+	if rec.Plate != "XYZ789" || rec.VehicleType != "Truck" || rec.ExpiresAt != nil {
+		t.Errorf("expected a new plate without expiry, got %+v", rec)
+	}
+	if !storage.plates.inList("XYZ789", id) || storage.plates.inList("ABC123", id) {
+		t.Error("expected the plate index to follow the new plate")
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"plate":""}`, http.StatusBadRequest},
+		{`{"plate":"ABCDEFGHIJKLMNOPQ"}`, http.StatusBadRequest},
+		{`{"id":7}`, http.StatusBadRequest},
+		{`{"colour":"red"}`, http.StatusBadRequest},
+		{`{"vehicleType":"Van","version":3}`, http.StatusConflict},
+	} {
+		if w := patch(tt.body); w.Code != tt.want {
+			t.Errorf("%s: expected status %v, got %v", tt.body, tt.want, w.Code)
+		}
+	}
+	if rec := storage.Records[id][0]; rec.Plate != "XYZ789" || rec.VehicleType != "Truck" || rec.Version != 4 {
+		t.Errorf("expected rejected patches to leave the record alone, got %+v", rec)
+	}
+}
+
+func TestHandlePutRecordVersion(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car", Version: 3}},
+	}
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/vehiclelist/record?id=1&recordId=100", bytes.NewReader([]byte(body)))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handlePutRecord(w, req)
+		return w
+	}
+
+	w := put(`{"plate":"ABC123","vehicleType":"Truck","version":3}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var updated Record
+	if err := json.NewDecoder(w.Body).Decode(&updated); err != nil || updated.Version != 4 {
+		t.Errorf("expected the response to carry version 4, got %+v, %v", updated, err)
+	}
+
+	// A second client still holding version 3 must not clobber the update.
+	if w := put(`{"plate":"ABC123","vehicleType":"Van","version":3}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict for a stale version, got %v", w.Code)
+	}
+	if w := put(`{"plate":"ABC123","vehicleType":"Van"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict without a version, got %v", w.Code)
+	}
+	if rec := storage.Records[id][0]; rec.VehicleType != "Truck" || rec.Version != 4 {
+		t.Errorf("expected the stored record to be kept, got %+v", rec)
+	}
+}
+
+func TestRecordTagLimits(t *testing.T) {
+	withSettings(t, func(s *settings) { s.MaxTagsPerRecord, s.MaxTagLength = 2, 8 })
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		want    int
+	}{
+		{"post within limits", handlePostRecord, http.MethodPost, `{"plate":"A1","tags":["staff","ev"]}`, http.StatusCreated},
+		{"post too many tags", handlePostRecord, http.MethodPost, `{"plate":"A2","tags":["a","b","c"]}`, http.StatusBadRequest},
+		{"post tag too long", handlePostRecord, http.MethodPost, `{"plate":"A3","tags":["contractor"]}`, http.StatusBadRequest},
+		{"put too many tags", handlePutRecord, http.MethodPut, `{"plate":"ABC123","tags":["a","b","c"]}`, http.StatusBadRequest},
+		{"put tag too long", handlePutRecord, http.MethodPut, `{"plate":"ABC123","tags":["contractor"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelist/record?id=1&recordId=100", bytes.NewReader([]byte(tt.body)))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+
+		tt.handler(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: expected status %v, got %v", tt.name, tt.want, w.Code)
+		}
+	}
+
+	result, _ := insertRecords(context.Background(), id, []Record{{Plate: "B1", Tags: []string{"a", "b", "c"}}}, "", false)
+	if result.Created != 0 || len(result.Errors) != 1 {
+		t.Errorf("expected bulk insert to reject too many tags, got %+v", result)
+	}
+	if rec := storage.Records[id][0]; len(rec.Tags) != 0 {
+		t.Errorf("expected rejected update to leave tags unchanged, got %v", rec.Tags)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	id := int64(1)
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		want    fieldError
+	}{
+		{"post unknown field", handlePostRecord, http.MethodPost, `{"plate":"A1","vehicleTyp":"Car"}`, fieldError{"Unknown field", "vehicleTyp"}},
+		{"post wrong type", handlePostRecord, http.MethodPost, `{"plate":123}`, fieldError{"Wrong type, expected string", "plate"}},
+		{"post malformed", handlePostRecord, http.MethodPost, `{"plate":`, fieldError{"Malformed JSON", ""}},
+		{"put wrong type", handlePutRecord, http.MethodPut, `{"plate":"A1","id":"x"}`, fieldError{"Wrong type, expected int64", "id"}},
+		{"login unknown field", loginHandler, http.MethodPost, `{"username":"a","pasword":"b"}`, fieldError{"Unknown field", "pasword"}},
+		{"login wrong type", loginHandler, http.MethodPost, `{"username":"a","isRememberMe":"yes"}`, fieldError{"Wrong type, expected bool", "isRememberMe"}},
+		{"login blank username", loginHandler, http.MethodPost, `{"username":" ","password":"b"}`, fieldError{"username required", "username"}},
+		{"login missing password", loginHandler, http.MethodPost, `{"username":"a"}`, fieldError{"password required", "password"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/?id=1&recordId=100", bytes.NewReader([]byte(tt.body)))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+
+		tt.handler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status Bad Request, got %v", tt.name, w.Code)
+		}
+		var got apiError
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Errorf("%s: failed to decode response: %v", tt.name, err)
+		}
+		if got.Error.Code != "bad_request" || got.Error.Message != tt.want.Message {
+			t.Errorf("%s: expected bad_request %q, got %+v", tt.name, tt.want.Message, got.Error)
+		}
+		var field string
+		if len(got.Error.Fields) == 1 {
+			field = got.Error.Fields[0].Field
+		}
+		if field != tt.want.Field || len(got.Error.Fields) > 1 {
+			t.Errorf("%s: expected field %q, got %+v", tt.name, tt.want.Field, got.Error.Fields)
+		}
+	}
+}
+
+func TestValidateStruct(t *testing.T) {
+	type payload struct {
+		Name  string   `json:"name" validate:"required,min=2,max=5"`
+		Code  string   `json:"code" validate:"pattern=^[A-Z]+$"`
+		Kind  string   `json:"kind" validate:"enum=car|truck"`
+		Items []string `json:"items" validate:"required"`
+		Note  string
+	}
+
+	if errs := validateStruct(&payload{Name: "abc", Code: "XY", Kind: "car", Items: []string{"a"}}); errs != nil {
+		t.Errorf("expected a valid payload, got %v", errs)
+	}
+	if errs := validateStruct(&payload{Name: "abc", Items: []string{"a"}}); errs != nil {
+		t.Errorf("expected empty optional fields to pass, got %v", errs)
+	}
+
+	errs := validateStruct(&payload{Name: "abcdef", Code: "xy", Kind: "bus"})
+	var fields []string
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	if want := []string{"name", "code", "kind", "items"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("expected violations of %v, got %v", want, errs)
+	}
+	if errs := validateStruct(&payload{Name: "a", Items: []string{}}); len(errs) != 2 || errs[0].Message != "name is shorter than 2 characters" || errs[1].Message != "items is required" {
+		t.Errorf("unexpected violations: %v", errs)
+	}
+}
+
+func TestValidationErrorEnvelope(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.VehicleTypes = []string{"Car", "Truck"}
+		s.MaxDisplayNameLength = 10
+	})
+	storage.Lists = map[int64]VehicleList{}
+	storage.Records = map[int64][]Record{1: {}}
+
+	tests := []struct {
+		handler http.HandlerFunc
+		body    string
+		fields  []string
+	}{
+		{handlePostRecord, `{"plate":"AB!","vehicleType":"Bus","tags":[" "]}`, []string{"plate", "vehicleType", "tags"}},
+		{handlePostRecord, `{"vehicleType":"Car"}`, []string{"plate"}},
+		{vehicleListsHandler, `{"displayName":"Visitors of the week","color":"red"}`, []string{"color", "displayName"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/?id=1", strings.NewReader(tt.body))
+		req = req.WithContext(contextWithID(req.Context(), 1))
+		w := httptest.NewRecorder()
+
+		tt.handler(w, req)
+
+		var body apiError
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.body, err)
+		}
+		if w.Code != http.StatusBadRequest || body.Error.Code != "invalid" {
+			t.Errorf("%s: expected status Bad Request with code invalid, got %v %+v", tt.body, w.Code, body.Error)
+		}
+		var fields []string
+		for _, err := range body.Error.Fields {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: expected errors for %v, got %v", tt.body, tt.fields, body.Error.Fields)
+		}
+	}
+	if len(storage.Records[1]) != 0 || len(storage.Lists) != 0 {
+		t.Error("expected invalid payloads to store nothing")
+	}
+}
+
+func TestReservedPlates(t *testing.T) {
+	withSettings(t, func(s *settings) { s.ReservedPlates = []string{"TEST*", "gov 001"} })
+
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		body    string
+		want    int
+	}{
+		{handlePostRecord, http.MethodPost, `{"plate":"TEST42"}`, http.StatusUnprocessableEntity},
+		{handlePostRecord, http.MethodPost, `{"plate":"GOV-001"}`, http.StatusUnprocessableEntity},
+		{handlePostRecord, http.MethodPost, `{"plate":"XYZ789"}`, http.StatusCreated},
+		{handlePutRecord, http.MethodPut, `{"plate":"test 1"}`, http.StatusUnprocessableEntity},
+		{handlePutRecord, http.MethodPut, `{"plate":"ABC124"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelist/record?id=1&recordId=100", bytes.NewReader([]byte(tt.body)))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+
+		tt.handler(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %v, got %v", tt.method, tt.body, tt.want, w.Code)
+		}
+	}
+
+	result, _ := insertRecords(context.Background(), id, []Record{{Plate: "TESTX"}, {Plate: "QWE456"}}, "", false)
+	if result.Created != 1 || len(result.Errors) != 1 || result.Errors[0].Index != 0 {
+		t.Errorf("unexpected bulk result: %+v", result)
+	}
+}
+
+func TestQueryRecordHandler(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	past := time.Now().Add(-time.Hour)
+	storage.Records = map[int64][]Record{
+		id: {
+			{ID: 100, Plate: "ABC123", VehicleType: "Car"},
+			{ID: 101, Plate: "XYZ789", VehicleType: "Truck"},
+			{ID: 102, Plate: "OLD000", VehicleType: "Car", ExpiresAt: &past},
+		},
+	}
+
+	reqBody := `{"projection":{"plate":true,"vehicleType":null,"missing":true}}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/query?id=1", bytes.NewReader([]byte(reqBody)))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	queryRecordHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status OK, got %v", w.Code)
+	}
+	var result struct {
+		Entries []map[string]interface{} `json:"entries"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", result.Entries)
+	}
+	for i, want := range []string{"ABC123", "XYZ789"} {
+		entry := result.Entries[i]
+		if len(entry) != 1 || entry["plate"] != want {
+			t.Errorf("expected only plate %s, got %v", want, entry)
+		}
+	}
+
+	nested := project(map[string]interface{}{
+		"plate": "ABC123",
+		"owner": map[string]interface{}{"name": "Ann", "phone": "123"},
+	}, map[string]interface{}{"owner": map[string]interface{}{"name": true}})
+	want := map[string]interface{}{"owner": map[string]interface{}{"name": "Ann"}}
+	if got, _ := json.Marshal(nested); string(got) != mustJSON(want) {
+		t.Errorf("unexpected nested projection: %s", got)
+	}
+}
+
+func mustJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func TestInferVehicleType(t *testing.T) {
+	rules, err := compileVehicleTypeRules([]VehicleTypeRule{
+		{Pattern: "^M[0-9]{4}$", Type: "Motorcycle"},
+		{Pattern: "^T", Type: "Truck"},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+	withSettings(t, func(s *settings) { s.vehicleTypeRules, s.DefaultVehicleType = rules, "Car" })
+
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{id: {}}
+
+	for _, body := range []string{`{"plate":"m 1234"}`, `{"plate":"ABC123"}`, `{"plate":"M5678","vehicleType":"Bus"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", bytes.NewReader([]byte(body)))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		handlePostRecord(httptest.NewRecorder(), req)
+	}
+
+	want := []string{"Motorcycle", "Car", "Bus"}
+	records := storage.Records[id]
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %v", len(want), records)
+	}
+	for i, rec := range records {
+		if rec.VehicleType != want[i] {
+			t.Errorf("record %s: expected type %s, got %s", rec.Plate, want[i], rec.VehicleType)
+		}
+	}
+
+	result, _ := insertRecords(context.Background(), id, []Record{{Plate: "T100"}}, "", false)
+	if result.Created != 1 || storage.Records[id][3].VehicleType != "Truck" {
+		t.Errorf("expected bulk insert to infer Truck, got %v", storage.Records[id])
+	}
+}
+
+func TestHandleDeleteRecord(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	record := Record{ID: 100, Plate: "ABC123", VehicleType: "Car"}
+	storage.Records = map[int64][]Record{
+		id: {record},
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/vehiclelist/record?id=1&recordId=100", nil)
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	handleDeleteRecord(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK, got %v", resp.StatusCode)
+	}
+
+	// Verify record deleted
+	if len(storage.Records[id]) != 0 {
+		t.Errorf("record not deleted correctly: %v", storage.Records[id])
+	}
+}
+
+// countingSink counts how often the batcher touches it.
+type countingSink struct {
+	sync.Mutex
+	calls  int
+	totals map[string]int64
+}
+
+func (s *countingSink) Add(name string, delta int64) {
+	s.Lock()
+	s.calls++
+	s.totals[name] += delta
+	s.Unlock()
+}
+
+func TestMetricsBatcher(t *testing.T) {
+	sink := &countingSink{totals: make(map[string]int64)}
+	b := newMetricsBatcher(sink, time.Hour)
+
+	for i := 0; i < 500; i++ {
+		b.Inc("a")
+		if i%5 == 0 {
+			b.Inc("b")
+		}
+	}
+
+	sink.Lock()
+	calls := sink.calls
+	sink.Unlock()
+	if calls != 0 {
+		t.Errorf("expected no sink calls before a flush, got %d", calls)
+	}
+
+	b.Flush()
+
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.totals["a"] != 500 || sink.totals["b"] != 100 {
+		t.Errorf("unexpected totals after flush: %v", sink.totals)
+	}
+	if sink.calls != 2 {
+		t.Errorf("expected one aggregated call per counter, got %d", sink.calls)
+	}
+}
+
+func BenchmarkCountMetric(b *testing.B) {
+	b.Run("direct", func(b *testing.B) {
+		c := newCollector()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.Add("requests", 1)
+			}
+		})
+	})
+	b.Run("batched", func(b *testing.B) {
+		batcher := newMetricsBatcher(newCollector(), time.Second)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				batcher.Inc("requests")
+			}
+		})
+		batcher.Flush()
+	})
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}))
+
+	tests := []struct {
+		header   string
+		generate bool
+	}{
+		{"req-1", false},
+		{"", true},
+		{"bad\nid", true},
+		{strings.Repeat("x", maxRequestIDLength+1), true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Request-ID", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		echoed := w.Header().Get("X-Request-ID")
+		if echoed == "" || echoed != seen {
+			t.Errorf("%q: expected the context id %q to be echoed, got %q", tt.header, seen, echoed)
+		}
+		if !tt.generate && echoed != tt.header {
+			t.Errorf("%q: expected the incoming id to be kept, got %q", tt.header, echoed)
+		}
+		if tt.generate && (echoed == tt.header || len(echoed) != 32) {
+			t.Errorf("%q: expected a generated id, got %q", tt.header, echoed)
+		}
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	handler := requestIDMiddleware(accessLogMiddleware(newAccessLogger(&buf), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("User-ID", "42")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists?offset=0", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one access log line, got %q", buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("access log line is not valid JSON: %v", err)
+	}
+	want := map[string]interface{}{
+		"user":      "42",
+		"clientIp":  "192.0.2.1",
+		"method":    "GET",
+		"path":      "/api/v1/vehiclelists",
+		"status":    float64(http.StatusTeapot),
+		"bytes":     float64(5),
+		"requestId": "req-1",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, entry[k])
+		}
+	}
+	if _, ok := entry["time"].(string); !ok {
+		t.Errorf("expected a timestamp, got %v", entry["time"])
+	}
+	if _, ok := entry["latencyMs"].(float64); !ok {
+		t.Errorf("expected a latency, got %v", entry["latencyMs"])
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "", "203.0.113.7"},
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.7:5000", []string{"198.51.100.1"}, "", "203.0.113.7"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.7:5000", nil, "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:5000", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"client prepending a spoofed hop", "10.0.0.1:5000", []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.1:5000", []string{"198.51.100.1, 203.0.113.7", "10.0.0.2"}, "", "203.0.113.7"},
+		{"only trusted hops", "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:5000", []string{"203.0.113.7, unknown"}, "", "10.0.0.1"},
+		{"trusted proxy with X-Real-IP", "10.0.0.1:5000", nil, "203.0.113.7", "203.0.113.7"},
+		{"X-Forwarded-For before X-Real-IP", "10.0.0.1:5000", []string{"203.0.113.7"}, "198.51.100.1", "203.0.113.7"},
+		{"trusted IPv6 proxy", "[::1]:5000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"IPv4-mapped trusted proxy", "[::ffff:10.0.0.1]:5000", []string{"203.0.113.7"}, "", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+}
+
+func TestExportAllHandler(t *testing.T) {
+	withSettings(t, func(s *settings) { s.AdminUsers = []string{"admin"} })
+
+	// Mock storage
+	past := time.Now().Add(-time.Hour)
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
+		2: {{ID: 200, Plate: "QWE456"}, {ID: 201, Plate: "OLD000", ExpiresAt: &past}},
+		3: {{ID: 300, Plate: "RTY000"}},
+	}
+	handler := requireRole(roleAdmin, http.HandlerFunc(exportAllHandler))
+
+	export := func(user, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/export/records"+query, nil)
+		req = req.WithContext(contextWithSession(req.Context(), Session{User: user, Role: userRole(user)}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := export("viewer", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden for a non-admin, got %v", w.Code)
+	}
+
+	tests := []struct {
+		query string
+		want  [][2]int64 // list id, record id
+	}{
+		{"", [][2]int64{{1, 100}, {1, 101}, {2, 200}, {3, 300}}},
+		{"?ids=3,1", [][2]int64{{1, 100}, {1, 101}, {3, 300}}},
+	}
+	for _, tt := range tests {
+		w := export("admin", tt.query)
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("%q: unexpected content type %q", tt.query, ct)
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if len(lines) != len(tt.want) {
+			t.Fatalf("%q: expected %d lines, got %q", tt.query, len(tt.want), w.Body.String())
+		}
+		for i, line := range lines {
+			var rec exportedRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("%q: invalid line %q: %v", tt.query, line, err)
+			}
+			if rec.ListID != tt.want[i][0] || rec.ID != tt.want[i][1] {
+				t.Errorf("%q: line %d: expected list %d record %d, got %+v", tt.query, i, tt.want[i][0], tt.want[i][1], rec)
+			}
+		}
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	now := time.Now()
+	storage.Tokens = map[string]Session{
+		"mine-current-123456": {ID: 1, Expiry: now.Add(time.Minute), CreatedAt: now.Add(-time.Minute), UserAgent: "laptop"},
+		"mine-other-abcdef":   {ID: 1, Expiry: now.Add(time.Minute), CreatedAt: now, UserAgent: "phone"},
+		"mine-expired-000000": {ID: 1, Expiry: now.Add(-time.Minute)},
+		"theirs-654321":       {ID: 2, Expiry: now.Add(time.Minute)},
+	}
+	caller := storage.Tokens["mine-current-123456"]
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil)
+	req.Header.Set("Authorization", "Bearer mine-current-123456")
+	req = req.WithContext(contextWithSession(req.Context(), caller))
+	w := httptest.NewRecorder()
+
+	sessionsHandler(w, req)
+
+	var result struct {
+		Entries []sessionInfo `json:"entries"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result.Entries) != 2 {
+		t.Fatalf("expected the caller's 2 active sessions, got %+v", result.Entries)
+	}
+	first, second := result.Entries[0], result.Entries[1]
+	if first.Token != "****123456" || !first.Current || first.UserAgent != "laptop" {
+		t.Errorf("unexpected current session: %+v", first)
+	}
+	if second.Token != "****abcdef" || second.Current {
+		t.Errorf("unexpected other session: %+v", second)
+	}
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"****abcdef", http.StatusOK},
+		{"theirs-654321", http.StatusNotFound},
+	} {
+		req = httptest.NewRequest(http.MethodDelete, "/api/v1/sessions?token="+tt.token, nil)
+		req = req.WithContext(contextWithSession(req.Context(), caller))
+		w = httptest.NewRecorder()
+
+		sessionsHandler(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("revoke %s: expected status %v, got %v", tt.token, tt.want, w.Code)
+		}
+	}
+	if _, exists := storage.Tokens["mine-other-abcdef"]; exists {
+		t.Error("session was not revoked")
+	}
+	if _, exists := storage.Tokens["theirs-654321"]; !exists {
+		t.Error("another user's session was revoked")
+	}
+}
+
+// withSettings runs the rest of the test with settings modified by fn.
+func withSettings(t *testing.T, fn func(s *settings)) {
+	t.Helper()
+	s := *currentSettings()
+	fn(&s)
+	prev := setSettings(&s)
+	t.Cleanup(func() { setSettings(prev) })
+}
+
+func TestReloadConfig(t *testing.T) {
+	prev := currentSettings()
+	defer setSettings(prev)
+
+	path := filepath.Join(t.TempDir(), "kpam.yaml")
+	if err := os.WriteFile(path, []byte("token_expiry: 1m\nreserved_plates: [TEST*]\nlisten_addr: \":9000\"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err := reloadConfig(path); err != nil {
+		t.Fatalf("expected reload to succeed, got %v", err)
+	}
+	cfg := currentSettings()
+	if cfg.TokenExpiry != time.Minute || len(cfg.ReservedPlates) != 1 {
+		t.Errorf("expected reloaded settings, got %+v", cfg.Config)
+	}
+	if cfg.MaxPlateLength != defaultMaxPlateLength {
+		t.Errorf("expected default max plate length, got %v", cfg.MaxPlateLength)
+	}
+
+	changes := strings.Join(configChanges(&prev.Config, &cfg.Config), ", ")
+	if !strings.Contains(changes, "token_expiry 5m0s -> 1m0s") {
+		t.Errorf("expected token_expiry change, got %q", changes)
+	}
+	if !strings.Contains(changes, "listen_addr  -> :9000 (on restart)") {
+		t.Errorf("expected listen_addr change applied on restart, got %q", changes)
+	}
+
+	// Secrets are reported as changed without their values.
+	secret := cfg.Config
+	secret.JWTSecret = "supersecretjwtvalue"
+	secret.APIKeys = []APIKey{{Key: "supersecretapikey123", User: "gate"}}
+	secret.Users = []ServiceAccount{{Username: "gate", Password: "hunter2-secret"}}
+	changes = strings.Join(configChanges(&cfg.Config, &secret), ", ")
+	for _, value := range []string{"supersecretjwtvalue", "supersecretapikey123", "hunter2-secret"} {
+		if strings.Contains(changes, value) {
+			t.Errorf("expected %q not to be logged, got %q", value, changes)
+		}
+	}
+	if !strings.Contains(changes, "api_keys changed") || !strings.Contains(changes, "jwt_secret changed") || !strings.Contains(changes, "users changed (on restart)") {
+		t.Errorf("expected the secrets to be reported as changed, got %q", changes)
+	}
+
+	// An invalid file keeps the running settings.
+	if err := os.WriteFile(path, []byte("plate_pattern: \"[\"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err := reloadConfig(path); err == nil {
+		t.Error("expected reload of an invalid pattern to fail")
+	}
+	if currentSettings() != cfg {
+		t.Error("expected settings to be kept after a failed reload")
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	defer func() { snapshots = nil }()
+
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff"},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
+	}
+
+	capture := func(name string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/snapshots?name="+name, nil)
+		w := httptest.NewRecorder()
+		snapshotsHandler(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status Created, got %v", w.Code)
+		}
+	}
+
+	capture("before")
+	storage.Lists[1] = VehicleList{ID: 1, DisplayName: "Staff cars"}
+	storage.Records[1] = append(storage.Records[1][1:], Record{ID: 102, Plate: "NEW001"})
+	capture("after")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/snapshots/diff?from=before&to=after", nil)
+	w := httptest.NewRecorder()
+	snapshotDiffHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var diff struct {
+		Lists struct {
+			Changed []struct{ Before, After VehicleList }
+		}
+		Records struct {
+			Added, Removed []exportedRecord
+			Changed        []json.RawMessage
+		}
+	}
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(diff.Lists.Changed) != 1 || diff.Lists.Changed[0].After.DisplayName != "Staff cars" {
+		t.Errorf("expected the renamed list to be changed, got %+v", diff.Lists)
+	}
+	if len(diff.Records.Added) != 1 || diff.Records.Added[0].Plate != "NEW001" {
+		t.Errorf("expected record NEW001 added, got %+v", diff.Records.Added)
+	}
+	if len(diff.Records.Removed) != 1 || diff.Records.Removed[0].Plate != "ABC123" {
+		t.Errorf("expected record ABC123 removed, got %+v", diff.Records.Removed)
+	}
+	if len(diff.Records.Changed) != 0 {
+		t.Errorf("expected no changed records, got %d", len(diff.Records.Changed))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/snapshots/diff?from=before&to=missing", nil)
+	w = httptest.NewRecorder()
+	snapshotDiffHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown snapshot, got %v", w.Code)
+	}
+
+	for i := 0; i < maxSnapshots+2; i++ {
+		capture(strconv.Itoa(i))
+	}
+	if _, ok := findSnapshot("before"); ok || len(snapshots) != maxSnapshots {
+		t.Errorf("expected retention of %d snapshots, got %d", maxSnapshots, len(snapshots))
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := defaultConfig().Validate(); err != nil {
+		t.Errorf("expected default config to be valid, got %v", err)
+	}
+
+	config := defaultConfig()
+	config.BaseURL = "localhost:1608"
+	config.TokenExpiry = -time.Minute
+	config.PlatePattern = "["
+	config.TLSKey = "key.pem"
+	config.CookieName = "my session"
+	config.CookiePath = "api"
+	config.OutputCasing = "kebab"
+	config.TrustedProxies = []string{"proxy.local"}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected invalid config to fail validation")
+	}
+	for _, key := range []string{"base_url", "token_expiry", "plate_pattern", "tls_cert", "cookie_name", "cookie_path", "output_casing", "trusted_proxies"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("expected an error for %s, got %q", key, err)
+		}
+	}
+
+	dir := t.TempDir()
+	if _, err := readConfig(filepath.Join(dir, "missing.yaml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a not exist error for a missing file, got %v", err)
+	}
+	path := filepath.Join(dir, "kpam.yaml")
+	if err := os.WriteFile(path, []byte("token_expiri: 1m\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if _, err := readConfig(path); err == nil || !strings.Contains(err.Error(), "token_expiri") {
+		t.Errorf("expected an error naming the unknown key, got %v", err)
+	}
+}
+
+func TestPersisterRetry(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, DisplayName: "Staff"}}
+	storage.Records = map[int64][]Record{1: {{ID: 100, Plate: "ABC123"}}}
+
+	var written []byte
+	failures := 2
+	p := newPersister(func(data []byte) error {
+		if failures > 0 {
+			failures--
+			// The change made while the disk was failing must be written too.
+			storage.Records[1] = append(storage.Records[1], Record{ID: 101, Plate: "XYZ789"})
+			return errors.New("disk full")
+		}
+		written = data
+		return nil
+	}, 3, time.Millisecond)
+
+	exhausted := metrics.Value("amv_persist_retries_exhausted_total")
+	if !p.flush() {
+		t.Fatal("expected the write to succeed after retries")
+	}
+	var state persistedState
+	if err := json.Unmarshal(written, &state); err != nil {
+		t.Fatalf("failed to decode persisted state: %v", err)
+	}
+	if len(state.Records[1]) != 3 || state.Lists[1].DisplayName != "Staff" {
+		t.Errorf("expected the latest state to be persisted, got %+v", state)
+	}
+
+	p = newPersister(func([]byte) error { return errors.New("disk full") }, 2, time.Millisecond)
+	if p.flush() {
+		t.Error("expected the write to give up")
+	}
+	if got := metrics.Value("amv_persist_retries_exhausted_total"); got != exhausted+1 {
+		t.Errorf("expected exhausted retries to be counted, got %v", got)
+	}
+}
+
+func TestPersistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, DisplayName: "Staff"}}
+	storage.Records = map[int64][]Record{1: {{ID: 100, Plate: "ABC123"}}}
+
+	p := newPersister(fileWriter(path), 0, time.Millisecond)
+	handler := persistMiddleware(p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record", nil))
+	select {
+	case <-p.dirty:
+	default:
+		t.Fatal("expected a successful POST to schedule a write")
+	}
+	if !p.flush() {
+		t.Fatal("expected the write to succeed")
+	}
+
+	storage.Lists, storage.Records = map[int64]VehicleList{}, map[int64][]Record{}
+	if err := loadStorage(path); err != nil {
+		t.Fatalf("failed to load storage: %v", err)
+	}
+	if len(storage.Records[1]) != 1 || storage.Lists[1].DisplayName != "Staff" {
+		t.Errorf("expected storage to be restored, got %v %v", storage.Lists, storage.Records)
+	}
+}
+
+func TestOutputCasing(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	storage.Lists = map[int64]VehicleList{id: {ID: id, DisplayName: "Staff", Name: "staff", UpdatedAt: updated}}
+	storage.Records = map[int64][]Record{id: {{ID: 100, Plate: "AB12", VehicleType: "car", Version: 1, UpdatedAt: updated}}}
+
+	get := func(path string, handler http.HandlerFunc) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		var body struct {
+			Entries []map[string]interface{} `json:"entries"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || len(body.Entries) != 1 {
+			t.Fatalf("%s: expected one entry, got %v", path, err)
+		}
+		return body.Entries[0]
+	}
+	keys := func(entry map[string]interface{}) []string {
+		var keys []string
+		for key := range entry {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	tests := []struct {
+		casing      string
+		listKeys    []string
+		recordKeys  []string
+		vehicleType string
+	}{
+		{casingCamel, []string{"archived", "color", "displayName", "id", "name", "order", "owner", "recordCount", "status", "updatedAt"}, []string{"id", "plate", "updatedAt", "vehicleType", "version"}, "vehicleType"},
+		{casingSnake, []string{"archived", "color", "display_name", "id", "name", "order", "owner", "record_count", "status", "updated_at"}, []string{"id", "plate", "updated_at", "vehicle_type", "version"}, "vehicle_type"},
+	}
+	for _, tt := range tests {
+		withSettings(t, func(s *settings) { s.OutputCasing = tt.casing })
+
+		list := get("/api/v1/vehiclelists", handleGetLists)
+		if got := keys(list); !reflect.DeepEqual(got, tt.listKeys) {
+			t.Errorf("%s: expected list keys %v, got %v", tt.casing, tt.listKeys, got)
+		}
+		rec := get("/api/v1/vehiclelist/record?id=1", handleGetRecord)
+		if got := keys(rec); !reflect.DeepEqual(got, tt.recordKeys) {
+			t.Errorf("%s: expected record keys %v, got %v", tt.casing, tt.recordKeys, got)
+		}
+		if rec[tt.vehicleType] != "car" || rec["plate"] != "AB12" {
+			t.Errorf("%s: expected the same values in either casing, got %v", tt.casing, rec)
+		}
+		// Entries embedding a record keep their own fields.
+		line, _ := json.Marshal(exportedRecord{ListID: id, Record: storage.Records[id][0]})
+		if want := `{"` + outputKey("listId") + `":1,"id":100,"plate":"AB12","` + tt.vehicleType + `":"car",`; !strings.HasPrefix(string(line), want) {
+			t.Errorf("%s: expected an export line starting with %s, got %s", tt.casing, want, line)
+		}
+	}
+
+	// A file persisted in snake_case loads back.
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, _ := json.Marshal(persistedState{Lists: storage.Lists, Records: storage.Records})
+	if err := os.WriteFile(path, state, 0o644); err != nil {
+		t.Fatalf("failed to write state: %v", err)
+	}
+	want := storage.Records[id][0]
+	storage.Lists, storage.Records = map[int64]VehicleList{}, map[int64][]Record{}
+	if err := loadStorage(path); err != nil {
+		t.Fatalf("failed to load snake_case state: %v", err)
+	}
+	if got := storage.Records[id]; len(got) != 1 || got[0].VehicleType != want.VehicleType || !got[0].UpdatedAt.Equal(want.UpdatedAt) {
+		t.Errorf("expected %+v to load back, got %+v", want, got)
+	}
+	if storage.Lists[id].DisplayName != "Staff" {
+		t.Errorf("expected the list to load back, got %+v", storage.Lists[id])
+	}
+}
+
+func TestSeedStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.json")
+	seed := `{
+		"lists": {"1": {"id": 1, "displayName": "Staff"}, "2": {"id": 2, "displayName": "Visitors"}},
+		"records": {"1": [{"id": 100, "plate": "abc 123", "vehicleType": "Car"}, {"plate": "XYZ789"}]}
+	}`
+	if err := os.WriteFile(path, []byte(seed), 0o644); err != nil {
+		t.Fatalf("failed to write seed: %v", err)
+	}
+
+	storage.Lists, storage.Records = map[int64]VehicleList{}, map[int64][]Record{}
+	seeded, err := seedStorage(path)
+	if err != nil || !seeded {
+		t.Fatalf("expected an empty storage to be seeded, got %v %v", seeded, err)
+	}
+	if len(storage.Lists) != 2 || storage.Lists[2].DisplayName != "Visitors" {
+		t.Errorf("expected the seeded lists, got %v", storage.Lists)
+	}
+	records := storage.Records[1]
+	if len(records) != 2 || records[0].ID != 100 || records[0].Plate != "ABC123" || records[1].ID == 0 || records[1].Version != 1 {
+		t.Errorf("expected the seeded records with ids and versions, got %+v", records)
+	}
+	if records, ok := storage.Records[2]; !ok || len(records) != 0 {
+		t.Errorf("expected an empty record list for list 2, got %v", storage.Records)
+	}
+	if !storage.plates.inList("XYZ789", 1) {
+		t.Error("expected the seeded plates to be indexed")
+	}
+
+	// Persisted data wins over the seed.
+	storage.Lists = map[int64]VehicleList{5: {ID: 5, DisplayName: "Restored"}}
+	storage.Records = map[int64][]Record{5: {}}
+	if seeded, err := seedStorage(path); err != nil || seeded {
+		t.Errorf("expected a non-empty storage not to be seeded, got %v %v", seeded, err)
+	}
+	if len(storage.Lists) != 1 || storage.Lists[5].DisplayName != "Restored" {
+		t.Errorf("expected the storage to be left alone, got %v", storage.Lists)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"records": {"1": [{"plate": ""}]}}`), 0o644); err != nil {
+		t.Fatalf("failed to write seed: %v", err)
+	}
+	storage.Lists, storage.Records = map[int64]VehicleList{}, map[int64][]Record{}
+	if _, err := seedStorage(path); err == nil {
+		t.Error("expected an invalid record to fail seeding")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).UTC()
+	lists := map[int64]VehicleList{1: {ID: 1, DisplayName: "Staff"}, 2: {ID: 2, DisplayName: "Visitors"}}
+	records := map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123", VehicleType: "Car", Tags: []string{"staff"}, Version: 2, ExpiresAt: &expiry}},
+		2: {{ID: 200, Plate: "XYZ789", Version: 1}},
+	}
+	storage.Lists, storage.Records = lists, records
+
+	w := httptest.NewRecorder()
+	backupHandler(w, httptest.NewRequest(http.MethodPost, "/api/v1/admin/backup", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("expected a binary backup, got %v %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	data := w.Body.Bytes()
+
+	restore := func(body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		restoreHandler(w, httptest.NewRequest(http.MethodPost, "/api/v1/admin/restore", bytes.NewReader(body)))
+		return w
+	}
+
+	storage.Lists = map[int64]VehicleList{3: {ID: 3, DisplayName: "Changed since"}}
+	storage.Records = map[int64][]Record{3: {{ID: 300, Plate: "NEW1"}}}
+	w = restore(data)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	if !reflect.DeepEqual(storage.Lists, lists) || !reflect.DeepEqual(storage.Records, records) {
+		t.Errorf("expected the backup to round-trip, got %v %v", storage.Lists, storage.Records)
+	}
+	if !storage.plates.inList("XYZ789", 2) || storage.plates.inList("NEW1", 3) {
+		t.Error("expected the plate index to follow the restore")
+	}
+
+	// A corrupt or invalid upload must not touch the storage.
+	encode := func(b backup) []byte {
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(b)
+		return buf.Bytes()
+	}
+	for name, body := range map[string][]byte{
+		"truncated": data[:len(data)/2],
+		"not gob":   []byte(`{"lists":{}}`),
+		"duplicate ids": encode(backup{Version: backupVersion, Lists: lists, Records: map[int64][]Record{
+			1: {{ID: 100, Plate: "ABC123"}, {ID: 100, Plate: "DEF456"}},
+		}}),
+		"duplicate plates": encode(backup{Version: backupVersion, Lists: lists, Records: map[int64][]Record{
+			1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "abc 123"}},
+		}}),
+		"records without a list": encode(backup{Version: backupVersion, Lists: lists, Records: map[int64][]Record{
+			9: {{ID: 900, Plate: "ORPHAN1"}},
+		}}),
+		"new version": encode(backup{Version: backupVersion + 1}),
+	} {
+		if w := restore(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status Bad Request, got %v", name, w.Code)
+		}
+		if len(storage.Lists) != 2 || len(storage.Records[1]) != 1 {
+			t.Fatalf("%s: expected the storage to be left alone, got %v", name, storage.Records)
+		}
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}, 2: {ID: 2}}
+	past := time.Now().Add(-time.Hour)
+	storage.Records = map[int64][]Record{1: {{ID: 100}, {ID: 101}, {ID: 102}, {ID: 103, ExpiresAt: &past}}, 2: {}}
+	storage.Tokens = map[string]Session{
+		"live":    {ID: 1, Expiry: time.Now().Add(time.Hour)},
+		"expired": {ID: 1, Expiry: time.Now().Add(-time.Hour)},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/stats", nil)
+	w := httptest.NewRecorder()
+	statsHandler(w, req)
+
+	var stats storageStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected status OK with stats, got %v: %v", w.Code, err)
+	}
+	if stats.Lists != 2 || stats.TotalRecords != 3 || stats.ActiveTokens != 1 {
+		t.Errorf("expected 2 lists, 3 records and 1 active token, got %+v", stats)
+	}
+	if want := map[int64]int{1: 3, 2: 0}; !reflect.DeepEqual(stats.RecordsPerList, want) {
+		t.Errorf("expected records per list %v, got %v", want, stats.RecordsPerList)
+	}
+	if stats.MemoryBytes == 0 {
+		t.Error("expected the memory in use")
+	}
+}
+
+func TestLoadConfigEnvURL(t *testing.T) {
+	prev := currentSettings()
+	defer setSettings(prev)
+	t.Setenv("KPAM_URL", "https://kpam.example.com")
+
+	path := filepath.Join(t.TempDir(), "kpam.yaml")
+	if err := os.WriteFile(path, []byte("base_url: http://localhost:1608\ntoken_expiry: 10m\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("expected config to load, got %v", err)
+	}
+	if config.BaseURL != "https://kpam.example.com" || config.TokenExpiry != 10*time.Minute {
+		t.Errorf("expected KPAM_URL to only override the base URL, got %+v", config)
+	}
+	s, err := newSettings(config)
+	if err != nil {
+		t.Fatalf("failed to apply config: %v", err)
+	}
+	setSettings(s)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader([]byte(`{"username":"test","password":"password"}`)))
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected a token cookie")
+	}
+	if ttl := time.Until(cookies[0].Expires); ttl < 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("expected the token to expire in 10m, got %v", ttl)
+	}
+
+	config, err = loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil || config.TokenExpiry != defaultTokenExpiry || config.BaseURL != "https://kpam.example.com" {
+		t.Errorf("expected defaults with the KPAM_URL base URL, got %+v, %v", config, err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		config string
+		want   int
+	}{
+		{"valid", "base_url: http://localhost:1608\naccess_log: " + filepath.Join(dir, "access.log") + "\n", 0},
+		{"invalid", "token_expiry: -1m\nplate_pattern: \"[\"\n", 1},
+		{"missing directory", "persist_path: " + filepath.Join(dir, "missing", "storage.json") + "\n", 1},
+		{"missing TLS key", "tls_cert: cert.pem\ntls_key: key.pem\n", 1},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".yaml")
+		if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		var out bytes.Buffer
+		if got := checkConfig(path, &out); got != tt.want {
+			t.Errorf("%s: expected exit code %d, got %d: %s", tt.name, tt.want, got, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if got := checkConfig(filepath.Join(dir, "none.yaml"), &out); got != 1 {
+		t.Errorf("expected a missing config file to fail the check, got %d", got)
+	}
+}
+
+func TestRecordAuditHandler(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{id: {}}
+
+	serve := func(handler http.HandlerFunc, method, query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/vehiclelist/record"+query, strings.NewReader(body))
+		req = req.WithContext(contextWithSession(req.Context(), Session{User: "alice"}))
+		w := httptest.NewRecorder()
+		recordMiddleware(handler).ServeHTTP(w, req)
+		return w
+	}
+
+	serve(handlePostRecord, http.MethodPost, "?id=1", `{"id":500,"plate":"AUD001"}`)
+	serve(handlePutRecord, http.MethodPut, "?id=1&recordId=500", `{"plate":"AUD001","vehicleType":"Van","version":1}`)
+	serve(handleDeleteRecord, http.MethodDelete, "?id=1&recordId=500", "")
+
+	w := serve(recordAuditHandler, http.MethodGet, "?id=1&recordId=500", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var result struct{ Entries []auditEvent }
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	want := []string{auditCreate, auditUpdate, auditDelete}
+	if len(result.Entries) != len(want) {
+		t.Fatalf("expected %d audit entries, got %+v", len(want), result.Entries)
+	}
+	for i, event := range result.Entries {
+		if event.Action != want[i] || event.User != "alice" || event.RecordID != 500 {
+			t.Errorf("entry %d: expected %s by alice, got %+v", i, want[i], event)
+		}
+		if i > 0 && event.Time.Before(result.Entries[i-1].Time) {
+			t.Errorf("entry %d is out of order", i)
+		}
+	}
+	if result.Entries[2].Record.VehicleType != "Van" {
+		t.Errorf("expected the delete to carry the deleted record, got %+v", result.Entries[2].Record)
+	}
+
+	if w := serve(recordAuditHandler, http.MethodGet, "?id=1&recordId=501", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown record, got %v", w.Code)
+	}
+
+	// Only the latest events are kept, and auditSince counts past the
+	// dropped ones.
+	since := auditLength()
+	for i := 0; i < maxAuditEvents+2; i++ {
+		recordAudit("bob", auditUpdate, 2, Record{ID: int64(i)})
+	}
+	auditLog.Lock()
+	n, first := len(auditLog.events), auditLog.events[0].RecordID
+	auditLog.Unlock()
+	if n != maxAuditEvents || first != 2 {
+		t.Errorf("expected the latest %d events, got %d from record %d", maxAuditEvents, n, first)
+	}
+	if got := len(auditSince(since, "bob")); got != maxAuditEvents {
+		t.Errorf("expected the kept changes since %d, got %d", since, got)
+	}
+	if got := auditSince(auditLength()-1, "bob"); len(got) != 1 || got[0].RecordID != maxAuditEvents+1 {
+		t.Errorf("expected the last change, got %+v", got)
+	}
+	if len(auditTrail(1, 500)) != 0 {
+		t.Error("expected the dropped trail of record 500")
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	w := httptest.NewRecorder()
+	openAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var spec struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+			SecuritySchemes map[string]json.RawMessage `json:"securitySchemes"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("expected OpenAPI 3.0.3, got %q", spec.OpenAPI)
+	}
+	if _, ok := spec.Paths["/api/v1/vehiclelist/record"]["put"]; !ok {
+		t.Error("expected the record update to be described")
+	}
+	if _, ok := spec.Components.SecuritySchemes["cookieAuth"]; !ok {
+		t.Error("expected the session cookie to be described")
+	}
+
+	// The schemas follow the structs, so every JSON field must show up.
+	for name, sample := range map[string]interface{}{"VehicleList": VehicleList{}, "Record": Record{}, "APIError": apiError{}} {
+		data, _ := json.Marshal(sample)
+		var fields map[string]interface{}
+		json.Unmarshal(data, &fields)
+		schema, ok := spec.Components.Schemas[name]
+		if !ok {
+			t.Errorf("expected a %s schema", name)
+			continue
+		}
+		for field := range fields {
+			if _, ok := schema.Properties[field]; !ok {
+				t.Errorf("expected %s.%s in the schema", name, field)
+			}
+		}
+	}
+}
+
+func TestRecordWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []recordEvent
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var event recordEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	recordWebhook = newWebhook(server.URL)
+	recordWebhook.backoff = time.Millisecond
+	go recordWebhook.run()
+	t.Cleanup(func() {
+		close(recordWebhook.events)
+		recordWebhook = nil
+	})
+
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}}
+	storage.Records = map[int64][]Record{1: {}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", strings.NewReader(`{"id":600,"plate":"HOOK01"}`))
+	w := httptest.NewRecorder()
+	recordMiddleware(http.HandlerFunc(handlePostRecord)).ServeHTTP(w, req)
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/vehiclelist/record?id=1&recordId=600", nil)
+	recordMiddleware(http.HandlerFunc(handleDeleteRecord)).ServeHTTP(httptest.NewRecorder(), req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status Created, got %v", w.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 delivered events, got %+v", received)
+	}
+	if received[0].Type != auditCreate || received[0].ListID != 1 || received[0].Record.Plate != "HOOK01" {
+		t.Errorf("expected the create event after a retry, got %+v", received[0])
+	}
+	if received[1].Type != auditDelete || received[1].Record.ID != 600 {
+		t.Errorf("expected the delete event, got %+v", received[1])
+	}
+}
+
+func TestRecordStream(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}}
+	storage.Records = map[int64][]Record{1: {}}
+
+	server := httptest.NewServer(metricsMiddleware(recordMiddleware(http.HandlerFunc(recordStreamHandler))))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/vehiclelist/record/stream?id=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open the stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || !strings.HasPrefix(lines.Text(), "retry:") {
+		t.Fatalf("expected the retry interval first, got %q", lines.Text())
+	}
+	if n := changes.subscriberCount(1); n != 1 {
+		t.Fatalf("expected 1 subscriber, got %d", n)
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", strings.NewReader(`{"id":700,"plate":"LIVE01"}`))
+	recordMiddleware(http.HandlerFunc(handlePostRecord)).ServeHTTP(httptest.NewRecorder(), post)
+
+	var eventType string
+	var event recordEvent
+	for lines.Scan() {
+		if name, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+			eventType = name
+		}
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			json.Unmarshal([]byte(data), &event)
+			break
+		}
+	}
+	if eventType != auditCreate || event.ListID != 1 || event.Record.Plate != "LIVE01" {
+		t.Errorf("expected a create event for LIVE01, got %q %+v", eventType, event)
+	}
+
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for changes.subscriberCount(1) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := changes.subscriberCount(1); n != 0 {
+		t.Errorf("expected the subscriber to be removed on disconnect, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	recordMiddleware(http.HandlerFunc(recordStreamHandler)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/stream?id=9", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown list, got %v", w.Code)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	withSettings(t, func(s *settings) { s.AdminUsers = []string{"alice"} })
+	// Mock storage
+	session := Session{Expiry: time.Now().Add(time.Minute), ID: 1, User: "alice", Role: roleAdmin}
+	token := generateToken(session)
+	storage.Tokens = map[string]Session{token: session}
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}}
+	storage.Records = map[int64][]Record{1: {}}
+
+	server := httptest.NewServer(metricsMiddleware(tokenMiddleware(http.HandlerFunc(wsHandler))))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the upgrade to require a session, got %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	read := func() map[string]interface{} {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("failed to read a message: %v", err)
+		}
+		return msg
+	}
+
+	conn.WriteJSON(wsCommand{Type: wsSubscribe, ListID: 1})
+	if msg := read(); msg["type"] != "ok" || msg["command"] != wsSubscribe {
+		t.Fatalf("expected the subscription to succeed, got %v", msg)
+	}
+
+	conn.WriteJSON(wsCommand{Type: wsAdd, ListID: 1, Record: Record{ID: 800, Plate: "SOCK01"}})
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := read()
+		got[msg["type"].(string)] = true
+		if rec, _ := msg["record"].(map[string]interface{}); rec["plate"] != "SOCK01" {
+			t.Errorf("expected the added record in %v", msg)
+		}
+	}
+	if !got["ok"] || !got[auditCreate] {
+		t.Errorf("expected a reply and a create event, got %v", got)
+	}
+	if trail := auditTrail(1, 800); len(trail) != 1 || trail[0].User != "alice" {
+		t.Errorf("expected the add to be audited as alice, got %+v", trail)
+	}
+
+	conn.WriteJSON(wsCommand{Type: wsUnsubscribe, ListID: 1})
+	read()
+	conn.WriteJSON(wsCommand{Type: wsDelete, ListID: 1, RecordID: 800})
+	if msg := read(); msg["type"] != "ok" || msg["command"] != wsDelete {
+		t.Errorf("expected the delete to succeed without an event, got %v", msg)
+	}
+	conn.WriteJSON(wsCommand{Type: wsDelete, ListID: 1, RecordID: 800})
+	if msg := read(); msg["type"] != "error" || msg["error"] != "Record not found" {
+		t.Errorf("expected an error for a missing record, got %v", msg)
+	}
+	conn.WriteJSON(wsCommand{Type: wsSubscribe, ListID: 9})
+	if msg := read(); msg["type"] != "error" {
+		t.Errorf("expected an error for an unknown list, got %v", msg)
+	}
+
+	conn.WriteJSON(wsCommand{Type: wsSubscribe, ListID: 1})
+	read()
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for changes.subscriberCount(1) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := changes.subscriberCount(1); n != 0 {
+		t.Errorf("expected the subscription to end with the connection, got %d", n)
+	}
+}
+
+func TestAuditMutations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := openMutationLog(path)
+	if err != nil {
+		t.Fatalf("failed to open the audit log: %v", err)
+	}
+	t.Cleanup(func() {
+		file.Close()
+		mutationLog.events, mutationLog.out = nil, nil
+	})
+
+	// Mock storage
+	session := Session{Expiry: time.Now().Add(time.Minute), ID: 7, User: "alice"}
+	token := generateToken(session)
+	storage.Tokens = map[string]Session{token: session}
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}, 2: {ID: 2}}
+	storage.Records = map[int64][]Record{1: {}, 2: {}}
+
+	handler := tokenMiddleware(recordMiddleware(http.HandlerFunc(recordHandler)))
+	for _, target := range []string{"?id=1", "?id=2", "?id=1"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record"+target, strings.NewReader(`{"plate":"AUD`+target[4:]+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	auditHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit?userId=7&listId=1&limit=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %v", w.Code)
+	}
+	var result struct {
+		Entries  []mutationEvent
+		Metadata pageMetadata `json:"_metadata"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.Metadata.TotalCount != 2 || len(result.Entries) != 1 {
+		t.Fatalf("expected 2 mutations of list 1 paged to 1, got %+v", result)
+	}
+	event := result.Entries[0]
+	if event.User != "alice" || event.Method != http.MethodPost || event.Endpoint != "/api/v1/vehiclelist/record?id=1" || event.Status != http.StatusCreated {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if strings.Contains(string(event.Before), "records") || strings.Contains(string(event.After), "records") {
+		t.Errorf("expected the list without its records, got %s and %s", event.Before, event.After)
+	}
+	if len(event.Changes) != 1 || event.Changes[0].Action != auditCreate || event.Changes[0].Record.Plate != "AUD1" {
+		t.Errorf("expected the created record as the only change, got %+v", event.Changes)
+	}
+
+	// Credentials in the query are not logged.
+	endpoint := auditEndpoint(httptest.NewRequest(http.MethodDelete, "/api/v1/sessions?token=live-token", nil).URL)
+	if endpoint != "/api/v1/sessions?token=REDACTED" {
+		t.Errorf("expected the token to be redacted, got %q", endpoint)
+	}
+
+	w = httptest.NewRecorder()
+	auditHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/audit?userId=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an invalid userId, got %v", w.Code)
+	}
+
+	// The log survives a restart.
+	file.Close()
+	if file, err = openMutationLog(path); err != nil {
+		t.Fatalf("failed to reopen the audit log: %v", err)
+	}
+	if n := len(mutationLog.events); n != 3 {
+		t.Errorf("expected 3 mutations restored, got %d", n)
+	}
+
+	// Only the latest events are kept in memory.
+	for i := 0; i < maxMutationEvents+2; i++ {
+		appendMutation(mutationEvent{Status: i})
+	}
+	if n := len(mutationLog.events); n != maxMutationEvents || mutationLog.events[0].Status != 2 {
+		t.Errorf("expected the latest %d mutations, got %d from status %d", maxMutationEvents, n, mutationLog.events[0].Status)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.AdminUsers = []string{"root"}
+		s.Roles = map[string]string{"alice": roleAdmin, "root": roleViewer}
+	})
+
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"alice", roleAdmin},
+		{"root", roleViewer}, // roles overrides admin_users
+		{"bob", roleViewer},
+	}
+	for _, tt := range tests {
+		if got := userRole(tt.user); got != tt.want {
+			t.Errorf("%s: expected role %s, got %s", tt.user, tt.want, got)
+		}
+	}
+
+	// The role travels in the token.
+	token := generateToken(Session{Expiry: time.Now().Add(time.Minute), User: "alice", Role: userRole("alice")})
+	session, err := authenticate(token)
+	if err != nil || session.Role != roleAdmin {
+		t.Fatalf("expected an admin session, got %+v, %v", session, err)
+	}
+
+	handler := adminWrites(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		role   string
+		method string
+		want   int
+	}{
+		{roleViewer, http.MethodGet, http.StatusOK},
+		{roleViewer, http.MethodPost, http.StatusForbidden},
+		{roleViewer, http.MethodDelete, http.StatusForbidden},
+		{roleAdmin, http.MethodPost, http.StatusOK},
+		{"", http.MethodPut, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tt.method, "/api/v1/vehiclelist/record?id=1", nil)
+		req = req.WithContext(contextWithSession(req.Context(), Session{User: "u", Role: tt.role}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %v, got %v", tt.role, tt.method, tt.want, w.Code)
+		}
+	}
+}
+
+func TestListACL(t *testing.T) {
+	seedACL(map[string][]int64{"carol": {1}})
+	t.Cleanup(func() { seedACL(nil) })
+
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, Name: "a"}, 2: {ID: 2, Name: "b"}}
+	storage.Records = map[int64][]Record{1: {}, 2: {}}
+
+	serve := func(user, role string, handler http.Handler, method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req = req.WithContext(contextWithSession(req.Context(), Session{ID: userID(user), User: user, Role: role}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	records := recordMiddleware(http.HandlerFunc(recordHandler))
+
+	tests := []struct {
+		user, role string
+		list       string
+		want       int
+	}{
+		{"carol", roleViewer, "1", http.StatusOK},
+		{"carol", roleViewer, "2", http.StatusForbidden},
+		{"carol", roleAdmin, "2", http.StatusOK}, // admins bypass the ACL
+		{"dave", roleViewer, "2", http.StatusOK}, // no ACL, no restriction
+	}
+	for _, tt := range tests {
+		if w := serve(tt.user, tt.role, records, http.MethodGet, "/api/v1/vehiclelist/record?id="+tt.list); w.Code != tt.want {
+			t.Errorf("%s as %s on list %s: expected status %v, got %v", tt.user, tt.role, tt.list, tt.want, w.Code)
+		}
+	}
+
+	w := serve("carol", roleViewer, http.HandlerFunc(handleGetLists), http.MethodGet, "/api/v1/vehiclelists")
+	var result struct{ Entries []VehicleList }
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result.Entries) != 1 || result.Entries[0].ID != 1 {
+		t.Errorf("expected only list 1 to be listed, got %+v", result.Entries)
+	}
+
+	if w := serve("carol", roleViewer, http.HandlerFunc(handlePutList), http.MethodPut, "/api/v1/vehiclelists?id=2"); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden for updating list 2, got %v", w.Code)
+	}
+}
+
+func TestTokenMiddlewareAPIKey(t *testing.T) {
+	withSettings(t, func(s *settings) {
+		s.APIKeys = []APIKey{{Key: "barrier-key-0123456789", User: "barrier1", Role: roleAdmin}}
+	})
+
+	var got Session
+	handler := tokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = contextSession(r.Context())
+	}))
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"valid", "barrier-key-0123456789", http.StatusOK},
+		{"invalid", "barrier-key-wrong", http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		got = Session{}
+		// A mutation without X-CSRF-Token: API keys skip the CSRF check.
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s key: expected status %v, got %v", tt.name, tt.want, w.Code)
+		}
+		if tt.want == http.StatusOK && (got.User != "barrier1" || got.Role != roleAdmin || got.ID != userID("barrier1")) {
+			t.Errorf("%s key: unexpected session %+v", tt.name, got)
+		}
+	}
+}
+
+func TestPageMetadataLinks(t *testing.T) {
+	withSettings(t, func(s *settings) { s.BaseURL = "https://kpam.example/" })
+
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{}
+	for id := int64(1); id <= 5; id++ {
+		storage.Lists[id] = VehicleList{ID: id, Order: int(id)}
+	}
+
+	tests := []struct {
+		query            string
+		hasNext, hasPrev bool
+		next, prev       string
+	}{
+		{"?limit=2&sort=order", true, false, "https://kpam.example/api/v1/vehiclelists?limit=2&offset=2&sort=order", ""},
+		{"?limit=2&offset=2&sort=order", true, true, "https://kpam.example/api/v1/vehiclelists?limit=2&offset=4&sort=order", "https://kpam.example/api/v1/vehiclelists?limit=2&offset=0&sort=order"},
+		{"?limit=2&offset=4&sort=order", false, true, "", "https://kpam.example/api/v1/vehiclelists?limit=2&offset=2&sort=order"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handleGetLists(w, httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists"+tt.query, nil))
+		var result struct {
+			Metadata pageMetadata `json:"_metadata"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.query, err)
+		}
+		meta := result.Metadata
+		if meta.HasNext != tt.hasNext || meta.HasPrev != tt.hasPrev || meta.NextURL != tt.next || meta.PrevURL != tt.prev {
+			t.Errorf("%s: unexpected metadata %+v", tt.query, meta)
+		}
+	}
+
+	// The record listing only pages when asked to.
+	storage.Records = map[int64][]Record{1: {{ID: 1}, {ID: 2}, {ID: 3}}}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1&limit=2", nil)
+	recordMiddleware(http.HandlerFunc(handleGetRecord)).ServeHTTP(w, req)
+	var result struct {
+		Entries  []Record
+		Metadata pageMetadata `json:"_metadata"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(result.Entries) != 2 || result.Metadata.NextURL != "https://kpam.example/api/v1/vehiclelist/record?id=1&limit=2&offset=2" {
+		t.Errorf("expected the first 2 records with a next link, got %+v", result)
+	}
+}
+
+func TestYAMLContentNegotiation(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, DisplayName: "Staff"}}
+	storage.Records = map[int64][]Record{1: {{ID: 1700000000000000001, Plate: "YAML01"}}}
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"application/json", "application/json"},
+		{"application/yaml", "application/yaml"},
+		{"", "application/json"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		recordMiddleware(http.HandlerFunc(handleGetRecord)).ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("Accept %q: expected %s, got %s", tt.accept, tt.contentType, ct)
+		}
+
+		var result struct {
+			Entries []Record `json:"entries"`
+		}
+		var err error
+		if tt.contentType == "application/yaml" {
+			var generic struct {
+				Entries []map[string]interface{} `yaml:"entries"`
+			}
+			err = yaml.Unmarshal(w.Body.Bytes(), &generic)
+			if err == nil && (len(generic.Entries) != 1 || generic.Entries[0]["id"] != 1700000000000000001 || generic.Entries[0]["plate"] != "YAML01") {
+				t.Errorf("Accept %q: unexpected body %s", tt.accept, w.Body.String())
+			}
+		} else {
+			err = json.NewDecoder(w.Body).Decode(&result)
+			if err == nil && (len(result.Entries) != 1 || result.Entries[0].Plate != "YAML01") {
+				t.Errorf("Accept %q: unexpected entries %+v", tt.accept, result.Entries)
+			}
+		}
+		if err != nil {
+			t.Errorf("Accept %q: failed to decode response: %v", tt.accept, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelists", nil)
+	req.Header.Set("Accept", "application/yaml")
+	w := httptest.NewRecorder()
+	handleGetLists(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/yaml" || !strings.Contains(w.Body.String(), "displayName: Staff") {
+		t.Errorf("expected the lists as YAML, got %s: %s", ct, w.Body.String())
+	}
+}
+
+func TestImportRecordHandlerDryRun(t *testing.T) {
+	// Mock storage
+	id := int64(1)
+	storage.Lists = map[int64]VehicleList{id: {ID: id}}
+	storage.Records = map[int64][]Record{
+		id: {{ID: 100, Plate: "ABC123", VehicleType: "Car"}},
+	}
+
+	reqBody := "plate,vehicleType\nxyz 789,Truck\n\nABC-123,Car\nQWE456\n\"bad,plate\n"
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/import?id=1&dryRun=true", bytes.NewReader([]byte(reqBody)))
+	req.Header.Set("Content-Type", "text/csv")
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w := httptest.NewRecorder()
+
+	importRecordHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status OK for a dry run, got %v", w.Code)
+	}
+	var result importResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !result.DryRun || result.Created != 2 || result.Rejected != 2 {
+		t.Errorf("expected the report of a real import, got %+v", result)
+	}
+	if len(storage.Records[id]) != 1 {
+		t.Errorf("expected a dry run to store nothing, got %+v", storage.Records[id])
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record/bulk?id=1&dryRun=true", strings.NewReader(`[{"plate":"NEW1"},{"plate":"ABC123"}]`))
+	req = req.WithContext(contextWithID(req.Context(), id))
+	w = httptest.NewRecorder()
+	bulkRecordHandler(w, req)
+	var bulk bulkResult
+	if err := json.NewDecoder(w.Body).Decode(&bulk); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if w.Code != http.StatusOK || !bulk.DryRun || bulk.Created != 1 || bulk.Skipped != 1 || len(storage.Records[id]) != 1 {
+		t.Errorf("unexpected bulk dry run: %v %+v", w.Code, bulk)
+	}
+}
+
+func TestIdempotentRecordPost(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}}
+	storage.Records = map[int64][]Record{1: {}}
+	storage.Idempotency = map[string]idempotentResponse{}
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		req.Header.Set("User-ID", "7")
+		w := httptest.NewRecorder()
+		recordMiddleware(http.HandlerFunc(recordHandler)).ServeHTTP(w, req)
+		return w
+	}
+
+	first := post("retry-1", `{"plate":"IDEM01"}`)
+	replay := post("retry-1", `{"plate":"IDEM01"}`)
+	if first.Code != http.StatusCreated || replay.Code != http.StatusCreated {
+		t.Fatalf("expected both attempts to report Created, got %v and %v", first.Code, replay.Code)
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected the retry to be a replay")
+	}
+	if n := len(storage.Records[1]); n != 1 {
+		t.Errorf("expected 1 record after a retry, got %d", n)
+	}
+
+	if w := post("retry-1", `{"plate":"IDEM02"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status Unprocessable Entity for a reused key, got %v", w.Code)
+	}
+	if w := post("retry-2", `{"plate":"IDEM02"}`); w.Code != http.StatusCreated || len(storage.Records[1]) != 2 {
+		t.Errorf("expected a new key to create a record, got %v", w.Code)
+	}
+
+	// A panicking handler releases its key for a retry.
+	func() {
+		defer func() { recover() }()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/vehiclelist/record?id=1", strings.NewReader(`{"plate":"IDEM03"}`))
+		req.Header.Set("Idempotency-Key", "retry-3")
+		req.Header.Set("User-ID", "7")
+		idempotent(func(http.ResponseWriter, *http.Request) { panic("handler failed") })(httptest.NewRecorder(), req)
+	}()
+	if w := post("retry-3", `{"plate":"IDEM03"}`); w.Code != http.StatusCreated {
+		t.Errorf("expected a retry after a panic to be served, got %v", w.Code)
+	}
+
+	// The janitor evicts keys after the window.
+	storage.Lock()
+	purgeExpired(time.Now().Add(currentSettings().IdempotencyWindow + time.Second))
+	n := len(storage.Idempotency)
+	storage.Unlock()
+	if n != 0 {
+		t.Errorf("expected expired keys to be evicted, %d remain", n)
+	}
+}
+
+func TestRegisterRoutesBasePath(t *testing.T) {
+	config := defaultConfig()
+	config.BasePath = "/kpam"
+	mux := http.NewServeMux()
+	registerRoutes(mux, config)
+
+	for _, tc := range []struct {
+		method, path, pattern string
+	}{
+		{"POST", "/kpam/login", "/kpam/login"},
+		{"GET", "/kpam/api/v1/vehiclelists", "/kpam/api/v1/vehiclelists"},
+		{"GET", "/kpam/api/v1/audit", "GET /kpam/api/v1/audit"},
+		{"GET", "/kpam/metrics", "/kpam/metrics"},
+		{"GET", "/api/v1/vehiclelists", ""},
+		{"GET", "/metrics", ""},
+	} {
+		_, pattern := mux.Handler(httptest.NewRequest(tc.method, tc.path, nil))
+		if pattern != tc.pattern {
+			t.Errorf("%s %s: expected pattern %q, got %q", tc.method, tc.path, tc.pattern, pattern)
+		}
+	}
+
+	// Metrics can stay at the root for monitoring.
+	config.OpsOutsideBasePath = true
+	mux = http.NewServeMux()
+	registerRoutes(mux, config)
+	if _, pattern := mux.Handler(httptest.NewRequest("GET", "/metrics", nil)); pattern != "/metrics" {
+		t.Errorf("expected /metrics outside the base path, got %q", pattern)
+	}
+
+	if err := (&Config{BaseURL: defaultURL, BasePath: "kpam/"}).Validate(); err == nil || !strings.Contains(err.Error(), "base_path") {
+		t.Errorf("expected an invalid base_path to be rejected, got %v", err)
+	}
+}
+
+func TestWriteErrorEnvelope(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist?id=42", nil)
+	req = req.WithContext(contextWithID(req.Context(), 42))
+	w := httptest.NewRecorder()
+	vehicleListHandler(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status Not Found, got %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON error, got Content-Type %q", ct)
+	}
+	var body map[string]map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got := body["error"]; len(got) != 2 || got["code"] != "not_found" || got["message"] != "List not found" {
+		t.Errorf("expected the not_found envelope, got %v", body)
+	}
+}
+
+func TestCounterIDs(t *testing.T) {
+	prev := ids
+	defer func() { ids = prev }()
+	counter := &counterIDs{}
+	ids = counter
+
+	// Concurrent allocations never collide.
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := ids.NextID()
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 8000 {
+		t.Errorf("expected 8000 unique ids, got %d", len(seen))
+	}
+
+	// Loading persisted state moves the counter past its ids.
+	path := filepath.Join(t.TempDir(), "storage.json")
+	data, _ := json.Marshal(persistedState{
+		Lists:   map[int64]VehicleList{5: {ID: 5}},
+		Records: map[int64][]Record{5: {{ID: 1 << 40, Plate: "ABC123"}}},
+	})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write storage: %v", err)
+	}
+	if err := loadStorage(path); err != nil {
+		t.Fatalf("failed to load storage: %v", err)
+	}
+	if id := ids.NextID(); id != 1<<40+1 {
+		t.Errorf("expected the id after the persisted maximum, got %d", id)
+	}
+	counter.Reserve(10)
+	if id := ids.NextID(); id != 1<<40+2 {
+		t.Errorf("expected reserving a lower id to be ignored, got %d", id)
+	}
+}
+
+func TestRecordsHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff"},
+		2: {ID: 2, DisplayName: "Visitors"},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789"}},
+		2: {{ID: 200, Plate: "VIS001"}},
+	}
+	storage.ACL = map[int64]map[int64]bool{7: {1: true}}
+	defer func() { storage.ACL = nil }()
+
+	get := func(query string, session *Session) map[string]recordsResult {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/records"+query, nil)
+		if session != nil {
+			req = req.WithContext(contextWithSession(req.Context(), *session))
+		}
+		w := httptest.NewRecorder()
+		recordsHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status OK, got %v", w.Code)
+		}
+		var result map[string]recordsResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return result
+	}
+
+	result := get("?ids=1,2,3", nil)
+	if len(result["1"].Entries) != 2 || len(result["2"].Entries) != 1 {
+		t.Errorf("expected the records of lists 1 and 2, got %+v", result)
+	}
+	if result["3"].Error == nil || result["3"].Error.Code != "not_found" {
+		t.Errorf("expected a not_found error for list 3, got %+v", result["3"])
+	}
+
+	// Each list is paged on its own.
+	result = get("?ids=1,2&offset=1&limit=1", nil)
+	if len(result["1"].Entries) != 1 || result["1"].Entries[0].ID != 101 || result["1"].Metadata.TotalCount != 2 {
+		t.Errorf("expected the second record of list 1, got %+v", result["1"])
+	}
+	if len(result["2"].Entries) != 0 || result["2"].Metadata.TotalCount != 1 {
+		t.Errorf("expected an empty page of list 2, got %+v", result["2"])
+	}
+
+	result = get("?ids=1,2", &Session{ID: 7, User: "guard", Role: roleViewer})
+	if len(result["1"].Entries) != 2 || result["2"].Error == nil || result["2"].Error.Code != "forbidden" {
+		t.Errorf("expected the access control list to hide list 2, got %+v", result)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/records?ids=1,x", nil)
+	w := httptest.NewRecorder()
+	recordsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for invalid ids, got %v", w.Code)
+	}
+}
+
+func TestMatchRecordHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, DisplayName: "Staff"}}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "AB0123"}, {ID: 101, Plate: "ABO123"}, {ID: 102, Plate: "A80I23"}, {ID: 103, Plate: "XYZ789"}},
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/match?id=1&"+query, nil)
+		req = req.WithContext(contextWithID(req.Context(), 1))
+		w := httptest.NewRecorder()
+		matchRecordHandler(w, req)
+		return w
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"plate=ab-0123", []int64{100, 101}},
+		{"plate=AB0123&maxDistance=0", []int64{100}},
+		{"plate=AB0123&maxDistance=2", []int64{100, 101, 102}},
+		{"plate=QQQ000", nil},
+	}
+	for _, tt := range tests {
+		w := get(tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status OK, got %v", tt.query, w.Code)
+		}
+		var result struct {
+			Entries []plateMatch `json:"entries"`
+		}
+		json.NewDecoder(w.Body).Decode(&result)
+		var got []int64
+		for _, m := range result.Entries {
+			got = append(got, m.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected records %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	if w := get("plate=AB0123&maxDistance=3"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request above max_match_distance, got %v", w.Code)
+	}
+}
+
+func TestFindPlateHandler(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff"},
+		2: {ID: 2, DisplayName: "Visitors"},
+		3: {ID: 3, DisplayName: "Banned"},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}},
+		2: {{ID: 200, Plate: "XYZ789"}},
+		3: {{ID: 300, Plate: "ABC123"}},
+	}
+	storage.ACL = map[int64]map[int64]bool{7: {1: true, 2: true}}
+	defer func() { storage.ACL = nil }()
+	rebuildPlateIndex()
+
+	find := func(plate string, session *Session) []plateLocation {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/records/find?plate="+plate, nil)
+		if session != nil {
+			req = req.WithContext(contextWithSession(req.Context(), *session))
+		}
+		w := httptest.NewRecorder()
+		findPlateHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status OK, got %v", w.Code)
+		}
+		var found []plateLocation
+		if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return found
+	}
+
+	found := find("abc-123", nil)
+	if len(found) != 2 || found[0].ListID != 1 || found[1].ListName != "Banned" || found[1].Record.ID != 300 {
+		t.Errorf("expected the plate in lists 1 and 3, got %+v", found)
+	}
+	if found := find("ABC123", &Session{ID: 7, Role: roleViewer}); len(found) != 1 || found[0].ListID != 1 {
+		t.Errorf("expected the access control list to hide list 3, got %+v", found)
+	}
+	if found := find("NONE1", nil); found == nil || len(found) != 0 {
+		t.Errorf("expected an empty array, got %+v", found)
+	}
+}
+
+func TestPlateIndex(t *testing.T) {
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1}, 2: {ID: 2}}
+	storage.Records = map[int64][]Record{1: {{ID: 100, Plate: "ABC123"}}, 2: {}}
+	rebuildPlateIndex()
+
+	// consistent checks the maintained index against a fresh one.
+	consistent := func(step string) {
+		t.Helper()
+		maintained := storage.plates
+		rebuildPlateIndex()
+		if !reflect.DeepEqual(maintained, storage.plates) {
+			t.Fatalf("%s: index out of date:\n%v\nwant\n%v", step, maintained.plates, storage.plates.plates)
+		}
+	}
+	send := func(handler http.HandlerFunc, method, target string, id int64, body string) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(contextWithID(req.Context(), id))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code >= http.StatusBadRequest {
+			t.Fatalf("%s %s: unexpected status %v: %s", method, target, w.Code, w.Body.String())
+		}
+	}
+
+	rec, err := createRecord(1, Record{Plate: "xyz-789"}, "alice")
+	if err != nil {
+		t.Fatalf("failed to create record: %v", err)
+	}
+	consistent("create")
+	send(handlePutRecord, http.MethodPut, "/api/v1/vehiclelist/record?id=1&recordId=100", 1, `{"plate":"DEF456","version":0}`)
+	consistent("update")
+	if refs := storage.plates.lookup("ABC123"); len(refs) != 0 {
+		t.Errorf("expected the old plate to be dropped, got %v", refs)
+	}
+	send(moveRecordHandler, http.MethodPost, "/api/v1/vehiclelist/record/move?from=1&to=2&recordId=100", 0, "")
+	consistent("move")
+	insertRecords(context.Background(), 2, []Record{{Plate: "GHI111"}, {Plate: "DEF456"}}, "alice", false)
+	consistent("bulk")
+	send(copyListHandler, http.MethodPost, "/api/v1/vehiclelists/copy?id=2", 2, "")
+	consistent("copy")
+	if _, err := deleteRecord(1, rec.ID, "alice"); err != nil {
+		t.Fatalf("failed to delete record: %v", err)
+	}
+	consistent("delete")
+	send(bulkDeleteRecordHandler, http.MethodPost, "/api/v1/vehiclelist/record/delete?id=2", 2, "[100]")
+	consistent("bulk delete")
+
+	if refs := storage.plates.lookup("def-456"); len(refs) != 1 || refs[0].ListID == 2 {
+		t.Errorf("expected DEF456 only in the copy, got %v", refs)
+	}
+	if storage.plates.inList("XYZ789", 1) {
+		t.Error("expected the deleted plate to be gone")
+	}
+}
+
+func TestRecordExpiry(t *testing.T) {
+	now := time.Now()
+	soon, past := now.Add(time.Hour), now.Add(-time.Minute)
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, DisplayName: "Contractors"}}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123", ExpiresAt: &soon}, {ID: 101, Plate: "XYZ789", ExpiresAt: &past}, {ID: 102, Plate: "QWE456"}},
+	}
+	rebuildPlateIndex()
+
+	list := func() []int64 {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record?id=1", nil)
+		req = req.WithContext(contextWithID(req.Context(), 1))
+		w := httptest.NewRecorder()
+		recordHandler(w, req)
+		var result map[string][]Record
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		var got []int64
+		for _, rec := range result["entries"] {
+			got = append(got, rec.ID)
+		}
+		return got
+	}
+
+	if got := list(); !reflect.DeepEqual(got, []int64{100, 102}) {
+		t.Errorf("expected the expired record to be hidden, got %v", got)
+	}
+
+	// Once its expiry passes, the record disappears and the janitor
+	// purges it.
+	soon = now.Add(-time.Second)
+	if got := list(); !reflect.DeepEqual(got, []int64{102}) {
+		t.Errorf("expected only the record without expiry, got %v", got)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/records/find?plate=ABC123", nil)
+	w := httptest.NewRecorder()
+	findPlateHandler(w, req)
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("expected no lookup result for an expired record, got %s", w.Body.String())
+	}
+
+	if event := janitorPass(now); event.PurgedRecords != 2 {
+		t.Errorf("expected 2 purged records, got %+v", event)
+	}
+	if n := len(storage.Records[1]); n != 1 {
+		t.Errorf("expected 1 record after the purge, got %d", n)
+	}
+}
+
+func TestCheckPlateHandler(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{1: {ID: 1, DisplayName: "Contractors"}}
+	storage.Records = map[int64][]Record{
+		1: {
+			{ID: 100, Plate: "ABC123"},
+			{ID: 101, Plate: "DEF456", ValidFrom: &past, ValidUntil: &future},
+			{ID: 102, Plate: "GHI789", ValidFrom: &future},
+			{ID: 103, Plate: "JKL012", ValidUntil: &past},
+			{ID: 104, Plate: "MNO345", ExpiresAt: &past},
+		},
+	}
+	rebuildPlateIndex()
+
+	tests := []struct {
+		plate   string
+		allowed bool
+		reason  string
+	}{
+		{"abc-123", true, reasonListed},
+		{"DEF456", true, reasonListed},
+		{"GHI789", false, reasonNotYetValid},
+		{"JKL012", false, reasonNoLongerValid},
+		{"MNO345", false, reasonExpired},
+		{"ZZZ999", false, reasonNotListed},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/vehiclelist/record/check?id=1&plate="+tt.plate, nil)
+		req = req.WithContext(contextWithID(req.Context(), 1))
+		w := httptest.NewRecorder()
+		checkPlateHandler(w, req)
+		var check plateCheck
+		json.NewDecoder(w.Body).Decode(&check)
+		if w.Code != http.StatusOK || check.Allowed != tt.allowed || check.Reason != tt.reason {
+			t.Errorf("%s: expected allowed=%v (%s), got %v %+v", tt.plate, tt.allowed, tt.reason, w.Code, check)
+		}
+	}
+
+	rec := Record{Plate: "ABC123", ValidFrom: &future, ValidUntil: &past}
+	if errs := validateRecord(&rec); len(errs) != 1 || errs[0].Field != "validUntil" {
+		t.Errorf("expected an empty window to be rejected, got %v", errs)
+	}
+}
+
+func TestAccessHandler(t *testing.T) {
+	mutationLog.events = nil
+	defer func() { mutationLog.events = nil }()
+	past := time.Now().Add(-time.Hour)
+	// Mock storage
+	storage.Lists = map[int64]VehicleList{
+		1: {ID: 1, DisplayName: "Staff"},
+		2: {ID: 2, DisplayName: "Old staff", Archived: true},
+	}
+	storage.Records = map[int64][]Record{
+		1: {{ID: 100, Plate: "ABC123"}, {ID: 101, Plate: "XYZ789", ExpiresAt: &past},
+			{ID: 102, Plate: "DUP1", ExpiresAt: &past}, {ID: 103, Plate: "DUP1"},
+			{ID: 104, Plate: "DUP2"}, {ID: 105, Plate: "DUP2", ExpiresAt: &past}},
+		2: {{ID: 200, Plate: "ABC123"}},
+	}
+	rebuildPlateIndex()
+
+	// An expired duplicate never shadows a valid record, whatever the
+	// iteration order of the index.
+	for i := 0; i < 20; i++ {
+		for _, plate := range []string{"DUP1", "DUP2"} {
+			if check := checkPlate(1, plate, time.Now()); !check.Allowed || check.Record.ExpiresAt != nil {
+				t.Fatalf("%s: expected the valid duplicate to allow it, got %+v", plate, check)
+			}
+		}
+	}
+
+	tests := []struct {
+		query  string
+		allow  bool
+		reason string
+	}{
+		{"listId=1&plate=abc 123", true, reasonListed},
+		{"listId=1&plate=XYZ789", false, reasonExpired},
+		{"listId=1&plate=QWE456", false, reasonNotListed},
+		{"listId=2&plate=ABC123", false, reasonListArchived},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/access?"+strings.ReplaceAll(tt.query, " ", "+"), nil)
+		req = req.WithContext(contextWithSession(req.Context(), Session{ID: 7, User: "gate", Role: roleViewer}))
+		w := httptest.NewRecorder()
+		accessHandler(w, req)
+		var decision accessDecision
+		json.NewDecoder(w.Body).Decode(&decision)
+		if w.Code != http.StatusOK || decision.Allow != tt.allow || decision.Reason != tt.reason {
+			t.Errorf("%s: expected allow=%v (%s), got %v %+v", tt.query, tt.allow, tt.reason, w.Code, decision)
+		}
+	}
+
+	if n := len(mutationLog.events); n != len(tests) {
+		t.Fatalf("expected %d logged decisions, got %d", len(tests), n)
+	}
+	if event := mutationLog.events[0]; event.User != "gate" || event.ListID != 1 || event.Decision == nil || !event.Decision.Allow {
+		t.Errorf("expected the decision to be logged, got %+v", event)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/access?listId=3&plate=ABC123", nil)
+	w := httptest.NewRecorder()
+	accessHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown list, got %v", w.Code)
 	}
 }
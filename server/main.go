@@ -1,33 +1,84 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
+	"html/template"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
-	"gopkg.in/yaml.v3"
+	"unicode"
+	"unicode/utf8"
 )
 
-// Config represents the configuration structure.
-type Config struct {
-	BaseURL        string        `yaml:"base_url"`
-	TokenExpiry    time.Duration `yaml:"token_expiry"`
-}
-
 // MemoryStorage is an in-memory store for lists and records.
 type MemoryStorage struct {
 	sync.Mutex
 	Lists   map[int64]VehicleList
 	Records map[int64][]Record
-	Tokens  map[string]struct {
-		Expiry time.Time
-		ID     int64
+	Tokens  map[string]Session
+	Shares  map[string]Share
+	Revoked map[string]time.Time     // Revoked token ids until their expiry
+	ACL     map[int64]map[int64]bool // List ids each restricted user id may use
+	Users   map[string]User          // Accounts by username
+
+	LoginFailures map[string]loginFailures // Failed logins by username
+
+	Idempotency map[string]idempotentResponse // By user id and Idempotency-Key
+
+	plates *plateIndex // Index of Records by plate
+}
+
+// Session is the state kept for an issued token.
+type Session struct {
+	Expiry      time.Time
+	ID          int64
+	User        string // Username given at login
+	CreatedAt   time.Time
+	UserAgent   string
+	Fingerprint string // Client fingerprint recorded at login
+	CSRF        string // Token expected in X-CSRF-Token for cookie requests
+	Role        string // roleViewer or roleAdmin
+	LastSeq     int64  // Highest X-Client-Seq seen for a mutation
+}
+
+// newMemoryStorage returns an empty, ready to use storage.
+func newMemoryStorage() MemoryStorage {
+	return MemoryStorage{
+		Lists:   make(map[int64]VehicleList),
+		Records: make(map[int64][]Record),
+		Tokens:  make(map[string]Session),
+		Shares:  make(map[string]Share),
+		Revoked: make(map[string]time.Time),
+		ACL:     make(map[int64]map[int64]bool),
+		Users:   make(map[string]User),
+
+		LoginFailures: make(map[string]loginFailures),
+
+		Idempotency: make(map[string]idempotentResponse),
+
+		plates: newPlateIndex(),
 	}
 }
 
@@ -36,273 +87,2816 @@ type VehicleList struct {
 	ID          int64  `json:"id"`
 	DisplayName string `json:"displayName"`
 	Name        string `json:"name"`
-	Color       string `json:"color"`
+	Color       string `json:"color" validate:"pattern=^#[0-9a-fA-F]{6}$"`
 	Order       int    `json:"order"`
 	Status      int    `json:"status"`
+	Owner       int64  `json:"owner"`
+	// Archived lists keep their records but are hidden from the lists
+	// response unless asked for.
+	Archived  bool      `json:"archived"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 // Record represents a record in a vehicle list.
 type Record struct {
-	ID          int64  `json:"id"`
-	Plate       string `json:"plate"`
-	VehicleType string `json:"vehicleType"`
+	ID          int64    `json:"id"`
+	Plate       string   `json:"plate" validate:"required,pattern=^[\\p{L}\\p{Nd}]*$"`
+	VehicleType string   `json:"vehicleType"`
+	Tags        []string `json:"tags,omitempty"`
+	// Version is incremented on every update. Updates must carry the
+	// version they were based on.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// ExpiresAt ends a temporary access grant. Expired records are hidden
+	// from responses and purged by the janitor; nil never expires.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// ValidFrom and ValidUntil bound when the plate is allowed through,
+	// ValidUntil excluded. Either may be nil for an open end.
+	ValidFrom  *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
 }
 
-var (
-	storage MemoryStorage
-	baseURL  string
-	tokenExpiry time.Duration
-)
+// expired reports whether the record has expired at now.
+func (rec Record) expired(now time.Time) bool {
+	return rec.ExpiresAt != nil && !now.Before(*rec.ExpiresAt)
+}
+
+// activeRecords returns the records not expired at now. The result never
+// shares its backing array with records.
+func activeRecords(records []Record, now time.Time) []Record {
+	active := make([]Record, 0, len(records))
+	for _, rec := range records {
+		if !rec.expired(now) {
+			active = append(active, rec)
+		}
+	}
+	return active
+}
+
+// activeCount returns the number of records not expired at now.
+func activeCount(records []Record, now time.Time) int {
+	count := 0
+	for _, rec := range records {
+		if !rec.expired(now) {
+			count++
+		}
+	}
+	return count
+}
+
+var storage = newMemoryStorage()
+
+// basePath is the base_path all routes are registered under, used to
+// generate links to them.
+var basePath string
 
 func main() {
 	// Parse flags and environment variables.
-	defaultURL := "http://localhost:1608"
-	defaultExpiry := 5 * time.Minute
 	configFile := flag.String("config", "kpam.yaml", "Path to configuration file")
+	checkOnly := flag.Bool("check-config", false, "Validate the configuration file and exit")
 	flag.Parse()
 
-	if envURL := os.Getenv("KPAM_URL"); envURL != "" {
-		baseURL = envURL
-	} else if config, err := readConfig(*configFile); err == nil {
-		baseURL = config.BaseURL
-		tokenExpiry = config.TokenExpiry
+	if *checkOnly {
+		os.Exit(checkConfig(*configFile, os.Stderr))
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Printf("Invalid config in %s:\n%v", *configFile, err)
+		os.Exit(1)
+	}
+	s, err := newSettings(config)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	setSettings(s)
+	watchConfig(*configFile)
+
+	if config.MetricsFlushInterval > 0 {
+		batcher = newMetricsBatcher(metrics, config.MetricsFlushInterval)
+	}
+	if config.JWTSecret != "" {
+		jwtSecret = []byte(config.JWTSecret)
+	}
+	seedACL(config.ListACL)
+	if err := seedUsers(config.Users); err != nil {
+		log.Fatalf("Failed to create users: %v", err)
+	}
+	if config.AuditPath != "" {
+		file, err := openMutationLog(config.AuditPath)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer file.Close()
+	}
+	if config.WebhookURL != "" {
+		recordWebhook = newWebhook(config.WebhookURL)
+		go recordWebhook.run()
+	}
+	if config.CleanupWebhook != "" {
+		onCleanup = cleanupWebhook(config.CleanupWebhook)
+	}
+	startJanitor(config.JanitorInterval)
+	if config.PersistPath != "" {
+		if err := loadStorage(config.PersistPath); err != nil {
+			log.Fatalf("Failed to load %s: %v", config.PersistPath, err)
+		}
+		persist = newPersister(fileWriter(config.PersistPath), config.PersistRetries, config.PersistRetryBackoff)
+		go persist.run()
+	}
+	if config.SeedFile != "" {
+		seeded, err := seedStorage(config.SeedFile)
+		if err != nil {
+			log.Fatalf("Failed to seed from %s: %v", config.SeedFile, err)
+		}
+		if seeded {
+			log.Printf("Seeded storage from %s", config.SeedFile)
+			if persist != nil {
+				persist.MarkDirty()
+			}
+		}
+	}
+
+	basePath = config.BasePath
+	registerRoutes(http.DefaultServeMux, config)
+
+	handler := gzipMiddleware(http.DefaultServeMux)
+	if persist != nil {
+		handler = persistMiddleware(persist, handler)
+	}
+	handler = metricsMiddleware(handler)
+	if config.AccessLog != "" {
+		file, err := os.OpenFile(config.AccessLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		defer file.Close()
+		handler = accessLogMiddleware(newAccessLogger(file), handler)
+	}
+	handler = requestIDMiddleware(handler)
+
+	addr, err := listenAddress(config.ListenAddr, config.BaseURL)
+	if err != nil {
+		log.Fatalf("Invalid listen address: %v", err)
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+	}
+
+	if err := validateTLSFiles(config.TLSCert, config.TLSKey); err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	if config.TLSCert == "" {
+		log.Printf("Starting server at %s (listening on %s)\n", config.BaseURL, addr)
+		log.Fatal(server.ListenAndServe())
+	}
+
+	if config.TLSRedirect {
+		redirect := &http.Server{
+			Addr:              ":80",
+			Handler:           httpsRedirectHandler(config.BaseURL),
+			ReadHeaderTimeout: server.ReadHeaderTimeout,
+		}
+		go func() {
+			log.Fatal(redirect.ListenAndServe())
+		}()
+	}
+	log.Printf("Starting TLS server at %s (listening on %s)\n", config.BaseURL, addr)
+	log.Fatal(server.ListenAndServeTLS(config.TLSCert, config.TLSKey))
+}
+
+// registerRoutes registers the handlers on mux, under the base_path of
+// config. With ops_outside_base_path the metrics stay at the root, where
+// monitoring usually scrapes them.
+func registerRoutes(mux *http.ServeMux, config *Config) {
+	route := func(pattern string) string {
+		return prefixPattern(pattern, config.BasePath)
+	}
+	opsRoute := route
+	if config.OpsOutsideBasePath {
+		opsRoute = func(pattern string) string { return pattern }
+	}
+	// Streaming endpoints are left out: a TimeoutHandler buffers the whole
+	// response and can't be flushed or hijacked.
+	timeout := func(h http.Handler) http.Handler {
+		if config.HandlerTimeout <= 0 {
+			return h
+		}
+		return timeoutHandler(h, config.HandlerTimeout)
+	}
+
+	mux.Handle(route("/login"), timeout(http.HandlerFunc(loginHandler)))
+	mux.Handle(route("/refresh"), timeout(http.HandlerFunc(refreshHandler)))
+	mux.Handle(route("/logout"), timeout(http.HandlerFunc(logoutHandler)))
+	mux.Handle(opsRoute("/metrics"), timeout(metrics))
+	mux.Handle(route("GET /openapi.json"), timeout(http.HandlerFunc(openAPIHandler)))
+	if config.SchemaRequiresAuth {
+		mux.Handle(route("GET /api/v1/meta/schema"), timeout(tokenMiddleware(http.HandlerFunc(schemaHandler))))
 	} else {
-		baseURL = defaultURL
-		tokenExpiry = defaultExpiry
+		mux.Handle(route("GET /api/v1/meta/schema"), timeout(http.HandlerFunc(schemaHandler)))
 	}
+	mux.Handle(route("/api/v1/vehiclelists"), timeout(tokenMiddleware(adminWrites(http.HandlerFunc(vehicleListsHandler)))))
+	mux.Handle(route("GET /api/v2/vehiclelists"), timeout(tokenMiddleware(http.HandlerFunc(vehicleListsV2Handler))))
+	mux.Handle(route("GET /api/v1/vehiclelist"), timeout(tokenMiddleware(recordMiddleware(http.HandlerFunc(vehicleListHandler)))))
+	mux.Handle(route("GET /api/v1/vehiclelist/by-name"), timeout(tokenMiddleware(http.HandlerFunc(listByNameHandler))))
+	mux.Handle(route("POST /api/v1/vehiclelists/copy"), timeout(tokenMiddleware(adminWrites(recordMiddleware(http.HandlerFunc(copyListHandler))))))
+	mux.Handle(route("POST /api/v1/vehiclelists/archive"), timeout(tokenMiddleware(adminWrites(recordMiddleware(listArchiveHandler(true))))))
+	mux.Handle(route("POST /api/v1/vehiclelists/unarchive"), timeout(tokenMiddleware(adminWrites(recordMiddleware(listArchiveHandler(false))))))
+	mux.Handle(route("/api/v1/vehiclelists/order"), timeout(tokenMiddleware(adminWrites(http.HandlerFunc(vehicleListsOrderHandler)))))
+	mux.Handle(route("POST /api/v1/vehiclelists/{id}/reconcile"), timeout(tokenMiddleware(http.HandlerFunc(reconcileHandler))))
+	mux.Handle(route("POST /api/v1/vehiclelists/{id}/share"), timeout(tokenMiddleware(http.HandlerFunc(shareHandler))))
+	mux.Handle(route("GET /shared/{token}"), timeout(http.HandlerFunc(sharedHandler)))
+	mux.Handle(route("/api/v1/vehiclelist/record"), timeout(tokenMiddleware(adminWrites(recordMiddleware(http.HandlerFunc(recordHandler))))))
+	mux.Handle(route("/api/v1/vehiclelist/record/bulk"), timeout(tokenMiddleware(adminWrites(recordMiddleware(http.HandlerFunc(bulkRecordHandler))))))
+	mux.Handle(route("/api/v1/vehiclelist/record/import"), timeout(tokenMiddleware(adminWrites(recordMiddleware(http.HandlerFunc(importRecordHandler))))))
+	mux.Handle(route("/api/v1/vehiclelist/record/export"), tokenMiddleware(recordMiddleware(http.HandlerFunc(exportRecordHandler))))
+	mux.Handle(route("POST /api/v1/vehiclelist/record/delete"), timeout(tokenMiddleware(adminWrites(recordMiddleware(http.HandlerFunc(bulkDeleteRecordHandler))))))
+	mux.Handle(route("DELETE /api/v1/vehiclelist/record/all"), timeout(tokenMiddleware(requireRole(roleAdmin, recordMiddleware(http.HandlerFunc(clearRecordsHandler))))))
+	mux.Handle(route("POST /api/v1/vehiclelist/record/move"), timeout(tokenMiddleware(adminWrites(http.HandlerFunc(moveRecordHandler)))))
+	mux.Handle(route("GET /api/v1/vehiclelist/record/audit"), timeout(tokenMiddleware(recordMiddleware(http.HandlerFunc(recordAuditHandler)))))
+	mux.Handle(route("GET /api/v1/vehiclelist/record/stream"), tokenMiddleware(recordMiddleware(http.HandlerFunc(recordStreamHandler))))
+	mux.Handle(route("GET /api/v1/vehiclelist/record/check"), timeout(tokenMiddleware(recordMiddleware(http.HandlerFunc(checkPlateHandler)))))
+	mux.Handle(route("GET /api/v1/vehiclelist/record/match"), timeout(tokenMiddleware(recordMiddleware(http.HandlerFunc(matchRecordHandler)))))
+	mux.Handle(route("/api/v1/vehiclelist/record/query"), timeout(tokenMiddleware(recordMiddleware(http.HandlerFunc(queryRecordHandler)))))
+	mux.Handle(route("GET /api/v1/records"), timeout(tokenMiddleware(http.HandlerFunc(recordsHandler))))
+	mux.Handle(route("GET /api/v1/records/find"), timeout(tokenMiddleware(http.HandlerFunc(findPlateHandler))))
+	mux.Handle(route("GET /api/v1/access"), timeout(tokenMiddleware(http.HandlerFunc(accessHandler))))
+	mux.Handle(route("GET /ws"), tokenMiddleware(http.HandlerFunc(wsHandler)))
+	mux.Handle(route("/api/v1/sessions"), timeout(tokenMiddleware(http.HandlerFunc(sessionsHandler))))
+	mux.Handle(route("GET /api/v1/whoami"), timeout(tokenMiddleware(http.HandlerFunc(whoamiHandler))))
+	mux.Handle(route("POST /api/v1/password"), timeout(tokenMiddleware(http.HandlerFunc(passwordHandler))))
+	mux.Handle(route("GET /api/v1/export/records"), tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(exportAllHandler))))
+	mux.Handle(route("POST /api/v1/admin/backup"), tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(backupHandler))))
+	mux.Handle(route("GET /api/v1/admin/stats"), timeout(tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(statsHandler)))))
+	mux.Handle(route("POST /api/v1/admin/restore"), timeout(tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(restoreHandler)))))
+	mux.Handle(route("POST /api/v1/snapshots"), timeout(tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(snapshotsHandler)))))
+	mux.Handle(route("GET /api/v1/users"), timeout(tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(usersHandler)))))
+	mux.Handle(route("GET /api/v1/audit"), timeout(tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(auditHandler)))))
+	mux.Handle(route("GET /api/v1/snapshots/diff"), timeout(tokenMiddleware(requireRole(roleAdmin, http.HandlerFunc(snapshotDiffHandler)))))
+}
 
-	// Initialize storage.
-	storage = MemoryStorage{
-		Lists:   make(map[int64]VehicleList),
-		Records: make(map[int64][]Record),
-		Tokens:  make(map[string]struct {
-			Expiry time.Time
-			ID     int64
-		}),
+// timeoutHandler answers 503 with an apiError when h takes longer than
+// timeout. The context of the request ends then, which handlers check
+// before committing changes, since h keeps running.
+func timeoutHandler(h http.Handler, timeout time.Duration) http.Handler {
+	body, _ := json.Marshal(apiError{Error: errorDetail{Code: "timeout", Message: "Request timed out"}})
+	timed := http.TimeoutHandler(h, timeout, string(body))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// For the 503 body; responses of h set their own Content-Type.
+		w.Header().Set("Content-Type", "application/json")
+		timed.ServeHTTP(w, r)
+	})
+}
+
+// prefixPattern inserts base before the path of a mux pattern such as
+// "GET /api/v1/audit".
+func prefixPattern(pattern, base string) string {
+	if method, path, ok := strings.Cut(pattern, " "); ok {
+		return method + " " + base + path
 	}
+	return base + pattern
+}
 
-	http.HandleFunc("/login", loginHandler)
-	http.Handle("/api/v1/vehiclelists", tokenMiddleware(http.HandlerFunc(vehicleListsHandler)))
-	http.Handle("/api/v1/vehiclelist/record", tokenMiddleware(recordMiddleware(http.HandlerFunc(recordHandler))))
+// validateTLSFiles checks that the certificate and key are either both
+// unset or both point to readable files.
+func validateTLSFiles(cert, key string) error {
+	if cert == "" && key == "" {
+		return nil
+	}
+	if cert == "" || key == "" {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	for _, file := range []string{cert, key} {
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	log.Printf("Starting server at %s\n", baseURL)
-	log.Fatal(http.ListenAndServe(baseURL[len("http://"):], nil))
+// httpsRedirectHandler permanently redirects requests to the https version
+// of the requested URL. The host of base is used when it is an https URL,
+// otherwise the request's own host.
+func httpsRedirectHandler(base string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if u, err := url.Parse(base); err == nil && u.Scheme == "https" {
+			host = u.Host
+		} else if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
 }
 
-func readConfig(path string) (*Config, error) {
-	file, err := ioutil.ReadFile(path)
+// listenAddress returns addr if set, otherwise the host and port of base. A
+// base URL without a port listens on the default port of its scheme.
+func listenAddress(addr, base string) (string, error) {
+	if addr != "" {
+		return addr, nil
+	}
+	u, err := url.Parse(base)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	var config Config
-	if err := yaml.Unmarshal(file, &config); err != nil {
-		return nil, err
+	if u.Host == "" {
+		return "", fmt.Errorf("base URL %q has no host", base)
 	}
-	if config.TokenExpiry == 0 {
-		config.TokenExpiry = 5 * time.Minute
+	if u.Port() != "" {
+		return u.Host, nil
 	}
-	return &config, nil
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
 
 	var creds struct {
-		Username      string `json:"username"`
-		Password      string `json:"password"`
-		IsRememberMe  bool   `json:"isRememberMe"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		IsRememberMe bool   `json:"isRememberMe"`
+	}
+	if err := decodeJSON(r, &creds); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	// Blank credentials would mint a token for an anonymous user.
+	if strings.TrimSpace(creds.Username) == "" {
+		writeFieldError(w, &fieldError{Message: "username required", Field: "username"})
+		return
+	}
+	if creds.Password == "" {
+		writeFieldError(w, &fieldError{Message: "password required", Field: "password"})
+		return
+	}
+
+	// A locked account is refused even the right password, so that
+	// guessing doesn't go on during the cooldown.
+	if until, locked := accountLocked(creds.Username, time.Now()); locked {
+		writeAccountLocked(w, until)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	role, ok := authenticateUser(creds.Username, creds.Password)
+	if !ok {
+		recordLoginFailure(creds.Username, time.Now())
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid username or password")
 		return
 	}
+	resetLoginFailures(creds.Username)
 
-	id := time.Now().UnixNano() // Example ID generation for user session
-	token := generateToken(id)
-	expiry := time.Now().Add(tokenExpiry)
+	session := Session{
+		Expiry:      time.Now().Add(currentSettings().TokenExpiry),
+		ID:          userID(creds.Username),
+		User:        creds.Username,
+		Role:        role,
+		CreatedAt:   time.Now(),
+		UserAgent:   r.UserAgent(),
+		Fingerprint: fingerprint(r),
+		CSRF:        hex.EncodeToString(randomBytes(16)),
+	}
+	token := generateToken(session)
 	storage.Lock()
-	storage.Tokens[token] = struct {
-		Expiry time.Time
-		ID     int64
-	}{
-		Expiry: expiry,
-		ID:     id,
+	storage.Tokens[token] = session
+	compactTokens(time.Now())
+	storage.Unlock()
+
+	setSessionCookies(w, token, session.CSRF, session.Expiry)
+
+	response := map[string]interface{}{
+		"redirectUrl":  "/",
+		"isAuthorized": true,
+		"csrfToken":    session.CSRF,
+		"role":         session.Role,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// refreshHandler exchanges a still valid token for a new one with a fresh
+// expiry, so that long-lived clients stay logged in without credentials.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	old, _ := requestToken(r)
+	session, err := authenticate(old)
+	if err != nil || (currentSettings().BindSessions && session.Fingerprint != fingerprint(r)) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	storage.Lock()
+	if stored, exists := storage.Tokens[old]; exists {
+		session = stored
 	}
+	session.Expiry = time.Now().Add(currentSettings().TokenExpiry)
+	token := generateToken(session)
+	storage.Tokens[token] = session
+	revokeToken(old)
 	storage.Unlock()
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    "s",
-		Value:   token,
-		Expires: expiry,
-	})
+	setSessionCookies(w, token, session.CSRF, session.Expiry)
 
 	response := map[string]interface{}{
-		"redirectUrl": "/",
 		"isAuthorized": true,
+		"csrfToken":    session.CSRF,
+		"expiresAt":    session.Expiry,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func vehicleListsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		// Handle GET method for vehicle lists.
-		offset, count := 0, 20 // Default values
+// logoutHandler revokes the caller's token and clears the cookies.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
 
-		lists := []VehicleList{}
+	if token, _ := requestToken(r); token != "" {
 		storage.Lock()
-		for _, list := range storage.Lists {
-			lists = append(lists, list)
-		}
+		revokeToken(token)
 		storage.Unlock()
-
-		response := map[string]interface{}{
-			"entries":   lists,
-			"_metadata": map[string]int{"offset": offset, "limit": count, "totalCount": len(lists)},
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	setSessionCookies(w, "", "", time.Unix(0, 0))
+	w.WriteHeader(http.StatusOK)
 }
 
-func recordHandler(w http.ResponseWriter, r *http.Request) {
+// setSessionCookies sets the session cookie and the CSRF cookie. The latter
+// is readable by scripts so that the frontend can echo it in X-CSRF-Token.
+func setSessionCookies(w http.ResponseWriter, token, csrf string, expiry time.Time) {
+	cfg := currentSettings()
+	http.SetCookie(w, &http.Cookie{
+		Name:    cfg.CookieName,
+		Value:   token,
+		Domain:  cfg.CookieDomain,
+		Path:    cfg.CookiePath,
+		Expires: expiry,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:    csrfCookie,
+		Value:   csrf,
+		Domain:  cfg.CookieDomain,
+		Path:    cfg.CookiePath,
+		Expires: expiry,
+	})
+}
+
+func vehicleListsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetRecord(w, r)
+		handleGetLists(w, r)
+	case http.MethodHead:
+		handleHeadLists(w, r)
 	case http.MethodPost:
-		handlePostRecord(w, r)
-	case http.MethodDelete:
-		handleDeleteRecord(w, r)
+		handlePostList(w, r)
+	case http.MethodPut:
+		handlePutList(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 	}
 }
 
-func recordMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idStr := r.URL.Query().Get("id")
-		if idStr == "" {
-			http.Error(w, "Missing id parameter", http.StatusBadRequest)
-			return
-		}
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid id parameter", http.StatusBadRequest)
-			return
-		}
+// listEntry is a list as returned by the lists endpoint.
+type listEntry struct {
+	VehicleList
+	RecordCount int `json:"recordCount"`
+}
 
-		// Pass ID as context value
-		r = r.WithContext(contextWithID(r.Context(), id))
-		next.ServeHTTP(w, r)
-	})
+// expandedListEntry is a list as returned by the v2 lists endpoint with
+// expand=records.
+type expandedListEntry struct {
+	listEntry
+	Records []Record `json:"records"`
 }
 
-func handleGetRecord(w http.ResponseWriter, r *http.Request) {
-	id := contextID(r.Context())
+// vehicleListsV2Handler serves the v2 lists. They page like the v1 lists
+// but embed the records of each list with expand=records, saving clients
+// a request per list.
+func vehicleListsV2Handler(w http.ResponseWriter, r *http.Request) {
+	switch expand := r.URL.Query().Get("expand"); expand {
+	case "":
+		getLists(w, r, false)
+	case "records":
+		getLists(w, r, true)
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("Unsupported expand parameter %q", expand))
+	}
+}
+
+// handleHeadLists reports the number of lists in X-Total-Count, without a
+// body. Sessions restricted by an access control list only count theirs.
+func handleHeadLists(w http.ResponseWriter, r *http.Request) {
+	session, restricted := contextSession(r.Context())
 	storage.Lock()
-	records, exists := storage.Records[id]
+	total := len(storage.Lists)
+	if restricted {
+		total = 0
+		for id := range storage.Lists {
+			if listAllowedLocked(session, id) {
+				total++
+			}
+		}
+	}
 	storage.Unlock()
 
-	if !exists {
-		http.Error(w, "List not found", http.StatusNotFound)
-		return
-	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.WriteHeader(http.StatusOK)
+}
 
-	response := map[string]interface{}{
-		"entries": records,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+func handleGetLists(w http.ResponseWriter, r *http.Request) {
+	getLists(w, r, false)
 }
 
-func handlePostRecord(w http.ResponseWriter, r *http.Request) {
-	id := contextID(r.Context())
-	var record Record
-	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+// getLists writes a page of the lists, with their records if expand is
+// set.
+func getLists(w http.ResponseWriter, r *http.Request, expand bool) {
+	offset, count, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	less, err := listSorter(r.URL.Query().Get("sort"), r.URL.Query().Get("dir"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	statuses, err := parseStatusFilter(r.URL.Query().Get("status"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	var modifiedSince time.Time
+	if value := r.URL.Query().Get("modifiedSince"); value != "" {
+		if modifiedSince, err = time.Parse(time.RFC3339, value); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid modifiedSince parameter")
+			return
+		}
+	}
+	version, err := requestSchemaVersion(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
 		return
 	}
 
+	includeArchived := r.URL.Query().Get("includeArchived") == "true"
+	session, restricted := contextSession(r.Context())
+
+	lists := []listEntry{}
+	now := time.Now()
 	storage.Lock()
-	storage.Records[id] = append(storage.Records[id], record)
+	for id, list := range storage.Lists {
+		if restricted && !listAllowedLocked(session, id) {
+			continue
+		}
+		if statuses != nil && !statuses[list.Status] {
+			continue
+		}
+		if list.Archived && !includeArchived {
+			continue
+		}
+		if !modifiedSince.IsZero() && !list.UpdatedAt.After(modifiedSince) {
+			continue
+		}
+		lists = append(lists, listEntry{VehicleList: list, RecordCount: activeCount(storage.Records[id], now)})
+	}
 	storage.Unlock()
 
-	w.WriteHeader(http.StatusCreated)
+	// Map iteration order is random, so always sort before paging.
+	sort.Slice(lists, func(i, j int) bool { return less(lists[i].VehicleList, lists[j].VehicleList) })
+	total := len(lists)
+	start, end := pageBounds(total, offset, count)
+
+	var entries interface{} = lists[start:end]
+	if expand {
+		// Only the records of the page are copied.
+		expanded := make([]expandedListEntry, 0, end-start)
+		storage.Lock()
+		for _, entry := range lists[start:end] {
+			records := activeRecords(storage.Records[entry.ID], now)
+			expanded = append(expanded, expandedListEntry{listEntry: entry, Records: records})
+		}
+		storage.Unlock()
+		entries = expanded
+	}
+	response := map[string]interface{}{
+		"entries":   schemaEntries(version, "list", entries),
+		"_metadata": newPageMetadata(r, offset, count, total),
+	}
+	writeWithETag(w, r, response)
 }
 
-func handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
-	id := contextID(r.Context())
-	recordIDStr := r.URL.Query().Get("recordId")
-	if recordIDStr == "" {
-		http.Error(w, "Missing recordId parameter", http.StatusBadRequest)
+// vehicleListHandler returns the single list named by the id parameter.
+func vehicleListHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := requestSchemaVersion(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
 		return
 	}
-	recordID, err := strconv.ParseInt(recordIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid recordId parameter", http.StatusBadRequest)
+
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
 		return
 	}
 
 	storage.Lock()
-	records, exists := storage.Records[id]
+	list, exists := storage.Lists[id]
+	storage.Unlock()
+
 	if !exists {
-		storage.Unlock()
-		http.Error(w, "List not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
 		return
 	}
-
-	for i, rec := range records {
-		if rec.ID == recordID {
-			storage.Records[id] = append(records[:i], records[i+1:]...)
-			storage.Unlock()
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-	}
-	storage.Unlock()
-	http.Error(w, "Record not found", http.StatusNotFound)
+	writeWithETag(w, r, schemaEntries(version, "list", list))
 }
 
-// Context helpers for passing ID
+// writeWithETag encodes v with encodeBody and tags it with a hash of the
+// body. When the request's If-None-Match already carries that tag, only 304
+// Not Modified is sent.
+func writeWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, contentType, err := encodeBody(r, v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
 
-func contextWithID(ctx context.Context, id int64) context.Context {
-	return context.WithValue(ctx, "id", id)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
 }
 
-func contextID(ctx context.Context) int64 {
-	if id, ok := ctx.Value("id").(int64); ok {
-		return id
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
 	}
-	return 0
+	return false
 }
 
-func tokenMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("s")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+func handlePostList(w http.ResponseWriter, r *http.Request) {
+	var list VehicleList
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+	if errs := validateList(&list); errs != nil {
+		writeFieldErrors(w, errs)
+		return
+	}
+	list.ID = ids.NextID()
+	list.Owner = requestUserID(r)
+	list.UpdatedAt = time.Now()
 
-		storage.Lock()
-		data, exists := storage.Tokens[cookie.Value]
+	storage.Lock()
+	if displayNameTaken(list) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", "Display name already in use")
+		return
+	}
+	if listNameTaken(list) {
 		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", "Name already in use")
+		return
+	}
+	storage.Lists[list.ID] = list
+	storage.Records[list.ID] = []Record{}
+	storage.Unlock()
 
-		if !exists || time.Now().After(data.Expiry) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+func handlePutList(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid id parameter")
+		return
+	}
+	if !requestListAllowed(r, id) {
+		writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+		return
+	}
+	var update VehicleList
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+	if errs := validateList(&update); errs != nil {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	storage.Lock()
+	list, exists := storage.Lists[id]
+	if !exists {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	update.ID, update.Owner, update.Archived = list.ID, list.Owner, list.Archived
+	update.UpdatedAt = time.Now()
+	if displayNameTaken(update) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", "Display name already in use")
+		return
+	}
+	if listNameTaken(update) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", "Name already in use")
+		return
+	}
+	storage.Lists[id] = update
+	storage.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// displayNameTaken reports whether uniqueDisplayName is enabled and another
+// list of the same owner already uses the list's display name. The caller
+// must hold the storage lock.
+func displayNameTaken(list VehicleList) bool {
+	if !currentSettings().UniqueDisplayName {
+		return false
+	}
+	name := normalizeName(list.DisplayName)
+	for _, other := range storage.Lists {
+		if other.ID != list.ID && other.Owner == list.Owner && normalizeName(other.DisplayName) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listNameTaken reports whether another list already uses the list's name,
+// ignoring case. Lists without a name never conflict. The caller must hold
+// the storage lock.
+func listNameTaken(list VehicleList) bool {
+	_, taken := listByName(list.Name, list.ID)
+	return taken
+}
+
+// listByName returns the list named name, ignoring case, other than the
+// list with id skip. The caller must hold the storage lock.
+func listByName(name string, skip int64) (VehicleList, bool) {
+	name = normalizeName(name)
+	if name == "" {
+		return VehicleList{}, false
+	}
+	var found VehicleList
+	var ok bool
+	for _, other := range storage.Lists {
+		// Names stored before they had to be unique may repeat, the oldest
+		// list wins.
+		if other.ID != skip && normalizeName(other.Name) == name && (!ok || other.ID < found.ID) {
+			found, ok = other, true
+		}
+	}
+	return found, ok
+}
+
+// copyListName returns a free name for a copy of the list named name:
+// name-copy, name-copy-2 and so on. The caller must hold the storage lock.
+func copyListName(name string) string {
+	if name == "" {
+		return ""
+	}
+	candidate := name + "-copy"
+	for i := 2; ; i++ {
+		if _, taken := listByName(candidate, 0); !taken {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-copy-%d", name, i)
+	}
+}
+
+// listByNameHandler returns the list with the name parameter, which is
+// unique ignoring case.
+func listByNameHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := requestSchemaVersion(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if strings.TrimSpace(name) == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing name parameter")
+		return
+	}
+
+	storage.Lock()
+	list, exists := listByName(name, 0)
+	storage.Unlock()
+
+	// Lists outside the caller's access control list don't exist for them.
+	if !exists || !requestListAllowed(r, list.ID) {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	writeWithETag(w, r, schemaEntries(version, "list", list))
+}
+
+// normalizeName folds case and collapses whitespace for name comparisons.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// copyListHandler duplicates the list named by the id parameter along with
+// its records, which get new ids. The copy belongs to the caller and is
+// validated like a created list: the "Copy of" prefix may take its display
+// name past max_display_name_length, and its records past
+// max_records_per_list if the limit was lowered since.
+func copyListHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	now := time.Now()
+
+	storage.Lock()
+	list, exists := storage.Lists[id]
+	if !exists {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	list.ID = ids.NextID()
+	list.DisplayName = "Copy of " + list.DisplayName
+	list.Name = copyListName(list.Name)
+	list.Owner = requestUserID(r)
+	list.Archived = false
+	list.UpdatedAt = now
+	if errs := validateList(&list); errs != nil {
+		storage.Unlock()
+		writeFieldErrors(w, errs)
+		return
+	}
+	if displayNameTaken(list) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", "Display name already in use")
+		return
+	}
+	if err := checkListCapacity(list.ID, len(storage.Records[id])); err != nil {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+		return
+	}
+	records := make([]Record, len(storage.Records[id]))
+	for i, rec := range storage.Records[id] {
+		rec.ID = ids.NextID()
+		rec.Tags = append([]string(nil), rec.Tags...)
+		rec.Version = 1
+		rec.UpdatedAt = now
+		records[i] = rec
+		storage.plates.add(list.ID, rec)
+	}
+	storage.Lists[list.ID] = list
+	storage.Records[list.ID] = records
+	storage.Unlock()
+
+	user := requestUser(r)
+	for _, rec := range records {
+		recordChanged(user, auditCreate, list.ID, rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+// listArchiveHandler archives or unarchives the list named by the id
+// parameter. Its records are kept either way.
+func listArchiveHandler(archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := contextID(r.Context())
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+			return
+		}
+		storage.Lock()
+		list, exists := storage.Lists[id]
+		if exists {
+			list.Archived = archived
+			list.UpdatedAt = time.Now()
+			storage.Lists[id] = list
+		}
+		storage.Unlock()
+
+		if !exists {
+			writeError(w, http.StatusNotFound, "not_found", "List not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// vehicleListsOrderHandler bulk-updates the Order of vehicle lists. Either
+// every list is reordered or, if any id is unknown, none of them are.
+func vehicleListsOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	var entries []struct {
+		ID    int64 `json:"id"`
+		Order int   `json:"order"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+	for _, e := range entries {
+		if !requestListAllowed(r, e.ID) {
+			writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+			return
+		}
+	}
+
+	storage.Lock()
+	defer storage.Unlock()
+
+	var unknown []string
+	for _, e := range entries {
+		if _, exists := storage.Lists[e.ID]; !exists {
+			unknown = append(unknown, strconv.FormatInt(e.ID, 10))
+		}
+	}
+	if len(unknown) > 0 {
+		writeError(w, http.StatusNotFound, "not_found", "Unknown list ids: "+strings.Join(unknown, ", "))
+		return
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		list := storage.Lists[e.ID]
+		list.Order = e.Order
+		list.UpdatedAt = now
+		storage.Lists[e.ID] = list
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// reconcileHandler compares a list against an upstream plate list and reports
+// plates missing locally and extra plates present only locally.
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid id parameter")
+		return
+	}
+	if !requestListAllowed(r, id) {
+		writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+		return
+	}
+
+	var upstream struct {
+		Plates []string `json:"plates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&upstream); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	storage.Lock()
+	_, exists := storage.Lists[id]
+	records := append([]Record(nil), storage.Records[id]...)
+	storage.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+
+	missing, extra := reconcilePlates(records, upstream.Plates)
+	response := map[string]interface{}{
+		"missing": missing,
+		"extra":   extra,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// reconcilePlates returns the upstream plates that have no local record and
+// the local plates absent upstream. Plates are compared in normalized form.
+func reconcilePlates(local []Record, upstream []string) (missing, extra []string) {
+	index := make(map[string]bool, len(local))
+	for _, rec := range local {
+		index[normalizePlate(rec.Plate)] = true
+	}
+	wanted := make(map[string]bool, len(upstream))
+	missing, extra = []string{}, []string{}
+	for _, plate := range upstream {
+		p := normalizePlate(plate)
+		if p == "" || wanted[p] {
+			continue
+		}
+		wanted[p] = true
+		if !index[p] {
+			missing = append(missing, p)
+		}
+	}
+	for p := range index {
+		if !wanted[p] {
+			extra = append(extra, p)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+// normalizePlate brings a plate to its canonical form: upper case without
+// spaces or dashes, so "ab 123" and "AB-123" compare equal.
+func normalizePlate(plate string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '\t' {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, strings.TrimSpace(plate))
+}
+
+// parseStatusFilter parses a comma-separated list of statuses. An empty
+// value returns a nil set, matching every status.
+func parseStatusFilter(value string) (map[int]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	statuses := make(map[int]bool)
+	for _, s := range strings.Split(value, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid status parameter")
+		}
+		statuses[status] = true
+	}
+	return statuses, nil
+}
+
+// listSorter returns an ordering for vehicle lists by the given key and
+// direction. Ties are broken by ID so the result is stable between requests.
+func listSorter(key, dir string) (func(a, b VehicleList) bool, error) {
+	var cmp func(a, b VehicleList) int
+	switch key {
+	case "", "order":
+		cmp = func(a, b VehicleList) int { return a.Order - b.Order }
+	case "name":
+		cmp = func(a, b VehicleList) int { return strings.Compare(a.Name, b.Name) }
+	case "displayName":
+		cmp = func(a, b VehicleList) int { return strings.Compare(a.DisplayName, b.DisplayName) }
+	case "status":
+		cmp = func(a, b VehicleList) int { return a.Status - b.Status }
+	default:
+		return nil, fmt.Errorf("Invalid sort parameter %q", key)
+	}
+
+	less, err := sortDirection(dir)
+	if err != nil {
+		return nil, err
+	}
+	return func(a, b VehicleList) bool { return less(cmp(a, b), a.ID, b.ID) }, nil
+}
+
+// recordSorter returns an ordering for records by the given key and
+// direction, id ascending by default. Ties are broken by ID so that pages
+// don't shift between requests.
+func recordSorter(key, dir string) (func(a, b Record) bool, error) {
+	var cmp func(a, b Record) int
+	switch key {
+	case "", "id":
+		cmp = func(a, b Record) int {
+			if a.ID == b.ID {
+				return 0
+			} else if a.ID < b.ID {
+				return -1
+			}
+			return 1
+		}
+	case "plate":
+		cmp = func(a, b Record) int { return strings.Compare(a.Plate, b.Plate) }
+	case "vehicleType":
+		cmp = func(a, b Record) int { return strings.Compare(a.VehicleType, b.VehicleType) }
+	default:
+		return nil, fmt.Errorf("Invalid sort parameter %q", key)
+	}
+
+	less, err := sortDirection(dir)
+	if err != nil {
+		return nil, err
+	}
+	return func(a, b Record) bool { return less(cmp(a, b), a.ID, b.ID) }, nil
+}
+
+// sortDirection parses the dir parameter, asc by default, and returns the
+// less function of a sort: c compares two items by the sort key, and ties
+// are broken by their IDs, ascending in both directions.
+func sortDirection(dir string) (func(c int, idA, idB int64) bool, error) {
+	desc := false
+	switch dir {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return nil, fmt.Errorf("Invalid dir parameter %q", dir)
+	}
+	return func(c int, idA, idB int64) bool {
+		if c == 0 {
+			return idA < idB
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	}, nil
+}
+
+// parsePagination reads the offset and limit query parameters.
+func parsePagination(r *http.Request) (offset, limit int, err error) {
+	offset, limit = 0, 20 // Default values
+	if s := r.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset parameter")
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("Invalid limit parameter")
+		}
+	}
+	return offset, limit, nil
+}
+
+// pageBounds clamps an offset/limit window to a slice of length total.
+func pageBounds(total, offset, limit int) (start, end int) {
+	start = offset
+	if start > total {
+		start = total
+	}
+	end = start + limit
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// pageMetadata describes a page of a paginated listing. The links repeat
+// the request with the offset of the next and previous page and are
+// omitted at the boundaries.
+type pageMetadata struct {
+	Offset     int    `json:"offset"`
+	Limit      int    `json:"limit"`
+	TotalCount int    `json:"totalCount"`
+	HasNext    bool   `json:"hasNext"`
+	HasPrev    bool   `json:"hasPrev"`
+	NextURL    string `json:"nextUrl,omitempty"`
+	PrevURL    string `json:"prevUrl,omitempty"`
+	// NextCursor continues a listing paged with the cursor parameter.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// newPageMetadata returns the metadata of the page of r at offset.
+func newPageMetadata(r *http.Request, offset, limit, total int) pageMetadata {
+	link := func(offset int) string {
+		query := r.URL.Query()
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("limit", strconv.Itoa(limit))
+		return strings.TrimSuffix(currentSettings().BaseURL, "/") + r.URL.Path + "?" + query.Encode()
+	}
+	meta := pageMetadata{
+		Offset:     offset,
+		Limit:      limit,
+		TotalCount: total,
+		HasNext:    offset+limit < total,
+		HasPrev:    offset > 0,
+	}
+	if meta.HasNext {
+		meta.NextURL = link(offset + limit)
+	}
+	if meta.HasPrev {
+		meta.PrevURL = link(max(offset-limit, 0))
+	}
+	return meta
+}
+
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleGetRecord(w, r)
+	case http.MethodHead:
+		handleHeadRecord(w, r)
+	case http.MethodPost:
+		idempotent(handlePostRecord)(w, r)
+	case http.MethodPut:
+		handlePutRecord(w, r)
+	case http.MethodPatch:
+		handlePatchRecord(w, r)
+	case http.MethodDelete:
+		handleDeleteRecord(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
+
+func recordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idStr := r.URL.Query().Get("id")
+		if idStr == "" {
+			writeError(w, http.StatusBadRequest, "bad_request", "Missing id parameter")
+			return
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid id parameter")
+			return
+		}
+
+		if !requestListAllowed(r, id) {
+			writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+			return
+		}
+
+		// Pass ID as context value
+		r = r.WithContext(contextWithID(r.Context(), id))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleHeadRecord reports the number of records of a list in
+// X-Total-Count, without a body.
+func handleHeadRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	storage.Lock()
+	records := storage.Records[id]
+	_, isList := storage.Lists[id]
+	count := activeCount(records, time.Now())
+	storage.Unlock()
+
+	if !isList {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleGetRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	// activeRecords copies under the lock: updates replace records in place
+	// and deletes compact the stored slice. Sorting then leaves the stored
+	// order alone too.
+	storage.Lock()
+	_, isList := storage.Lists[id]
+	records := activeRecords(storage.Records[id], time.Now())
+	storage.Unlock()
+
+	// A list may exist without a records entry yet; that is an empty list,
+	// not a missing one.
+	if !isList {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	less, err := recordSorter(r.URL.Query().Get("sort"), r.URL.Query().Get("dir"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return less(records[i], records[j]) })
+
+	if r.URL.Query().Get("format") == "html" {
+		offset, count, err := parsePagination(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		start, end := pageBounds(len(records), offset, count)
+		renderRecordsHTML(w, r, id, records[start:end], offset, count, len(records))
+		return
+	}
+
+	version, err := requestSchemaVersion(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	// Records are only paged when asked to, a plain request gets them all
+	// and no _metadata. Cursors page stably while records change.
+	var meta *pageMetadata
+	if query := r.URL.Query(); query.Has("cursor") {
+		page, pageMeta, err := cursorPage(r, records, less)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		records, meta = page, &pageMeta
+	} else if query.Has("offset") || query.Has("limit") {
+		offset, count, err := parsePagination(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		page := newPageMetadata(r, offset, count, len(records))
+		meta = &page
+		start, end := pageBounds(len(records), offset, count)
+		records = records[start:end]
+	}
+	var entries interface{} = records
+	if r.URL.Query().Get("enrich") == "true" {
+		entries = enrichRecords(records)
+	}
+	response := map[string]interface{}{
+		"entries": schemaEntries(version, "record", entries),
+	}
+	if meta != nil {
+		response["_metadata"] = meta
+	}
+	writeEncoded(w, r, response)
+}
+
+// maxRecordsLists bounds the lists fetched by one records request.
+const maxRecordsLists = 100
+
+// listRecords is the result for one list of a records request: its records,
+// or why they couldn't be returned.
+type listRecords struct {
+	Entries  interface{}   `json:"entries,omitempty"`
+	Metadata *pageMetadata `json:"_metadata,omitempty"`
+	Error    *errorDetail  `json:"error,omitempty"`
+}
+
+// recordsHandler returns the records of the lists in the ids parameter,
+// e.g. ids=1,2,3, keyed by list id. offset and limit page each list. A list
+// that is missing or not accessible gets an error instead of failing the
+// whole request.
+func recordsHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := requestSchemaVersion(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	var listIDs []int64
+	seen := make(map[int64]bool)
+	for _, field := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid ids parameter")
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			listIDs = append(listIDs, id)
+		}
+	}
+	if len(listIDs) == 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing ids parameter")
+		return
+	}
+	if len(listIDs) > maxRecordsLists {
+		writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("More than %d ids", maxRecordsLists))
+		return
+	}
+	paged := r.URL.Query().Has("offset") || r.URL.Query().Has("limit")
+	offset, count, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	session, restricted := contextSession(r.Context())
+	response := make(map[string]listRecords, len(listIDs))
+	now := time.Now()
+	storage.Lock()
+	for _, id := range listIDs {
+		key := strconv.FormatInt(id, 10)
+		records := storage.Records[id]
+		_, isList := storage.Lists[id]
+		switch {
+		case !isList:
+			response[key] = listRecords{Error: &errorDetail{Code: "not_found", Message: "List not found"}}
+			continue
+		case restricted && !listAllowedLocked(session, id):
+			response[key] = listRecords{Error: &errorDetail{Code: "forbidden", Message: "Forbidden"}}
+			continue
+		}
+		records = activeRecords(records, now)
+		result := listRecords{}
+		if paged {
+			meta := newPageMetadata(r, offset, count, len(records))
+			result.Metadata = &meta
+			start, end := pageBounds(len(records), offset, count)
+			records = records[start:end]
+		}
+		// activeRecords copied the entries, they are encoded after the lock
+		// is released.
+		result.Entries = schemaEntries(version, "record", records)
+		response[key] = result
+	}
+	storage.Unlock()
+
+	writeEncoded(w, r, response)
+}
+
+//go:embed templates/records.html
+var recordsHTML string
+
+var recordsTemplate = template.Must(template.New("records").Parse(recordsHTML))
+
+// renderRecordsHTML writes one page of records as an HTML table with links
+// to the neighbouring pages.
+func renderRecordsHTML(w http.ResponseWriter, r *http.Request, id int64, records []Record, offset, limit, total int) {
+	pageURL := func(offset int) string {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(limit))
+		return r.URL.Path + "?" + q.Encode()
+	}
+
+	data := struct {
+		ListID           int64
+		Records          []Record
+		From, To, Total  int
+		PrevURL, NextURL string
+	}{
+		ListID:  id,
+		Records: records,
+		From:    offset + 1,
+		To:      offset + len(records),
+		Total:   total,
+	}
+	if len(records) == 0 {
+		data.From = offset
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		data.PrevURL = pageURL(prev)
+	}
+	if offset+limit < total {
+		data.NextURL = pageURL(offset + limit)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := recordsTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render records: %v", err)
+	}
+}
+
+func handlePostRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	var record Record
+	if err := decodeJSON(r, &record); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	if _, err := createRecord(id, record, requestUser(r)); err != nil {
+		var errs fieldErrors
+		var full *listFullError
+		if errors.As(err, &errs) {
+			writeFieldErrors(w, errs)
+		} else if errors.As(err, &full) {
+			writeError(w, http.StatusConflict, "conflict", full.Error())
+		} else if errors.Is(err, errDuplicateID) || errors.Is(err, errDuplicatePlate) {
+			writeError(w, http.StatusConflict, "conflict", err.Error())
+		} else if errors.Is(err, errListNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", err.Error())
+		} else {
+			writeError(w, http.StatusUnprocessableEntity, "unprocessable", err.Error())
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// errReservedPlate rejects records whose plate matches reserved_plates.
+var errReservedPlate = errors.New("Reserved plate")
+
+// errDuplicateID rejects a record created with an id already in its list.
+var errDuplicateID = errors.New("Record id already in use")
+
+// errDuplicatePlate rejects a record whose plate another record of its list
+// already has, the rule of moves and bulk inserts too.
+var errDuplicatePlate = errors.New("Duplicate plate")
+
+// listFullError rejects records that would take a list past
+// max_records_per_list.
+type listFullError struct {
+	Count  int // Records in the list
+	Adding int
+	Limit  int
+}
+
+func (e *listFullError) Error() string {
+	return fmt.Sprintf("List has %d of at most %d records, cannot add %d", e.Count, e.Limit, e.Adding)
+}
+
+// checkListCapacity returns a *listFullError if adding records to the list
+// id would exceed max_records_per_list. The caller must hold the storage
+// lock.
+func checkListCapacity(id int64, adding int) error {
+	limit := currentSettings().MaxRecordsPerList
+	if count := len(storage.Records[id]); limit > 0 && count+adding > limit {
+		return &listFullError{Count: count, Adding: adding, Limit: limit}
+	}
+	return nil
+}
+
+// createRecord validates a record and adds it to the list id. An unknown
+// list is reported as errListNotFound, invalid records as fieldErrors, a
+// full list as a *listFullError, a client-chosen id already in the list
+// as errDuplicateID and a plate already in it as errDuplicatePlate.
+func createRecord(id int64, record Record, user string) (Record, error) {
+	if errs := validateRecord(&record); errs != nil {
+		return Record{}, errs
+	}
+	if isReservedPlate(record.Plate) {
+		return Record{}, errReservedPlate
+	}
+	if record.VehicleType == "" {
+		record.VehicleType = inferVehicleType(record.Plate)
+	}
+
+	record.Version = 1
+	record.UpdatedAt = time.Now()
+
+	storage.Lock()
+	if _, isList := storage.Lists[id]; !isList {
+		storage.Unlock()
+		return Record{}, errListNotFound
+	}
+	if err := checkListCapacity(id, 1); err != nil {
+		storage.Unlock()
+		return Record{}, err
+	}
+	if storage.plates.inList(record.Plate, id) {
+		storage.Unlock()
+		return Record{}, errDuplicatePlate
+	}
+	if record.ID == 0 {
+		record.ID = ids.NextID()
+	} else if _, taken := findRecord(id, record.ID); taken {
+		storage.Unlock()
+		return Record{}, errDuplicateID
+	} else {
+		ids.Reserve(record.ID)
+	}
+	storage.Records[id] = append(storage.Records[id], record)
+	storage.plates.add(id, record)
+	storage.Unlock()
+	recordChanged(user, auditCreate, id, record)
+	return record, nil
+}
+
+func handlePutRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	recordID, err := parseRecordID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	var update Record
+	if err := decodeJSON(r, &update); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	if errs := validateRecord(&update); errs != nil {
+		writeFieldErrors(w, errs)
+		return
+	}
+	if isReservedPlate(update.Plate) {
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable", "Reserved plate")
+		return
+	}
+
+	storage.Lock()
+	records, exists := storage.Records[id]
+	if !exists {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	index := recordIndex(records, recordID)
+	if index < 0 {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+	if rec := records[index]; update.Version != rec.Version {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("Version conflict, record is at version %d", rec.Version))
+		return
+	}
+	if storage.plates.takenInList(update.Plate, id, recordID) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", errDuplicatePlate.Error())
+		return
+	}
+	update.ID = recordID
+	update.Version++
+	update.UpdatedAt = time.Now()
+	records[index] = update
+	storage.plates.add(id, update)
+	storage.Unlock()
+
+	// Subscribers and the response are served after unlocking, a slow
+	// client must not hold up other requests.
+	recordChanged(requestUser(r), auditUpdate, id, update)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// recordIndex returns the index of the record recordID in records, or -1.
+func recordIndex(records []Record, recordID int64) int {
+	for i, rec := range records {
+		if rec.ID == recordID {
+			return i
+		}
+	}
+	return -1
+}
+
+// handlePatchRecord updates the fields of a record present in the body and
+// leaves the others untouched. A null clears expiresAt, validFrom or
+// validUntil. Unlike with PUT the version is optional, but a given one must
+// match.
+func handlePatchRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	recordID, err := parseRecordID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := decodeJSON(r, &patch); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	for _, field := range []string{"id", "updatedAt"} {
+		if _, ok := patch[field]; ok {
+			writeFieldError(w, &fieldError{Message: "Read-only field", Field: field})
+			return
+		}
+	}
+	body, _ := json.Marshal(patch)
+
+	storage.Lock()
+	records, exists := storage.Records[id]
+	if !exists {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	index := recordIndex(records, recordID)
+	if index < 0 {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+	rec := records[index]
+	// Decoding over a copy sets just the fields present. The tags are
+	// copied too, as decoding reuses the backing array.
+	update := rec
+	update.Tags = append([]string(nil), rec.Tags...)
+	if err := decodeJSONFrom(bytes.NewReader(body), &update); err != nil {
+		storage.Unlock()
+		writeFieldError(w, err)
+		return
+	}
+	if errs := validateRecord(&update); errs != nil {
+		storage.Unlock()
+		writeFieldErrors(w, errs)
+		return
+	}
+	if _, ok := patch["plate"]; ok && isReservedPlate(update.Plate) {
+		storage.Unlock()
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable", "Reserved plate")
+		return
+	}
+	if update.Version != rec.Version {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("Version conflict, record is at version %d", rec.Version))
+		return
+	}
+	if storage.plates.takenInList(update.Plate, id, recordID) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", errDuplicatePlate.Error())
+		return
+	}
+	update.Version = rec.Version + 1
+	update.UpdatedAt = time.Now()
+	records[index] = update
+	storage.plates.add(id, update)
+	storage.Unlock()
+
+	// As with PUT, subscribers and the response are served after unlocking.
+	recordChanged(requestUser(r), auditUpdate, id, update)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// queryRecordHandler lists the records of a list reduced to the shape of a
+// projection template sent in the body, e.g. {"projection": {"plate": true}}.
+// As in JSON Merge Patch, object members are matched recursively and members
+// that are null or false are left out.
+func queryRecordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	var query struct {
+		Projection map[string]interface{} `json:"projection"`
+	}
+	if err := decodeJSON(r, &query); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	if query.Projection == nil {
+		writeFieldError(w, &fieldError{Message: "Missing required field", Field: "projection"})
+		return
+	}
+
+	storage.Lock()
+	records, exists := storage.Records[id]
+	records = activeRecords(records, time.Now())
+	storage.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+
+	// Go through the JSON form so that projections use the wire field names.
+	response := map[string]interface{}{
+		"entries": project(toGeneric(records), query.Projection),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// project reduces value to the members named in projection.
+func project(value interface{}, projection map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for key, p := range projection {
+			member, ok := v[key]
+			if !ok || p == nil || p == false {
+				continue
+			}
+			if nested, isObject := p.(map[string]interface{}); isObject {
+				member = project(member, nested)
+			}
+			out[key] = member
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = project(item, projection)
+		}
+		return out
+	}
+	return value
+}
+
+// bulkRecordHandler appends an array of records to a list in one go. Invalid
+// or duplicate rows are reported back instead of failing the whole batch.
+func bulkRecordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	var records []Record
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+		return
+	}
+
+	result, err := insertRecords(r.Context(), id, records, requestUser(r), r.URL.Query().Get("dryRun") == "true")
+	if isContextError(err) {
+		writeContextError(w, err)
+		return
+	}
+	if errors.Is(err, errListNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.DryRun {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// bulkError describes why a single row of a bulk insert was rejected.
+type bulkError struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// bulkResult summarizes the outcome of a bulk insert. For a dry run Created
+// counts the records that would have been created.
+type bulkResult struct {
+	Created int         `json:"created"`
+	Skipped int         `json:"skipped"`
+	Errors  []bulkError `json:"errors"`
+	DryRun  bool        `json:"dryRun,omitempty"`
+}
+
+// bulkDeleteResult is the response of the bulk delete endpoint.
+type bulkDeleteResult struct {
+	Deleted  int `json:"deleted"`
+	NotFound int `json:"notFound"`
+}
+
+// bulkDeleteRecordHandler deletes the records whose ids are given as a JSON
+// array, all under a single lock.
+func bulkDeleteRecordHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	var recordIDs []int64
+	if err := decodeJSON(r, &recordIDs); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	remove := make(map[int64]bool, len(recordIDs))
+	for _, recordID := range recordIDs {
+		remove[recordID] = true
+	}
+
+	storage.Lock()
+	records, exists := storage.Records[id]
+	if !exists {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	kept := records[:0]
+	var deleted []Record
+	found := make(map[int64]bool)
+	for _, rec := range records {
+		if remove[rec.ID] {
+			found[rec.ID] = true
+			deleted = append(deleted, rec)
+			storage.plates.remove(id, rec.ID)
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	storage.Records[id] = kept
+	storage.Unlock()
+
+	user := requestUser(r)
+	for _, rec := range deleted {
+		recordChanged(user, auditDelete, id, rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bulkDeleteResult{Deleted: len(found), NotFound: len(remove) - len(found)})
+}
+
+// clearRecordsHandler deletes every record of a list and reports how many
+// there were. The list itself stays.
+func clearRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+
+	storage.Lock()
+	_, isList := storage.Lists[id]
+	deleted := storage.Records[id]
+	if !isList {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	for _, rec := range deleted {
+		storage.plates.remove(id, rec.ID)
+	}
+	storage.Records[id] = []Record{}
+	storage.Unlock()
+
+	user := requestUser(r)
+	for _, rec := range deleted {
+		recordChanged(user, auditDelete, id, rec)
+	}
+	writeEncoded(w, r, map[string]int{"deleted": len(deleted)})
+}
+
+// moveRecordHandler moves a record from one list to another, keeping all of
+// its fields. The destination's duplicate plate rule applies.
+func moveRecordHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := strconv.ParseInt(query.Get("from"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid from parameter")
+		return
+	}
+	to, err := strconv.ParseInt(query.Get("to"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid to parameter")
+		return
+	}
+	if from == to {
+		writeError(w, http.StatusBadRequest, "bad_request", "Source and destination lists are the same")
+		return
+	}
+	recordID, err := parseRecordID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if !requestListAllowed(r, from) || !requestListAllowed(r, to) {
+		writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+		return
+	}
+
+	storage.Lock()
+	source, exists := storage.Records[from]
+	destination := storage.Records[to]
+	if _, destIsList := storage.Lists[to]; !exists || !destIsList {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	index := -1
+	for i, rec := range source {
+		if rec.ID == recordID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		storage.Unlock()
+		writeError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+	rec := source[index]
+	if storage.plates.inList(rec.Plate, to) {
+		storage.Unlock()
+		writeError(w, http.StatusConflict, "conflict", "Duplicate plate "+rec.Plate)
+		return
+	}
+	storage.Records[from] = append(source[:index], source[index+1:]...)
+	storage.Records[to] = append(destination, rec)
+	storage.plates.remove(from, rec.ID)
+	storage.plates.add(to, rec)
+	storage.Unlock()
+
+	user := requestUser(r)
+	recordChanged(user, auditDelete, from, rec)
+	recordChanged(user, auditCreate, to, rec)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// insertRecords validates, normalizes and appends records to the list with
+// the given id under a single lock acquisition. Each accepted record gets a
+// fresh id; rows that fail validation or duplicate an existing plate are
+// skipped and reported by their index in the input. A dry run reports the
+// same result without storing anything. Nothing is stored either, and a
+// *listFullError returned, if the accepted rows would overfill the list, or
+// errListNotFound if there is no list id.
+func insertRecords(ctx context.Context, id int64, records []Record, user string, dryRun bool) (bulkResult, error) {
+	storage.Lock()
+	result, created, err := insertRecordsLocked(ctx, id, records, dryRun)
+	storage.Unlock()
+
+	// Published after unlocking, a slow subscriber must not hold up other
+	// requests.
+	for _, rec := range created {
+		recordChanged(user, auditCreate, id, rec)
+	}
+	return result, err
+}
+
+// insertRecordsLocked is insertRecords without the lock and the change
+// notifications, returning the records stored. The caller must hold the
+// storage lock.
+func insertRecordsLocked(ctx context.Context, id int64, records []Record, dryRun bool) (bulkResult, []Record, error) {
+	result := bulkResult{Errors: []bulkError{}, DryRun: dryRun}
+
+	if _, isList := storage.Lists[id]; !isList {
+		return result, nil, errListNotFound
+	}
+	plates := make(map[string]bool)
+	for _, rec := range storage.Records[id] {
+		plates[normalizePlate(rec.Plate)] = true
+	}
+
+	var accepted []Record
+	for i, rec := range records {
+		if err := ctx.Err(); err != nil {
+			return result, nil, err
+		}
+		if errs := validateRecord(&rec); errs != nil {
+			result.Skipped++
+			result.Errors = append(result.Errors, bulkError{Index: i, Reason: errs.Error()})
+			continue
+		}
+		if isReservedPlate(rec.Plate) {
+			result.Skipped++
+			result.Errors = append(result.Errors, bulkError{Index: i, Reason: "reserved plate " + rec.Plate})
+			continue
+		}
+		if plates[rec.Plate] {
+			result.Skipped++
+			result.Errors = append(result.Errors, bulkError{Index: i, Reason: "duplicate plate " + rec.Plate})
+			continue
+		}
+		plates[rec.Plate] = true
+		if rec.VehicleType == "" {
+			rec.VehicleType = inferVehicleType(rec.Plate)
+		}
+		accepted = append(accepted, rec)
+	}
+	if err := checkListCapacity(id, len(accepted)); err != nil {
+		return result, nil, err
+	}
+	result.Created = len(accepted)
+	if dryRun {
+		return result, nil, nil
+	}
+	// Nothing is stored once the client is gone, or the handler timed out.
+	if err := ctx.Err(); err != nil {
+		return result, nil, err
+	}
+
+	now := time.Now()
+	for i := range accepted {
+		rec := &accepted[i]
+		rec.ID = ids.NextID()
+		rec.Version = 1
+		rec.UpdatedAt = now
+		storage.Records[id] = append(storage.Records[id], *rec)
+		storage.plates.add(id, *rec)
+	}
+	return result, accepted, nil
+}
+
+// importError describes why a CSV line was rejected.
+type importError struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// importResult summarizes the outcome of a CSV import, see bulkResult.
+type importResult struct {
+	Created  int           `json:"created"`
+	Rejected int           `json:"rejected"`
+	Errors   []importError `json:"errors"`
+	DryRun   bool          `json:"dryRun,omitempty"`
+}
+
+// importRecordHandler imports records from a text/csv body with the columns
+// plate,vehicleType. A leading header row is skipped, as are blank lines.
+func importRecordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "text/csv" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be text/csv")
+		return
+	}
+
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	result := importResult{Errors: []importError{}}
+	var records []Record
+	var lines []int
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		if err := r.Context().Err(); err != nil {
+			writeContextError(w, err)
+			return
+		}
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				writeError(w, http.StatusBadRequest, "bad_request", "Bad request")
+				return
+			}
+			result.Rejected++
+			result.Errors = append(result.Errors, importError{Line: parseErr.Line, Reason: parseErr.Err.Error()})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		if first && strings.EqualFold(strings.TrimSpace(row[0]), "plate") {
+			continue
+		}
+		if len(row) > 2 {
+			result.Rejected++
+			result.Errors = append(result.Errors, importError{Line: line, Reason: "expected columns plate,vehicleType"})
+			continue
+		}
+		rec := Record{Plate: row[0]}
+		if len(row) > 1 {
+			rec.VehicleType = row[1]
+		}
+		records = append(records, rec)
+		lines = append(lines, line)
+	}
+
+	inserted, err := insertRecords(r.Context(), id, records, requestUser(r), r.URL.Query().Get("dryRun") == "true")
+	if isContextError(err) {
+		writeContextError(w, err)
+		return
+	}
+	if errors.Is(err, errListNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+		return
+	}
+	result.Created = inserted.Created
+	result.DryRun = inserted.DryRun
+	result.Rejected += inserted.Skipped
+	for _, e := range inserted.Errors {
+		result.Errors = append(result.Errors, importError{Line: lines[e.Index], Reason: e.Reason})
+	}
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Line < result.Errors[j].Line })
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.DryRun {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// exportFormat picks the export body format from the format parameter or,
+// failing that, the Accept header. CSV is the default; ok is false when the
+// client accepts none of the supported formats.
+func exportFormat(r *http.Request) (format string, ok bool) {
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		return "csv", true
+	case "ndjson":
+		return "ndjson", true
+	case "":
+	default:
+		return "", false
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "csv", true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.TrimSpace(mediaType) {
+		case "text/csv", "text/*", "*/*":
+			return "csv", true
+		case "application/x-ndjson":
+			return "ndjson", true
+		}
+	}
+	return "", false
+}
+
+// exportRecordHandler streams the unexpired records of a list as
+// plate,vehicleType CSV or, see exportFormat, as NDJSON records. Rows are
+// written straight to the response instead of being buffered.
+func exportRecordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	// Stream from a snapshot, a large export must not block writers.
+	records, exists := storage.snapshotRecords(func(listID int64) bool { return listID == id })[id]
+	records = activeRecords(records, time.Now())
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+
+	format, ok := exportFormat(r)
+	if !ok {
+		writeError(w, http.StatusNotAcceptable, "not_acceptable", "Not acceptable")
+		return
+	}
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="list-%d.ndjson"`, id))
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := r.Context().Err(); err != nil {
+				log.Printf("Export of list %d stopped: %v", id, err)
+				return
+			}
+			if err := enc.Encode(rec); err != nil {
+				log.Printf("Failed to export list %d: %v", id, err)
+				return
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="list-%d.csv"`, id))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"plate", "vehicleType"})
+	for _, rec := range records {
+		if err := r.Context().Err(); err != nil {
+			log.Printf("Export of list %d stopped: %v", id, err)
+			return
+		}
+		if err := writer.Write([]string{rec.Plate, rec.VehicleType}); err != nil {
+			log.Printf("Failed to export list %d: %v", id, err)
+			return
+		}
+	}
+	writer.Flush()
+}
+
+// isReservedPlate reports whether the plate matches a reserved_plates entry.
+func isReservedPlate(plate string) bool {
+	plate = normalizePlate(plate)
+	for _, pattern := range currentSettings().ReservedPlates {
+		if ok, _ := path.Match(normalizePlate(pattern), plate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRecord normalizes the record in place and reports every problem
+// found with it: the rules of its validate tags and those set by the config.
+func validateRecord(rec *Record) fieldErrors {
+	rec.Plate = normalizePlate(rec.Plate)
+	rec.VehicleType = strings.TrimSpace(rec.VehicleType)
+	for i, tag := range rec.Tags {
+		rec.Tags[i] = strings.TrimSpace(tag)
+	}
+	errs := validateStruct(rec)
+	cfg := currentSettings()
+	if len(rec.Plate) > cfg.MaxPlateLength {
+		errs = append(errs, &fieldError{Message: fmt.Sprintf("plate is longer than %d characters", cfg.MaxPlateLength), Field: "plate"})
+	} else if rec.Plate != "" && cfg.platePattern != nil && !cfg.platePattern.MatchString(rec.Plate) {
+		errs = append(errs, &fieldError{Message: "plate does not match " + cfg.platePattern.String(), Field: "plate"})
+	}
+	if rec.VehicleType != "" && len(cfg.VehicleTypes) > 0 && !containsString(cfg.VehicleTypes, rec.VehicleType) {
+		errs = append(errs, &fieldError{Message: "unknown vehicle type " + rec.VehicleType, Field: "vehicleType"})
+	}
+	if len(rec.Tags) > cfg.MaxTagsPerRecord {
+		errs = append(errs, &fieldError{Message: fmt.Sprintf("more than %d tags", cfg.MaxTagsPerRecord), Field: "tags"})
+	}
+	for _, tag := range rec.Tags {
+		if tag == "" {
+			errs = append(errs, &fieldError{Message: "tag is empty", Field: "tags"})
+			break
+		}
+		if len(tag) > cfg.MaxTagLength {
+			errs = append(errs, &fieldError{Message: fmt.Sprintf("tag is longer than %d characters", cfg.MaxTagLength), Field: "tags"})
+			break
+		}
+	}
+	if rec.ValidFrom != nil && rec.ValidUntil != nil && !rec.ValidFrom.Before(*rec.ValidUntil) {
+		errs = append(errs, &fieldError{Message: "validUntil must be after validFrom", Field: "validUntil"})
+	}
+	return errs
+}
+
+// validateList checks the client supplied fields of a list and reports
+// every problem found. The color is optional.
+func validateList(list *VehicleList) fieldErrors {
+	errs := validateStruct(list)
+	cfg := currentSettings()
+	if utf8.RuneCountInString(list.DisplayName) > cfg.MaxDisplayNameLength {
+		errs = append(errs, &fieldError{Message: fmt.Sprintf("displayName is longer than %d characters", cfg.MaxDisplayNameLength), Field: "displayName"})
+	}
+	if utf8.RuneCountInString(list.Name) > cfg.MaxListNameLength {
+		errs = append(errs, &fieldError{Message: fmt.Sprintf("name is longer than %d characters", cfg.MaxListNameLength), Field: "name"})
+	}
+	return errs
+}
+
+// VehicleTypeRule assigns Type to records whose normalized plate matches
+// the regular expression Pattern.
+type VehicleTypeRule struct {
+	Pattern string `yaml:"pattern"`
+	Type    string `yaml:"type"`
+
+	re *regexp.Regexp
+}
+
+// compileVehicleTypeRules prepares the rules for inferVehicleType.
+func compileVehicleTypeRules(rules []VehicleTypeRule) ([]VehicleTypeRule, error) {
+	compiled := make([]VehicleTypeRule, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("vehicle type rule %d: %v", i, err)
+		}
+		compiled[i] = VehicleTypeRule{Pattern: rule.Pattern, Type: rule.Type, re: re}
+	}
+	return compiled, nil
+}
+
+// inferVehicleType returns the type of the first rule matching the plate,
+// or the default vehicle type when none does.
+func inferVehicleType(plate string) string {
+	cfg := currentSettings()
+	for _, rule := range cfg.vehicleTypeRules {
+		if rule.re.MatchString(plate) {
+			return rule.Type
+		}
+	}
+	return cfg.DefaultVehicleType
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaHandler describes the record constraints the server enforces so
+// that clients can build their forms from it.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentSettings()
+	pattern := ""
+	if cfg.platePattern != nil {
+		pattern = cfg.platePattern.String()
+	}
+	types := cfg.VehicleTypes
+	if types == nil {
+		types = []string{}
+	}
+	response := map[string]interface{}{
+		"vehicleTypes": types,
+		"platePattern": pattern,
+		"limits": map[string]int{
+			"maxPlateLength":   cfg.MaxPlateLength,
+			"maxTagsPerRecord": cfg.MaxTagsPerRecord,
+			"maxTagLength":     cfg.MaxTagLength,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleDeleteRecord(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	recordID, err := parseRecordID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if _, err := deleteRecord(id, recordID, requestUser(r)); err != nil {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Errors of deleteRecord.
+var (
+	errListNotFound   = errors.New("List not found")
+	errRecordNotFound = errors.New("Record not found")
+)
+
+// deleteRecord removes a record from the list id and returns it.
+func deleteRecord(id, recordID int64, user string) (Record, error) {
+	storage.Lock()
+	records, exists := storage.Records[id]
+	if !exists {
+		storage.Unlock()
+		return Record{}, errListNotFound
+	}
+
+	for i, rec := range records {
+		if rec.ID == recordID {
+			storage.Records[id] = append(records[:i], records[i+1:]...)
+			storage.plates.remove(id, rec.ID)
+			storage.Unlock()
+			recordChanged(user, auditDelete, id, rec)
+			return rec, nil
+		}
+	}
+	storage.Unlock()
+	return Record{}, errRecordNotFound
+}
+
+// parseRecordID reads the recordId query parameter.
+func parseRecordID(r *http.Request) (int64, error) {
+	recordIDStr := r.URL.Query().Get("recordId")
+	if recordIDStr == "" {
+		return 0, fmt.Errorf("Missing recordId parameter")
+	}
+	recordID, err := strconv.ParseInt(recordIDStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid recordId parameter")
+	}
+	return recordID, nil
+}
+
+// fieldError is the body of a 400 response for a rejected JSON payload.
+// Field names the offending field when it is known.
+type fieldError struct {
+	Message string `json:"error"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *fieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Field
+}
+
+// decodeJSON strictly decodes the request body into v, rejecting unknown
+// fields, and describes what was wrong with the payload on failure.
+func decodeJSON(r *http.Request, v interface{}) *fieldError {
+	return decodeJSONFrom(r.Body, v)
+}
+
+// decodeJSONFrom is decodeJSON for a body already read.
+func decodeJSONFrom(body io.Reader, v interface{}) *fieldError {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return &fieldError{Message: "Malformed JSON"}
+	case errors.Is(err, io.EOF):
+		return &fieldError{Message: "Empty request body"}
+	case errors.As(err, &typeErr):
+		return &fieldError{Message: "Wrong type, expected " + typeErr.Type.String(), Field: typeErr.Field}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return &fieldError{Message: "Unknown field", Field: strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)}
+	}
+	return &fieldError{Message: "Bad request"}
+}
+
+// writeFieldError sends err as a 400 apiError with code bad_request,
+// listing the field when it is known.
+func writeFieldError(w http.ResponseWriter, err *fieldError) {
+	body := apiError{Error: errorDetail{Code: "bad_request", Message: err.Message}}
+	if err.Field != "" {
+		body.Error.Fields = fieldErrors{err}
+	}
+	writeAPIError(w, http.StatusBadRequest, body)
+}
+
+// apiError is the body of error responses: a stable machine-readable code,
+// such as "not_found", and a message for humans.
+type apiError struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists each invalid field of a rejected payload.
+	Fields fieldErrors `json:"fields,omitempty"`
+}
+
+// writeError sends an error response with an apiError body. It replaces
+// http.Error, whose plain text bodies made clients branch on the content
+// type.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, apiError{Error: errorDetail{Code: code, Message: message}})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, body apiError) {
+	// Like http.Error, drop headers meant for the body that was planned.
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// statusClientClosedRequest is the nginx status of requests the client
+// abandoned before the response; it only shows in logs and metrics.
+const statusClientClosedRequest = 499
+
+// isContextError reports whether err is the end of a request's context.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeContextError answers a request whose context ended, see
+// isContextError, before its work was done.
+func writeContextError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusServiceUnavailable, "timeout", "Request timed out")
+		return
+	}
+	writeError(w, statusClientClosedRequest, "client_closed_request", "Request cancelled by the client")
+}
+
+// Context helpers for passing ID
+
+// ctxKey is the type of the context keys of this package. Being unexported
+// it can't collide with keys set by other packages.
+type ctxKey int
+
+const (
+	listIDKey ctxKey = iota
+	sessionKey
+	requestIDKey
+)
+
+func contextWithID(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, listIDKey, id)
+}
+
+// contextID returns the list id set by recordMiddleware and whether there
+// was one.
+func contextID(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(listIDKey).(int64)
+	return id, ok
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// requestID returns the correlation id of the request, see
+// requestIDMiddleware.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// maxRequestIDLength bounds client supplied request ids.
+const maxRequestIDLength = 128
+
+// requestIDMiddleware tags every request with a correlation id, taken from
+// the X-Request-ID header or generated, and echoes it in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = hex.EncodeToString(randomBytes(16))
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(contextWithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts ids of printable ASCII characters, so that a
+// client can't inject line breaks or control characters into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func contextWithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func contextSession(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionKey).(Session)
+	return session, ok
+}
+
+// csrfCookie is the name of the cookie carrying the CSRF token.
+const csrfCookie = "csrf"
+
+func tokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data Session
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			// Like a bearer token the key is added deliberately, so it
+			// needs no CSRF check.
+			var ok bool
+			if data, ok = apiKeySession(key); !ok {
+				writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+				return
+			}
+		} else {
+			var ok bool
+			if data, ok = tokenSession(w, r); !ok {
+				return
+			}
 		}
 
 		r.Header.Set("User-ID", strconv.FormatInt(data.ID, 10))
+		r = r.WithContext(contextWithSession(r.Context(), data))
+		if isStateChanging(r.Method) {
+			auditMutation(w, r, next)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func generateToken(id int64) string {
-	return fmt.Sprintf("%d-%d", id, time.Now().UnixNano())
+// tokenSession authenticates the session token of r. It answers requests
+// failing the checks itself and reports whether r may go on.
+func tokenSession(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	token, bearer := requestToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return Session{}, false
+	}
+
+	data, err := authenticate(token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return Session{}, false
+	}
+	cfg := currentSettings()
+	if cfg.BindSessions && data.Fingerprint != fingerprint(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return Session{}, false
+	}
+	// Browsers attach the cookie to cross-site requests on their own, a
+	// bearer token has to be added deliberately and needs no CSRF check.
+	if !bearer && isStateChanging(r.Method) &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("X-CSRF-Token")), []byte(data.CSRF)) != 1 {
+		writeError(w, http.StatusForbidden, "forbidden", "Invalid CSRF token")
+		return Session{}, false
+	}
+	if cfg.EnforceClientSeq && isStateChanging(r.Method) && r.Header.Get("X-Client-Seq") != "" {
+		seq, err := strconv.ParseInt(r.Header.Get("X-Client-Seq"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid X-Client-Seq header")
+			return Session{}, false
+		}
+		if !advanceClientSeq(token, seq) {
+			writeError(w, http.StatusConflict, "conflict", "Out of order X-Client-Seq")
+			return Session{}, false
+		}
+	}
+	return data, true
+}
+
+// advanceClientSeq records seq as the session's last sequence number if it
+// is greater than the previous one, and reports whether it was.
+func advanceClientSeq(token string, seq int64) bool {
+	storage.Lock()
+	defer storage.Unlock()
+	session, exists := storage.Tokens[token]
+	if !exists || seq <= session.LastSeq {
+		return false
+	}
+	session.LastSeq = seq
+	storage.Tokens[token] = session
+	return true
+}
+
+// requestToken returns the session token from the Authorization bearer
+// header or, failing that, from the session cookie.
+func requestToken(r *http.Request) (token string, bearer bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), true
+	}
+	if cookie, err := r.Cookie(currentSettings().CookieName); err == nil {
+		return cookie.Value, false
+	}
+	return "", false
+}
+
+func isStateChanging(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// userID derives a stable user id from the username, so that every session
+// of a user maps to the same id.
+func userID(username string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(username))
+	return int64(h.Sum64() &^ (1 << 63))
+}
+
+// requestUserID returns the id of the user set by tokenMiddleware.
+func requestUserID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(r.Header.Get("User-ID"), 10, 64)
+	return id
+}
+
+// fingerprint derives a coarse client fingerprint from the User-Agent and
+// the network prefix of the client address (/24 for IPv4, /48 for IPv6), so
+// that a client keeps its fingerprint while moving within a network.
+func fingerprint(r *http.Request) string {
+	host := clientIP(r)
+	prefix := host
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			prefix = ip4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			prefix = ip.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent() + "|" + prefix))
+	return hex.EncodeToString(sum[:16])
 }
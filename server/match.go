@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// plateMatch is a record whose plate is within the requested distance of
+// the queried plate.
+type plateMatch struct {
+	Record
+	Distance int `json:"distance"`
+}
+
+// matchRecordHandler returns the records of a list whose plate differs from
+// the plate parameter by at most maxDistance edits (default 1), closest
+// first. It finds the plates an ANPR camera misread, e.g. O for 0.
+func matchRecordHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	plate := normalizePlate(r.URL.Query().Get("plate"))
+	if plate == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing plate parameter")
+		return
+	}
+	maxDistance := 1
+	if value := r.URL.Query().Get("maxDistance"); value != "" {
+		var err error
+		if maxDistance, err = strconv.Atoi(value); err != nil || maxDistance < 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid maxDistance parameter")
+			return
+		}
+	}
+	// The cost grows with the distance, so it is capped.
+	if limit := currentSettings().MaxMatchDistance; maxDistance > limit {
+		writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("maxDistance may not exceed %d", limit))
+		return
+	}
+
+	now := time.Now()
+	storage.Lock()
+	records := storage.Records[id]
+	_, isList := storage.Lists[id]
+	matches := []plateMatch{}
+	for _, rec := range records {
+		if rec.expired(now) {
+			continue
+		}
+		if d := plateDistance(plate, normalizePlate(rec.Plate), maxDistance); d <= maxDistance {
+			matches = append(matches, plateMatch{Record: rec, Distance: d})
+		}
+	}
+	storage.Unlock()
+
+	if !isList {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Plate < matches[j].Plate
+	})
+	writeEncoded(w, r, map[string]interface{}{"entries": matches})
+}
+
+// plateLocation is a record found by findPlateHandler and the list it is
+// in.
+type plateLocation struct {
+	ListID   int64  `json:"listId"`
+	ListName string `json:"listName"`
+	Record   Record `json:"record"`
+}
+
+// findPlateHandler returns every record with the plate parameter across all
+// lists the caller may use, ordered by list id. The plate index spares it
+// a scan of every list.
+func findPlateHandler(w http.ResponseWriter, r *http.Request) {
+	plate := normalizePlate(r.URL.Query().Get("plate"))
+	if plate == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing plate parameter")
+		return
+	}
+
+	session, restricted := contextSession(r.Context())
+	found := []plateLocation{}
+	now := time.Now()
+	storage.Lock()
+	for _, ref := range storage.plates.lookup(plate) {
+		if restricted && !listAllowedLocked(session, ref.ListID) {
+			continue
+		}
+		if rec, ok := findRecord(ref.ListID, ref.RecordID); ok && normalizePlate(rec.Plate) == plate && !rec.expired(now) {
+			found = append(found, plateLocation{ListID: ref.ListID, ListName: storage.Lists[ref.ListID].DisplayName, Record: rec})
+		}
+	}
+	storage.Unlock()
+
+	writeEncoded(w, r, found)
+}
+
+// plateDistance returns the Levenshtein distance of two plates, or limit+1
+// as soon as it is known to exceed limit.
+func plateDistance(a, b string, limit int) int {
+	s, t := []rune(a), []rune(b)
+	if diff := len(s) - len(t); diff > limit || -diff > limit {
+		return limit + 1
+	}
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return min(prev[len(t)], limit+1)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsSink receives counter increments.
+type metricsSink interface {
+	Add(name string, delta int64)
+}
+
+// Collector holds counters and serves them in the Prometheus text format.
+type Collector struct {
+	sync.Mutex
+	counters map[string]int64
+}
+
+func newCollector() *Collector {
+	return &Collector{counters: make(map[string]int64)}
+}
+
+// Add increments the named counter by delta.
+func (c *Collector) Add(name string, delta int64) {
+	c.Lock()
+	c.counters[name] += delta
+	c.Unlock()
+}
+
+// Value returns the current value of the named counter.
+func (c *Collector) Value(name string) int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.counters[name]
+}
+
+// ServeHTTP writes all counters, sorted by name.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flushMetrics()
+
+	c.Lock()
+	names := make([]string, 0, len(c.counters))
+	for name := range c.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %d\n", name, c.counters[name])
+	}
+	c.Unlock()
+}
+
+// metricsBatcher buffers counter increments and applies them to a sink in
+// aggregated batches, so the request path never contends on the sink's lock.
+// Counts are eventually consistent: they reach the sink on the next flush.
+type metricsBatcher struct {
+	sink    metricsSink
+	updates chan string
+	flushes chan chan struct{}
+}
+
+func newMetricsBatcher(sink metricsSink, interval time.Duration) *metricsBatcher {
+	b := &metricsBatcher{
+		sink:    sink,
+		updates: make(chan string, 1024),
+		flushes: make(chan chan struct{}),
+	}
+	go b.run(interval)
+	return b
+}
+
+// Inc queues an increment of the named counter.
+func (b *metricsBatcher) Inc(name string) {
+	b.updates <- name
+}
+
+// Flush applies all queued increments and returns once they reached the sink.
+func (b *metricsBatcher) Flush() {
+	done := make(chan struct{})
+	b.flushes <- done
+	<-done
+}
+
+func (b *metricsBatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := make(map[string]int64)
+	apply := func() {
+		for name, delta := range pending {
+			b.sink.Add(name, delta)
+			delete(pending, name)
+		}
+	}
+	for {
+		select {
+		case name := <-b.updates:
+			pending[name]++
+		case <-ticker.C:
+			apply()
+		case done := <-b.flushes:
+			// Drain what was queued before the flush was requested.
+			for drained := false; !drained; {
+				select {
+				case name := <-b.updates:
+					pending[name]++
+				default:
+					drained = true
+				}
+			}
+			apply()
+			close(done)
+		}
+	}
+}
+
+var (
+	metrics = newCollector()
+	// batcher is set when metrics_flush_interval is configured.
+	batcher *metricsBatcher
+)
+
+// countMetric increments the named counter, through the batcher if enabled.
+func countMetric(name string) {
+	if batcher != nil {
+		batcher.Inc(name)
+		return
+	}
+	metrics.Add(name, 1)
+}
+
+// flushMetrics pushes pending batched increments to the collector.
+func flushMetrics() {
+	if batcher != nil {
+		batcher.Flush()
+	}
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the Flusher of streaming
+// responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack hands the connection over for WebSockets, which check for
+// http.Hijacker directly.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// metricsMiddleware counts requests by method and response code.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		countMetric(`amv_http_requests_total{method="` + r.Method + `",code="` + strconv.Itoa(rec.status) + `"}`)
+	})
+}
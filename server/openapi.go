@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Authentication levels of an API operation. authAdmin operations need a
+// session with the admin role.
+const (
+	authNone = iota
+	authSession
+	authAdmin
+)
+
+// apiParam is a query or path parameter of an API operation.
+type apiParam struct {
+	Name     string
+	In       string
+	Type     string
+	Required bool
+	Summary  string
+}
+
+// apiOperation describes one endpoint for the OpenAPI document. Request and
+// Response are sample values whose types the schemas are derived from, so
+// the document follows the structs they are encoded from; a string names
+// a non-JSON media type instead.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Auth     int
+	Params   []apiParam
+	Request  interface{}
+	Status   int
+	Response interface{}
+}
+
+var listIDParam = apiParam{Name: "id", In: "query", Type: "integer", Required: true, Summary: "List id"}
+
+var recordIDParam = apiParam{Name: "recordId", In: "query", Type: "integer", Required: true, Summary: "Record id"}
+
+var dryRunParam = apiParam{Name: "dryRun", In: "query", Type: "boolean", Summary: "Validate only, report without storing"}
+
+// listsParams filter and page the lists.
+var listsParams = []apiParam{
+	{Name: "offset", In: "query", Type: "integer"},
+	{Name: "limit", In: "query", Type: "integer"},
+	{Name: "sort", In: "query", Type: "string"},
+	{Name: "dir", In: "query", Type: "string"},
+	{Name: "status", In: "query", Type: "string", Summary: "Comma-separated statuses"},
+	{Name: "modifiedSince", In: "query", Type: "string", Summary: "RFC 3339 time"},
+	{Name: "includeArchived", In: "query", Type: "boolean"},
+}
+
+var pathIDParam = apiParam{Name: "id", In: "path", Type: "integer", Required: true, Summary: "List id"}
+
+type loginRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	IsRememberMe bool   `json:"isRememberMe"`
+}
+
+type listsPage struct {
+	Entries  []listEntry  `json:"entries"`
+	Metadata pageMetadata `json:"_metadata"`
+}
+
+type expandedListsPage struct {
+	Entries  []expandedListEntry `json:"entries"`
+	Metadata pageMetadata        `json:"_metadata"`
+}
+
+type listOrder struct {
+	ID    int64 `json:"id"`
+	Order int   `json:"order"`
+}
+
+type recordsPage struct {
+	Entries  []Record      `json:"entries"`
+	Metadata *pageMetadata `json:"_metadata,omitempty"`
+}
+
+// recordsResult is listRecords with the entries typed for the schema.
+type recordsResult struct {
+	Entries  []Record      `json:"entries,omitempty"`
+	Metadata *pageMetadata `json:"_metadata,omitempty"`
+	Error    *errorDetail  `json:"error,omitempty"`
+}
+
+type matchesPage struct {
+	Entries []plateMatch `json:"entries"`
+}
+
+type auditPage struct {
+	Entries []auditEvent `json:"entries"`
+}
+
+type mutationsPage struct {
+	Entries  []mutationEvent `json:"entries"`
+	Metadata pageMetadata    `json:"_metadata"`
+}
+
+type usersPage struct {
+	Entries []userInfo `json:"entries"`
+}
+
+type sessionsPage struct {
+	Entries []sessionInfo `json:"entries"`
+}
+
+type recordQuery struct {
+	Projection map[string]interface{} `json:"projection"`
+}
+
+type reconcileRequest struct {
+	Plates []string `json:"plates"`
+}
+
+// apiOperations lists the endpoints registered in main.
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/login", Summary: "Log in and set the session cookies", Request: loginRequest{}, Status: http.StatusOK},
+	{Method: "POST", Path: "/refresh", Summary: "Renew the session token", Status: http.StatusOK},
+	{Method: "POST", Path: "/logout", Summary: "End the session", Status: http.StatusOK},
+	{Method: "GET", Path: "/metrics", Summary: "Server metrics", Status: http.StatusOK, Response: "text/plain"},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document", Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/meta/schema", Summary: "Schema versions of lists and records", Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/vehiclelists", Summary: "Page through the lists", Auth: authSession, Params: listsParams, Status: http.StatusOK, Response: listsPage{}},
+	{Method: "GET", Path: "/api/v2/vehiclelists", Summary: "Page through the lists with their records", Auth: authSession, Params: append([]apiParam{
+		{Name: "expand", In: "query", Type: "string", Summary: "records to embed the records of each list"},
+	}, listsParams...), Status: http.StatusOK, Response: expandedListsPage{}},
+	{Method: "HEAD", Path: "/api/v1/vehiclelists", Summary: "Count the lists in X-Total-Count", Auth: authSession, Status: http.StatusOK},
+	{Method: "POST", Path: "/api/v1/vehiclelists", Summary: "Create a list", Auth: authAdmin, Request: VehicleList{}, Status: http.StatusCreated, Response: VehicleList{}},
+	{Method: "PUT", Path: "/api/v1/vehiclelists", Summary: "Update a list", Auth: authAdmin, Params: []apiParam{listIDParam}, Request: VehicleList{}, Status: http.StatusOK, Response: VehicleList{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist", Summary: "Get a list", Auth: authSession, Params: []apiParam{listIDParam}, Status: http.StatusOK, Response: VehicleList{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist/by-name", Summary: "Get a list by its unique name", Auth: authSession, Params: []apiParam{{Name: "name", In: "query", Type: "string", Required: true}}, Status: http.StatusOK, Response: VehicleList{}},
+	{Method: "POST", Path: "/api/v1/vehiclelists/copy", Summary: "Copy a list with its records", Auth: authAdmin, Params: []apiParam{listIDParam}, Status: http.StatusCreated, Response: VehicleList{}},
+	{Method: "POST", Path: "/api/v1/vehiclelists/archive", Summary: "Archive a list", Auth: authAdmin, Params: []apiParam{listIDParam}, Status: http.StatusOK, Response: VehicleList{}},
+	{Method: "POST", Path: "/api/v1/vehiclelists/unarchive", Summary: "Unarchive a list", Auth: authAdmin, Params: []apiParam{listIDParam}, Status: http.StatusOK, Response: VehicleList{}},
+	{Method: "PUT", Path: "/api/v1/vehiclelists/order", Summary: "Reorder the lists", Auth: authAdmin, Request: []listOrder{}, Status: http.StatusOK},
+	{Method: "POST", Path: "/api/v1/vehiclelists/{id}/reconcile", Summary: "Reconcile a list with upstream plates", Auth: authSession, Params: []apiParam{pathIDParam}, Request: reconcileRequest{}, Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "POST", Path: "/api/v1/vehiclelists/{id}/share", Summary: "Create a read-only share link", Auth: authSession, Params: []apiParam{pathIDParam, {Name: "ttl", In: "query", Type: "string"}}, Status: http.StatusCreated, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/shared/{token}", Summary: "View a shared list", Params: []apiParam{{Name: "token", In: "path", Type: "string", Required: true}}, Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist/record", Summary: "List the records of a list", Auth: authSession, Params: []apiParam{
+		listIDParam,
+		{Name: "enrich", In: "query", Type: "boolean"},
+		{Name: "sort", In: "query", Type: "string", Summary: "id (default), plate or vehicleType"},
+		{Name: "dir", In: "query", Type: "string", Summary: "asc (default) or desc"},
+		{Name: "offset", In: "query", Type: "integer"},
+		{Name: "limit", In: "query", Type: "integer", Summary: "All records when neither offset nor limit is given"},
+		{Name: "cursor", In: "query", Type: "string", Summary: "nextCursor of the previous page, empty for the first; excludes offset"},
+	}, Status: http.StatusOK, Response: recordsPage{}},
+	{Method: "HEAD", Path: "/api/v1/vehiclelist/record", Summary: "Count the records of a list in X-Total-Count", Auth: authSession, Params: []apiParam{listIDParam}, Status: http.StatusOK},
+	{Method: "POST", Path: "/api/v1/vehiclelist/record", Summary: "Add a record", Auth: authAdmin, Params: []apiParam{listIDParam}, Request: Record{}, Status: http.StatusCreated, Response: Record{}},
+	{Method: "PUT", Path: "/api/v1/vehiclelist/record", Summary: "Update a record", Auth: authAdmin, Params: []apiParam{listIDParam, recordIDParam}, Request: Record{}, Status: http.StatusOK, Response: Record{}},
+	{Method: "PATCH", Path: "/api/v1/vehiclelist/record", Summary: "Update some fields of a record", Auth: authAdmin, Params: []apiParam{listIDParam, recordIDParam}, Request: map[string]interface{}{}, Status: http.StatusOK, Response: Record{}},
+	{Method: "DELETE", Path: "/api/v1/vehiclelist/record", Summary: "Delete a record", Auth: authAdmin, Params: []apiParam{listIDParam, recordIDParam}, Status: http.StatusOK},
+	{Method: "POST", Path: "/api/v1/vehiclelist/record/bulk", Summary: "Add records in bulk", Auth: authAdmin, Params: []apiParam{listIDParam, dryRunParam}, Request: []Record{}, Status: http.StatusOK, Response: bulkResult{}},
+	{Method: "POST", Path: "/api/v1/vehiclelist/record/import", Summary: "Import records from CSV", Auth: authAdmin, Params: []apiParam{listIDParam, dryRunParam}, Request: "text/csv", Status: http.StatusOK, Response: importResult{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist/record/export", Summary: "Export records as CSV or NDJSON", Auth: authSession, Params: []apiParam{listIDParam, {Name: "format", In: "query", Type: "string"}}, Status: http.StatusOK, Response: "text/csv"},
+	{Method: "POST", Path: "/api/v1/vehiclelist/record/delete", Summary: "Delete records in bulk", Auth: authAdmin, Params: []apiParam{listIDParam}, Request: []int64{}, Status: http.StatusOK, Response: bulkDeleteResult{}},
+	{Method: "DELETE", Path: "/api/v1/vehiclelist/record/all", Summary: "Delete every record of a list", Auth: authAdmin, Params: []apiParam{listIDParam}, Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "POST", Path: "/api/v1/vehiclelist/record/move", Summary: "Move a record to another list", Auth: authAdmin, Params: []apiParam{
+		{Name: "from", In: "query", Type: "integer", Required: true},
+		{Name: "to", In: "query", Type: "integer", Required: true},
+		recordIDParam,
+	}, Status: http.StatusOK, Response: Record{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist/record/audit", Summary: "Audit trail of a record", Auth: authSession, Params: []apiParam{listIDParam, recordIDParam}, Status: http.StatusOK, Response: auditPage{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist/record/stream", Summary: "Stream record changes as server-sent events", Auth: authSession, Params: []apiParam{listIDParam}, Status: http.StatusOK, Response: "text/event-stream"},
+	{Method: "GET", Path: "/api/v1/vehiclelist/record/check", Summary: "Check whether a plate is currently allowed", Auth: authSession, Params: []apiParam{
+		listIDParam,
+		{Name: "plate", In: "query", Type: "string", Required: true},
+	}, Status: http.StatusOK, Response: plateCheck{}},
+	{Method: "GET", Path: "/api/v1/vehiclelist/record/match", Summary: "Find records with a plate close to the given one", Auth: authSession, Params: []apiParam{
+		listIDParam,
+		{Name: "plate", In: "query", Type: "string", Required: true},
+		{Name: "maxDistance", In: "query", Type: "integer", Summary: "Edits allowed, 1 by default"},
+	}, Status: http.StatusOK, Response: matchesPage{}},
+	{Method: "POST", Path: "/api/v1/vehiclelist/record/query", Summary: "Query records with a projection", Auth: authSession, Params: []apiParam{listIDParam}, Request: recordQuery{}, Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/records", Summary: "Get the records of several lists", Auth: authSession, Params: []apiParam{
+		{Name: "ids", In: "query", Type: "string", Required: true, Summary: "Comma-separated list ids"},
+		{Name: "offset", In: "query", Type: "integer"},
+		{Name: "limit", In: "query", Type: "integer"},
+	}, Status: http.StatusOK, Response: map[string]recordsResult{}},
+	{Method: "GET", Path: "/api/v1/records/find", Summary: "Find a plate in every list", Auth: authSession, Params: []apiParam{
+		{Name: "plate", In: "query", Type: "string", Required: true},
+	}, Status: http.StatusOK, Response: []plateLocation{}},
+	{Method: "GET", Path: "/api/v1/access", Summary: "Decide whether a plate may pass a gate", Auth: authSession, Params: []apiParam{
+		{Name: "listId", In: "query", Type: "integer", Required: true},
+		{Name: "plate", In: "query", Type: "string", Required: true},
+	}, Status: http.StatusOK, Response: accessDecision{}},
+	{Method: "GET", Path: "/ws", Summary: "WebSocket for subscribing to list changes and adding or deleting records", Auth: authSession, Status: http.StatusSwitchingProtocols},
+	{Method: "GET", Path: "/api/v1/sessions", Summary: "List the sessions of the user", Auth: authSession, Status: http.StatusOK, Response: sessionsPage{}},
+	{Method: "DELETE", Path: "/api/v1/sessions", Summary: "Revoke a session", Auth: authSession, Params: []apiParam{{Name: "token", In: "query", Type: "string", Required: true}}, Status: http.StatusOK},
+	{Method: "GET", Path: "/api/v1/whoami", Summary: "Describe the caller and the expiry of their token", Auth: authSession, Status: http.StatusOK, Response: whoami{}},
+	{Method: "POST", Path: "/api/v1/password", Summary: "Change the password of the user", Auth: authSession, Request: passwordChange{}, Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/export/records", Summary: "Export all records", Auth: authAdmin, Status: http.StatusOK, Response: "application/x-ndjson"},
+	{Method: "POST", Path: "/api/v1/admin/backup", Summary: "Download a gob-encoded backup of all lists and records", Auth: authAdmin, Status: http.StatusOK, Response: "application/octet-stream"},
+	{Method: "POST", Path: "/api/v1/admin/restore", Summary: "Replace all lists and records with a backup", Auth: authAdmin, Request: "application/octet-stream", Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/admin/stats", Summary: "Count the lists, records and active tokens", Auth: authAdmin, Status: http.StatusOK, Response: storageStats{}},
+	{Method: "GET", Path: "/api/v1/users", Summary: "List the accounts and their roles", Auth: authAdmin, Status: http.StatusOK, Response: usersPage{}},
+	{Method: "GET", Path: "/api/v1/audit", Summary: "Page through the log of mutations", Auth: authAdmin, Params: []apiParam{
+		{Name: "offset", In: "query", Type: "integer"},
+		{Name: "limit", In: "query", Type: "integer"},
+		{Name: "userId", In: "query", Type: "integer"},
+		{Name: "listId", In: "query", Type: "integer"},
+	}, Status: http.StatusOK, Response: mutationsPage{}},
+	{Method: "POST", Path: "/api/v1/snapshots", Summary: "Take a snapshot", Auth: authAdmin, Params: []apiParam{{Name: "name", In: "query", Type: "string", Required: true}}, Status: http.StatusCreated, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/api/v1/snapshots/diff", Summary: "Compare two snapshots", Auth: authAdmin, Params: []apiParam{
+		{Name: "from", In: "query", Type: "string", Required: true},
+		{Name: "to", In: "query", Type: "string", Required: true},
+	}, Status: http.StatusOK, Response: snapshotDiff{}},
+}
+
+// openAPISpec returns the OpenAPI 3.0 document of apiOperations.
+func openAPISpec(baseURL string) map[string]interface{} {
+	schemas := map[string]interface{}{
+		"APIError": schemaOf(reflect.TypeOf(apiError{}), nil),
+	}
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary":   op.Summary,
+			"responses": operationResponses(op, schemas),
+		}
+		if len(op.Params) > 0 {
+			params := make([]interface{}, len(op.Params))
+			for i, p := range op.Params {
+				param := map[string]interface{}{
+					"name":     p.Name,
+					"in":       p.In,
+					"required": p.Required,
+					"schema":   map[string]interface{}{"type": p.Type},
+				}
+				if p.Summary != "" {
+					param["description"] = p.Summary
+				}
+				params[i] = param
+			}
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  mediaContent(op.Request, schemas),
+			}
+		}
+		switch op.Auth {
+		case authSession, authAdmin:
+			operation["security"] = []interface{}{
+				map[string]interface{}{"cookieAuth": []string{}},
+				map[string]interface{}{"bearerAuth": []string{}},
+				map[string]interface{}{"apiKeyAuth": []string{}},
+			}
+		default:
+			operation["security"] = []interface{}{}
+		}
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]interface{})
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "AMV vehicle lists API",
+			"version": "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": baseURL}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"cookieAuth": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": currentSettings().CookieName,
+					"description": "Session cookie set by /login. State-changing requests " +
+						"must echo the csrf cookie in the X-CSRF-Token header.",
+				},
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"apiKeyAuth": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// operationResponses describes the success response of op and the errors
+// it can answer with, all described by an APIError object.
+func operationResponses(op apiOperation, schemas map[string]interface{}) map[string]interface{} {
+	success := map[string]interface{}{"description": http.StatusText(op.Status)}
+	if op.Response != nil {
+		success["content"] = mediaContent(op.Response, schemas)
+	}
+	failure := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaRef("APIError")},
+			},
+		}
+	}
+	responses := map[string]interface{}{
+		strconv.Itoa(op.Status): success,
+		"default":               failure("Error message"),
+	}
+	if op.Request != nil {
+		if _, ok := op.Request.(string); !ok {
+			responses["400"] = failure("Invalid request body")
+		}
+	}
+	if op.Auth != authNone {
+		responses["401"] = failure("Missing or invalid session")
+	}
+	if op.Auth == authAdmin {
+		responses["403"] = failure("Session without the admin role")
+	}
+	return responses
+}
+
+func mediaContent(sample interface{}, schemas map[string]interface{}) map[string]interface{} {
+	if mediaType, ok := sample.(string); ok {
+		return map[string]interface{}{
+			mediaType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	}
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(sample), schemas)},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf derives the JSON schema of t from its json tags. Named structs
+// are added to schemas and referenced, anonymous ones are inlined; a nil
+// schemas inlines everything.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		return schemaOf(t.Elem(), schemas)
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" || schemas == nil {
+			return structSchema(t, schemas)
+		}
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // Guards against recursive types.
+			schemas[name] = structSchema(t, schemas)
+		}
+		return schemaRef(name)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	addStructProperties(t, schemas, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// addStructProperties adds the fields of t to properties, flattening
+// embedded structs the way encoding/json does.
+func addStructProperties(t reflect.Type, schemas map[string]interface{}, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructProperties(field.Type, schemas, properties)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[outputFieldName(t, name)] = schemaOf(field.Type, schemas)
+	}
+}
+
+// schemaName is the component name of a struct type, e.g. BulkResult for
+// bulkResult.
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// openAPIHandler serves the OpenAPI document of the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec(currentSettings().BaseURL + basePath))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Default retry policy of failed persistence writes.
+const (
+	defaultPersistRetries      = 5
+	defaultPersistRetryBackoff = time.Second
+	maxPersistRetryBackoff     = time.Minute
+)
+
+// persistedState is the part of storage written to disk.
+type persistedState struct {
+	Lists   map[int64]VehicleList `json:"lists"`
+	Records map[int64][]Record    `json:"records"`
+}
+
+// persister writes the lists and records after they change. Writes run in
+// the background and failed ones are retried with exponential backoff; the
+// in-memory storage stays authoritative meanwhile. Each attempt writes the
+// state as of that attempt, so changes made while a write is failing are
+// not lost either.
+type persister struct {
+	write   func(data []byte) error
+	retries int
+	backoff time.Duration
+	dirty   chan struct{}
+}
+
+// persist is nil unless persist_path is configured.
+var persist *persister
+
+func newPersister(write func([]byte) error, retries int, backoff time.Duration) *persister {
+	return &persister{
+		write:   write,
+		retries: retries,
+		backoff: backoff,
+		dirty:   make(chan struct{}, 1),
+	}
+}
+
+// MarkDirty schedules a write of the current state. Changes made before a
+// pending write starts are coalesced into it.
+func (p *persister) MarkDirty() {
+	select {
+	case p.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (p *persister) run() {
+	for range p.dirty {
+		p.flush()
+	}
+}
+
+// flush writes the current state, retrying failures. Once the retries are
+// exhausted it raises amv_persist_retries_exhausted_total and gives up until
+// the next change; it reports whether the state was written.
+func (p *persister) flush() bool {
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		err := p.writeState()
+		if err == nil {
+			if attempt > 0 {
+				log.Printf("Persisted storage after %d retries", attempt)
+			}
+			return true
+		}
+		countMetric("amv_persist_failures_total")
+		if attempt >= p.retries {
+			countMetric("amv_persist_retries_exhausted_total")
+			log.Printf("ALERT: failed to persist storage after %d retries, changes are only in memory: %v", attempt, err)
+			return false
+		}
+		log.Printf("Failed to persist storage, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxPersistRetryBackoff {
+			backoff = maxPersistRetryBackoff
+		}
+	}
+}
+
+func (p *persister) writeState() error {
+	storage.Lock()
+	data, err := json.Marshal(persistedState{Lists: storage.Lists, Records: storage.Records})
+	storage.Unlock()
+	if err != nil {
+		return err
+	}
+	return p.write(data)
+}
+
+// fileWriter returns a write function replacing the file at path
+// atomically, so a failed write never leaves a truncated file behind.
+func fileWriter(path string) func([]byte) error {
+	return func(data []byte) error {
+		tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), path)
+	}
+}
+
+// loadStorage restores the lists and records persisted at path. A missing
+// file leaves the storage empty.
+func loadStorage(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Files written with output_casing snake are read back in camelCase.
+	if data, err = renameKeys(data, camelCase, true); err != nil {
+		return err
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	storage.Lock()
+	defer storage.Unlock()
+	if state.Lists != nil {
+		storage.Lists = state.Lists
+	}
+	if state.Records != nil {
+		storage.Records = state.Records
+	}
+	reserveStoredIDs()
+	rebuildPlateIndex()
+	return nil
+}
+
+// seedStorage fills an empty storage with the lists and records of the JSON
+// file at path, which has the format of persist_path. A storage already
+// holding lists or records, e.g. restored from persist_path, is left alone.
+// It reports whether it seeded.
+func seedStorage(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if data, err = renameKeys(data, camelCase, true); err != nil {
+		return false, err
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, err
+	}
+	for listID, records := range state.Records {
+		for i := range records {
+			if errs := validateRecord(&records[i]); errs != nil {
+				return false, fmt.Errorf("list %d record %d: %v", listID, i, errs)
+			}
+		}
+	}
+
+	storage.Lock()
+	defer storage.Unlock()
+	if len(storage.Lists) > 0 || len(storage.Records) > 0 {
+		return false, nil
+	}
+	if state.Lists != nil {
+		storage.Lists = state.Lists
+	}
+	if state.Records != nil {
+		storage.Records = state.Records
+	}
+	for id := range storage.Lists {
+		if storage.Records[id] == nil {
+			storage.Records[id] = []Record{}
+		}
+	}
+	reserveStoredIDs()
+	now := time.Now()
+	for _, records := range storage.Records {
+		for i := range records {
+			if records[i].ID == 0 {
+				records[i].ID = ids.NextID()
+			}
+			if records[i].Version == 0 {
+				records[i].Version, records[i].UpdatedAt = 1, now
+			}
+		}
+	}
+	rebuildPlateIndex()
+	return true, nil
+}
+
+// persistMiddleware schedules a write after every successful state-changing
+// request.
+func persistMiddleware(p *persister, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if isStateChanging(r.Method) && rec.status < http.StatusBadRequest {
+			p.MarkDirty()
+		}
+	})
+}
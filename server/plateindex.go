@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+)
+
+// plateRef locates a record.
+type plateRef struct {
+	ListID   int64
+	RecordID int64
+}
+
+// plateIndex maps normalized plates to the records carrying them, so plate
+// lookups don't scan every list. It is guarded by the storage lock and must
+// follow every change of storage.Records.
+type plateIndex struct {
+	refs   map[string]map[plateRef]bool
+	plates map[plateRef]string // The indexed plate of each record
+}
+
+func newPlateIndex() *plateIndex {
+	return &plateIndex{
+		refs:   make(map[string]map[plateRef]bool),
+		plates: make(map[plateRef]string),
+	}
+}
+
+// add indexes a record of a list, replacing its previous plate.
+func (x *plateIndex) add(listID int64, rec Record) {
+	ref := plateRef{ListID: listID, RecordID: rec.ID}
+	x.remove(listID, rec.ID)
+	plate := normalizePlate(rec.Plate)
+	if x.refs[plate] == nil {
+		x.refs[plate] = make(map[plateRef]bool)
+	}
+	x.refs[plate][ref] = true
+	x.plates[ref] = plate
+}
+
+// remove drops a record from the index.
+func (x *plateIndex) remove(listID, recordID int64) {
+	ref := plateRef{ListID: listID, RecordID: recordID}
+	plate, ok := x.plates[ref]
+	if !ok {
+		return
+	}
+	delete(x.plates, ref)
+	delete(x.refs[plate], ref)
+	if len(x.refs[plate]) == 0 {
+		delete(x.refs, plate)
+	}
+}
+
+// lookup returns the records with a plate, ordered by list and record id.
+func (x *plateIndex) lookup(plate string) []plateRef {
+	found := make([]plateRef, 0, len(x.refs[normalizePlate(plate)]))
+	for ref := range x.refs[normalizePlate(plate)] {
+		found = append(found, ref)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].ListID != found[j].ListID {
+			return found[i].ListID < found[j].ListID
+		}
+		return found[i].RecordID < found[j].RecordID
+	})
+	return found
+}
+
+// inList reports whether a list has a record with the plate. The caller
+// must hold the storage lock.
+func (x *plateIndex) inList(plate string, listID int64) bool {
+	_, ok := x.recordIn(listID, plate)
+	return ok
+}
+
+// takenInList reports whether a list has a record other than recordID with
+// the plate, so that a record keeps its own plate on update. The caller
+// must hold the storage lock.
+func (x *plateIndex) takenInList(plate string, listID, recordID int64) bool {
+	for _, rec := range x.recordsIn(listID, plate) {
+		if rec.ID != recordID {
+			return true
+		}
+	}
+	return false
+}
+
+// recordIn returns the record of a list with the plate, the one with the
+// lowest id when a list holds the plate more than once. The caller must
+// hold the storage lock.
+func (x *plateIndex) recordIn(listID int64, plate string) (Record, bool) {
+	records := x.recordsIn(listID, plate)
+	if len(records) == 0 {
+		return Record{}, false
+	}
+	return records[0], true
+}
+
+// recordsIn returns the records of a list with the plate, ordered by id.
+// The caller must hold the storage lock.
+func (x *plateIndex) recordsIn(listID int64, plate string) []Record {
+	plate = normalizePlate(plate)
+	var records []Record
+	for ref := range x.refs[plate] {
+		if ref.ListID != listID {
+			continue
+		}
+		// Double check against the records, which are the source of truth.
+		if rec, ok := findRecord(ref.ListID, ref.RecordID); ok && normalizePlate(rec.Plate) == plate {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// rebuildPlateIndex indexes storage.Records from scratch, after they were
+// loaded or replaced. The caller must hold the storage lock.
+func rebuildPlateIndex() {
+	storage.plates = newPlateIndex()
+	for listID, records := range storage.Records {
+		for _, rec := range records {
+			storage.plates.add(listID, rec)
+		}
+	}
+}
+
+// findRecord returns a record of a list. The caller must hold the storage
+// lock.
+func findRecord(listID, recordID int64) (Record, bool) {
+	for _, rec := range storage.Records[listID] {
+		if rec.ID == recordID {
+			return rec, true
+		}
+	}
+	return Record{}, false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Roles of users. Viewers can read everything, admins can also change lists
+// and records and use the admin endpoints.
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
+
+// roleRank orders the roles, a role has the rights of all lower ones.
+var roleRank = map[string]int{
+	roleViewer: 0,
+	roleAdmin:  1,
+}
+
+// userRole returns the role of a user: the one given in roles, admin for
+// admin_users, and default_role otherwise.
+func userRole(username string) string {
+	cfg := currentSettings()
+	if role, ok := cfg.Roles[username]; ok {
+		return role
+	}
+	if containsString(cfg.AdminUsers, username) {
+		return roleAdmin
+	}
+	return cfg.DefaultRole
+}
+
+// hasRole reports whether a session has at least role.
+func hasRole(session Session, role string) bool {
+	rank, ok := roleRank[session.Role]
+	return ok && rank >= roleRank[role]
+}
+
+// requireRole only lets sessions with at least role through.
+func requireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := contextSession(r.Context())
+		if !ok || !hasRole(session, role) {
+			writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminWrites requires the admin role for state-changing requests and
+// leaves reads open to every authenticated user.
+func adminWrites(next http.Handler) http.Handler {
+	admin := requireRole(roleAdmin, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStateChanging(r.Method) {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// schemaFields lists, per schema version, the JSON fields each kind of
+// entity gained in that version. A client announcing version n through the
+// X-Schema-Version header only receives the fields of versions 1 to n, so
+// fields added later don't break older clients. New fields go into a new
+// version appended here.
+var schemaFields = []map[string][]string{
+	1: {
+		"record": {"id", "plate", "vehicleType"},
+		"list":   {"id", "displayName", "name", "color", "order", "status"},
+	},
+	2: {
+		"list": {"owner"},
+	},
+	3: {
+		"record": {"tags"},
+	},
+	4: {
+		"record": {"derived"},
+	},
+	5: {
+		"list": {"recordCount"},
+	},
+	6: {
+		"list": {"archived"},
+	},
+	7: {
+		"record": {"version"},
+	},
+	8: {
+		"record": {"updatedAt"},
+		"list":   {"updatedAt"},
+	},
+	9: {
+		"list": {"records"},
+	},
+	10: {
+		"record": {"expiresAt"},
+	},
+	11: {
+		"record": {"validFrom", "validUntil"},
+	},
+}
+
+// latestSchemaVersion is served to clients that don't ask for a version.
+var latestSchemaVersion = len(schemaFields) - 1
+
+// requestSchemaVersion reads the X-Schema-Version header.
+func requestSchemaVersion(r *http.Request) (int, error) {
+	header := r.Header.Get("X-Schema-Version")
+	if header == "" {
+		return latestSchemaVersion, nil
+	}
+	version, err := strconv.Atoi(header)
+	if err != nil || version < 1 || version > latestSchemaVersion {
+		return 0, fmt.Errorf("Unsupported X-Schema-Version %q", header)
+	}
+	return version, nil
+}
+
+// schemaEntries reduces entries of the given kind to the fields known in
+// the schema version. The latest version is returned as is.
+func schemaEntries(version int, kind string, entries interface{}) interface{} {
+	if version >= latestSchemaVersion {
+		return entries
+	}
+	allowed := make(map[string]interface{})
+	for v := 1; v <= version; v++ {
+		for _, field := range schemaFields[v][kind] {
+			allowed[outputKey(field)] = true
+		}
+	}
+	return project(toGeneric(entries), allowed)
+}
+
+// toGeneric converts v to its generic JSON form, so that it can be
+// inspected by JSON field name.
+func toGeneric(v interface{}) interface{} {
+	var generic interface{}
+	data, _ := json.Marshal(v)
+	json.Unmarshal(data, &generic)
+	return generic
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sessionInfo describes an active session without revealing its token.
+type sessionInfo struct {
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	UserAgent string    `json:"userAgent"`
+	Current   bool      `json:"current"`
+}
+
+// sessionsHandler lists (GET) or revokes (DELETE) the caller's sessions.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleGetSessions(w, r)
+	case http.MethodDelete:
+		handleDeleteSession(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
+
+func handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := contextSession(r.Context())
+	current, _ := requestToken(r)
+	now := time.Now()
+
+	sessions := []sessionInfo{}
+	storage.Lock()
+	for token, session := range storage.Tokens {
+		if session.ID != caller.ID || now.After(session.Expiry) {
+			continue
+		}
+		sessions = append(sessions, sessionInfo{
+			Token:     maskToken(token),
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.Expiry,
+			UserAgent: session.UserAgent,
+			Current:   token == current,
+		})
+	}
+	storage.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	response := map[string]interface{}{
+		"entries": sessions,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleDeleteSession revokes one of the caller's sessions. The token
+// parameter is either the full token or its masked form from the listing.
+func handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	caller, _ := contextSession(r.Context())
+	target := r.URL.Query().Get("token")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing token parameter")
+		return
+	}
+
+	storage.Lock()
+	defer storage.Unlock()
+	for token, session := range storage.Tokens {
+		if session.ID == caller.ID && (token == target || maskToken(token) == target) {
+			revokeToken(token)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "not_found", "Session not found")
+}
+
+// whoami describes the caller. API keys don't expire, so their callers get
+// no expiry.
+type whoami struct {
+	UserID    int64      `json:"userId"`
+	User      string     `json:"user"`
+	Role      string     `json:"role"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ExpiresIn *int64     `json:"expiresIn,omitempty"` // Seconds left
+}
+
+// whoamiHandler tells the caller who they are authenticated as and when
+// their token expires, so clients know when to refresh it.
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := contextSession(r.Context())
+	info := whoami{UserID: session.ID, User: session.User, Role: session.Role}
+	if !session.Expiry.IsZero() {
+		ttl := int64(time.Until(session.Expiry).Seconds())
+		info.ExpiresAt, info.ExpiresIn = &session.Expiry, &ttl
+	}
+	writeEncoded(w, r, info)
+}
+
+// maskToken hides all but the last characters of a token.
+func maskToken(token string) string {
+	const visible = 6
+	if len(token) <= visible {
+		return "****"
+	}
+	return "****" + token[len(token)-visible:]
+}
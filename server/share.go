@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Share grants anonymous read-only access to the records of one list.
+type Share struct {
+	ListID int64     `json:"listId"`
+	Expiry time.Time `json:"expiresAt"`
+}
+
+// shareKey signs share tokens. It is regenerated on every start, which
+// invalidates outstanding links together with the in-memory share store.
+var shareKey = randomBytes(32)
+
+// shareHandler issues a share token for the list in the path. The optional
+// ttl query parameter sets its lifetime (default 24h).
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid id parameter")
+		return
+	}
+	if !requestListAllowed(r, id) {
+		writeError(w, http.StatusForbidden, "forbidden", "Forbidden")
+		return
+	}
+	ttl := 24 * time.Hour
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid ttl parameter")
+			return
+		}
+	}
+
+	storage.Lock()
+	_, exists := storage.Lists[id]
+	storage.Unlock()
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+
+	token, share := newShare(id, ttl)
+	response := map[string]interface{}{
+		"token":     token,
+		"url":       currentSettings().BaseURL + basePath + "/shared/" + token,
+		"expiresAt": share.Expiry,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// sharedHandler serves the records of a shared list without a session.
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := lookupShare(r.PathValue("token"))
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	storage.Lock()
+	records, exists := storage.Records[share.ListID]
+	records = activeRecords(records, time.Now())
+	storage.Unlock()
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+
+	response := map[string]interface{}{
+		"entries": records,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// newShare stores and returns a signed token for the list valid for ttl.
+func newShare(listID int64, ttl time.Duration) (string, Share) {
+	share := Share{ListID: listID, Expiry: time.Now().Add(ttl)}
+	payload := fmt.Sprintf("%d.%d.%s", listID, share.Expiry.Unix(), hex.EncodeToString(randomBytes(8)))
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signShare(payload)
+
+	storage.Lock()
+	storage.Shares[token] = share
+	storage.Unlock()
+	return token, share
+}
+
+// lookupShare verifies the token signature and returns its share if it is
+// known and not expired.
+func lookupShare(token string) (Share, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Share{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(signShare(string(payload)))) {
+		return Share{}, false
+	}
+
+	storage.Lock()
+	share, exists := storage.Shares[token]
+	storage.Unlock()
+	if !exists || time.Now().After(share.Expiry) {
+		return Share{}, false
+	}
+	return share, true
+}
+
+func signShare(payload string) string {
+	mac := hmac.New(sha256.New, shareKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSnapshots bounds the number of snapshots kept; capturing one more
+// drops the oldest.
+const maxSnapshots = 10
+
+// snapshot is a copy of the lists and records taken at one point in time.
+type snapshot struct {
+	Name      string
+	CreatedAt time.Time
+	Lists     map[int64]VehicleList
+	Records   map[int64][]Record
+}
+
+var (
+	snapshotsMu sync.Mutex
+	snapshots   []snapshot
+)
+
+// snapshotChange is an entity present in both snapshots with different
+// values.
+type snapshotChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// entityDiff reports how one kind of entity differs between two snapshots.
+type entityDiff struct {
+	Added   []interface{}    `json:"added"`
+	Removed []interface{}    `json:"removed"`
+	Changed []snapshotChange `json:"changed"`
+}
+
+// snapshotDiff is the response of the snapshot diff endpoint.
+type snapshotDiff struct {
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	Lists   entityDiff `json:"lists"`
+	Records entityDiff `json:"records"`
+}
+
+// snapshotsHandler captures a snapshot of the current storage under the
+// name parameter. Capturing an existing name replaces that snapshot.
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing name parameter")
+		return
+	}
+	snap := captureSnapshot(name, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":      snap.Name,
+		"createdAt": snap.CreatedAt,
+		"lists":     len(snap.Lists),
+		"records":   countRecords(snap.Records),
+	})
+}
+
+// snapshotDiffHandler reports the lists and records added, removed and
+// changed between the snapshots named by the from and to parameters.
+func snapshotDiffHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, ok := findSnapshot(query.Get("from"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Snapshot not found")
+		return
+	}
+	to, ok := findSnapshot(query.Get("to"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Snapshot not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffSnapshots(from, to))
+}
+
+// captureSnapshot copies the current storage and keeps it under name.
+func captureSnapshot(name string, now time.Time) snapshot {
+	snap := snapshot{
+		Name:      name,
+		CreatedAt: now,
+		Lists:     make(map[int64]VehicleList),
+		Records:   make(map[int64][]Record),
+	}
+	storage.Lock()
+	for id, list := range storage.Lists {
+		snap.Lists[id] = list
+	}
+	for id, records := range storage.Records {
+		copied := make([]Record, len(records))
+		for i, rec := range records {
+			rec.Tags = append([]string(nil), rec.Tags...)
+			copied[i] = rec
+		}
+		snap.Records[id] = copied
+	}
+	storage.Unlock()
+
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	for i, s := range snapshots {
+		if s.Name == name {
+			snapshots = append(snapshots[:i], snapshots[i+1:]...)
+			break
+		}
+	}
+	snapshots = append(snapshots, snap)
+	if len(snapshots) > maxSnapshots {
+		snapshots = snapshots[len(snapshots)-maxSnapshots:]
+	}
+	return snap
+}
+
+func findSnapshot(name string) (snapshot, bool) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	for _, s := range snapshots {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return snapshot{}, false
+}
+
+func diffSnapshots(from, to snapshot) snapshotDiff {
+	return snapshotDiff{
+		From:    from.Name,
+		To:      to.Name,
+		Lists:   diffEntities(snapshotLists(from), snapshotLists(to)),
+		Records: diffEntities(snapshotRecords(from), snapshotRecords(to)),
+	}
+}
+
+func snapshotLists(s snapshot) map[string]interface{} {
+	entities := make(map[string]interface{}, len(s.Lists))
+	for id, list := range s.Lists {
+		entities[fmt.Sprint(id)] = list
+	}
+	return entities
+}
+
+// snapshotRecords keys the records by list id, record id and occurrence,
+// since record ids are not guaranteed to be unique within a list.
+func snapshotRecords(s snapshot) map[string]interface{} {
+	entities := make(map[string]interface{})
+	for id, records := range s.Records {
+		seen := make(map[int64]int)
+		for _, rec := range records {
+			key := fmt.Sprintf("%d/%d/%d", id, rec.ID, seen[rec.ID])
+			seen[rec.ID]++
+			entities[key] = exportedRecord{ListID: id, Record: rec}
+		}
+	}
+	return entities
+}
+
+// diffEntities compares two sets of entities by key. The result is ordered
+// by key so that diffs of the same snapshots are identical.
+func diffEntities(from, to map[string]interface{}) entityDiff {
+	diff := entityDiff{
+		Added:   []interface{}{},
+		Removed: []interface{}{},
+		Changed: []snapshotChange{},
+	}
+	keys := make([]string, 0, len(from)+len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, exists := from[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		before, inFrom := from[key]
+		after, inTo := to[key]
+		switch {
+		case !inFrom:
+			diff.Added = append(diff.Added, after)
+		case !inTo:
+			diff.Removed = append(diff.Removed, before)
+		case !reflect.DeepEqual(before, after):
+			diff.Changed = append(diff.Changed, snapshotChange{Before: before, After: after})
+		}
+	}
+	return diff
+}
+
+func countRecords(records map[int64][]Record) int {
+	n := 0
+	for _, list := range records {
+		n += len(list)
+	}
+	return n
+}
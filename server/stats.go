@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// storageStats is a summary of the storage for quick inspection, without a
+// Prometheus scraper.
+type storageStats struct {
+	Lists          int           `json:"lists"`
+	TotalRecords   int           `json:"totalRecords"`
+	ActiveTokens   int           `json:"activeTokens"`
+	RecordsPerList map[int64]int `json:"recordsPerList"`
+	MemoryBytes    uint64        `json:"memoryBytes"` // Heap in use by the process
+}
+
+// statsHandler returns the storageStats. Like the record counts of the list
+// endpoints, expired records are not counted. Counting takes a single pass
+// under the lock, which the storage only has as a plain mutex; the pass is
+// short and the memory is read after releasing it.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	stats := storageStats{RecordsPerList: make(map[int64]int)}
+	storage.Lock()
+	stats.Lists = len(storage.Lists)
+	for id, records := range storage.Records {
+		count := activeCount(records, now)
+		stats.RecordsPerList[id] = count
+		stats.TotalRecords += count
+	}
+	for _, session := range storage.Tokens {
+		if now.Before(session.Expiry) {
+			stats.ActiveTokens++
+		}
+	}
+	storage.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.MemoryBytes = mem.HeapAlloc
+	writeEncoded(w, r, stats)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tuning of record change streams.
+const (
+	streamBufferSize  = 64
+	streamKeepAlive   = 30 * time.Second
+	streamRetryMillis = 3000
+)
+
+// changeHub fans record events out to the subscribers of their list.
+type changeHub struct {
+	sync.Mutex
+	subscribers map[int64]map[chan recordEvent]struct{}
+}
+
+var changes = &changeHub{subscribers: make(map[int64]map[chan recordEvent]struct{})}
+
+// Subscribe returns a channel receiving the events of a list, and a
+// function ending the subscription.
+func (h *changeHub) Subscribe(listID int64) (<-chan recordEvent, func()) {
+	ch := make(chan recordEvent, streamBufferSize)
+	h.Lock()
+	if h.subscribers[listID] == nil {
+		h.subscribers[listID] = make(map[chan recordEvent]struct{})
+	}
+	h.subscribers[listID][ch] = struct{}{}
+	h.Unlock()
+	return ch, func() {
+		h.Lock()
+		delete(h.subscribers[listID], ch)
+		if len(h.subscribers[listID]) == 0 {
+			delete(h.subscribers, listID)
+		}
+		h.Unlock()
+	}
+}
+
+// Publish sends an event to the subscribers of its list. A subscriber too
+// slow to keep up misses the event rather than blocking the publisher.
+func (h *changeHub) Publish(event recordEvent) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subscribers[event.ListID] {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropped %s event of list %d for a slow stream subscriber", event.Type, event.ListID)
+		}
+	}
+}
+
+// subscriberCount returns the number of subscribers of a list.
+func (h *changeHub) subscriberCount(listID int64) int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subscribers[listID])
+}
+
+// recordStreamHandler streams the record changes of a list as server-sent
+// events until the client disconnects. Each event is named after the
+// change, create, update or delete, and carries a recordEvent.
+func recordStreamHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := contextID(r.Context())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing list id")
+		return
+	}
+	storage.Lock()
+	_, isList := storage.Lists[id]
+	storage.Unlock()
+	if !isList {
+		writeError(w, http.StatusNotFound, "not_found", "List not found")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+	events, unsubscribe := changes.Subscribe(id)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryMillis)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
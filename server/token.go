@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compactPrefix marks compact tokens, telling them apart from JWTs.
+const compactPrefix = "c1."
+
+// Layout of a compact token payload: user id, expiry and issue time as
+// big-endian Unix seconds, token id, fingerprint and CSRF token as raw
+// bytes, then the username. An HMAC-SHA256 of the payload follows it.
+const (
+	compactIDLen     = 16
+	compactHeaderLen = 3*8 + 3*compactIDLen
+)
+
+// generateCompactToken returns a signed binary token for the session. It
+// carries the same claims as a JWT in about half the size, which
+// matters for clients sending it on every request.
+func generateCompactToken(session Session) string {
+	payload := make([]byte, compactHeaderLen, compactHeaderLen+len(session.User)+sha256.Size)
+	binary.BigEndian.PutUint64(payload[0:], uint64(session.ID))
+	binary.BigEndian.PutUint64(payload[8:], uint64(session.Expiry.Unix()))
+	binary.BigEndian.PutUint64(payload[16:], uint64(time.Now().Unix()))
+	copy(payload[24:], randomBytes(compactIDLen))
+	putHexField(payload[24+compactIDLen:], session.Fingerprint)
+	putHexField(payload[24+2*compactIDLen:], session.CSRF)
+	payload = append(payload, session.User...)
+	payload = append(payload, signCompact(payload)...)
+	return compactPrefix + base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// parseCompactToken verifies a compact token and returns its claims.
+func parseCompactToken(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, compactPrefix))
+	if err != nil || len(data) < compactHeaderLen+sha256.Size {
+		return claims, errInvalidToken
+	}
+	payload, mac := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if !hmac.Equal(mac, signCompact(payload)) {
+		return claims, errInvalidToken
+	}
+	claims.Subject = strconv.FormatInt(int64(binary.BigEndian.Uint64(payload[0:])), 10)
+	claims.ExpiresAt = int64(binary.BigEndian.Uint64(payload[8:]))
+	claims.IssuedAt = int64(binary.BigEndian.Uint64(payload[16:]))
+	claims.ID = base64.RawURLEncoding.EncodeToString(payload[24 : 24+compactIDLen])
+	claims.Fingerprint = hexField(payload[24+compactIDLen : 24+2*compactIDLen])
+	claims.CSRF = hexField(payload[24+2*compactIDLen : compactHeaderLen])
+	claims.User = string(payload[compactHeaderLen:])
+	return claims, nil
+}
+
+// putHexField stores a hex encoded field of the session in dst. Values
+// that are not 16 hex encoded bytes, such as an unset one, are left zero.
+func putHexField(dst []byte, value string) {
+	if b, err := hex.DecodeString(value); err == nil && len(b) == compactIDLen {
+		copy(dst, b)
+	}
+}
+
+// hexField is the inverse of putHexField.
+func hexField(b []byte) string {
+	if bytes.Equal(b, make([]byte, len(b))) {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func signCompact(payload []byte) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(compactPrefix))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
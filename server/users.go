@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ServiceAccount is an account of the users config. Its password is hashed
+// at startup and never kept in storage.
+type ServiceAccount struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+}
+
+// User is an account that logs in with a password. Role overrides the role
+// userRole gives Username when set.
+type User struct {
+	Username     string
+	PasswordHash []byte
+	Role         string
+}
+
+// bcryptCost is the cost of password hashes. Tests lower it.
+var bcryptCost = bcrypt.DefaultCost
+
+// dummyHash is compared against for unknown usernames, so that they take
+// as long to reject as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// seedUsers replaces the users with the configured service accounts.
+func seedUsers(accounts []ServiceAccount) error {
+	users := make(map[string]User, len(accounts))
+	for _, account := range accounts {
+		hash, err := bcrypt.GenerateFromPassword([]byte(account.Password), bcryptCost)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", account.Username, err)
+		}
+		users[account.Username] = User{Username: account.Username, PasswordHash: hash, Role: account.Role}
+	}
+	storage.Lock()
+	storage.Users = users
+	storage.Unlock()
+	return nil
+}
+
+// authenticateUser checks a username and password and returns the role of
+// the user. Without any users configured every login is accepted, as
+// before accounts existed, except for admins: anyone could claim their
+// names.
+func authenticateUser(username, password string) (string, bool) {
+	storage.Lock()
+	user, ok := storage.Users[username]
+	open := len(storage.Users) == 0
+	storage.Unlock()
+	if open {
+		role := accountRole(username)
+		return role, role != roleAdmin
+	}
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", false
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return "", false
+	}
+	return accountRole(username), true
+}
+
+// accountRole returns the role of a user: the role of its account if it
+// has one, otherwise the role userRole gives it. Every path deriving a role
+// from a username goes through it, so accounts keep their role.
+func accountRole(username string) string {
+	storage.Lock()
+	user := storage.Users[username]
+	storage.Unlock()
+	if user.Role != "" {
+		return user.Role
+	}
+	return userRole(username)
+}
+
+// loginFailures counts the consecutive failed logins of a username.
+type loginFailures struct {
+	Count       int
+	Expiry      time.Time // When the count is forgotten
+	LockedUntil time.Time
+}
+
+// accountLocked reports whether logins of a username are refused at now and
+// until when.
+func accountLocked(username string, now time.Time) (time.Time, bool) {
+	storage.Lock()
+	defer storage.Unlock()
+	failures := storage.LoginFailures[username]
+	return failures.LockedUntil, now.Before(failures.LockedUntil)
+}
+
+// writeAccountLocked refuses a request of an account locked until until.
+func writeAccountLocked(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	writeError(w, http.StatusLocked, "locked", "Account locked after repeated failed logins")
+}
+
+// recordLoginFailure counts a failed login of a username at now and locks
+// it once lockout_threshold failures follow each other. Unknown usernames
+// are counted too, so that lockouts don't reveal which accounts exist.
+func recordLoginFailure(username string, now time.Time) {
+	s := currentSettings()
+	storage.Lock()
+	defer storage.Unlock()
+	failures := storage.LoginFailures[username]
+	if now.After(failures.Expiry) {
+		failures.Count = 0
+	}
+	failures.Count++
+	failures.Expiry = now.Add(s.LockoutDuration)
+	if failures.Count >= s.LockoutThreshold {
+		failures.Count = 0
+		failures.LockedUntil = now.Add(s.LockoutDuration)
+	}
+	storage.LoginFailures[username] = failures
+}
+
+// resetLoginFailures forgets the failed logins of a username after it
+// logged in.
+func resetLoginFailures(username string) {
+	storage.Lock()
+	delete(storage.LoginFailures, username)
+	storage.Unlock()
+}
+
+// userInfo is a user as listed by usersHandler.
+type userInfo struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// usersHandler lists the usernames and roles of the accounts, ordered by
+// username. Password hashes are never returned.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	storage.Lock()
+	users := make([]userInfo, 0, len(storage.Users))
+	for _, user := range storage.Users {
+		users = append(users, userInfo{Username: user.Username})
+	}
+	storage.Unlock()
+
+	for i := range users {
+		users[i].Role = accountRole(users[i].Username)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	writeEncoded(w, r, map[string]interface{}{"entries": users})
+}
+
+// maxPasswordLength is the longest password bcrypt can hash, in bytes.
+const maxPasswordLength = 72
+
+// passwordChange is the body of a password change. RevokeOtherSessions logs
+// out every other session of the user.
+type passwordChange struct {
+	CurrentPassword     string `json:"currentPassword"`
+	NewPassword         string `json:"newPassword"`
+	RevokeOtherSessions bool   `json:"revokeOtherSessions"`
+}
+
+// checkPasswordPolicy rejects passwords shorter than min_password_length or
+// mixing fewer than min_password_classes character classes.
+func checkPasswordPolicy(password string, s *settings) *fieldError {
+	if len(password) > maxPasswordLength {
+		return &fieldError{Message: fmt.Sprintf("newPassword may not exceed %d bytes", maxPasswordLength), Field: "newPassword"}
+	}
+	if len([]rune(password)) < s.MinPasswordLength {
+		return &fieldError{Message: fmt.Sprintf("newPassword must be at least %d characters", s.MinPasswordLength), Field: "newPassword"}
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < s.MinPasswordClasses {
+		return &fieldError{Message: fmt.Sprintf("newPassword must mix at least %d of lowercase letters, uppercase letters, digits and other characters", s.MinPasswordClasses), Field: "newPassword"}
+	}
+	return nil
+}
+
+// passwordHandler changes the password of the caller's account. Wrong
+// current passwords count towards the lockout like failed logins, so a
+// stolen session can't be used to guess the password. Changed passwords
+// are kept in memory only: a restart restores the configured ones.
+// Stateless tokens are not tracked and so survive RevokeOtherSessions until
+// they expire.
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+	var change passwordChange
+	if err := decodeJSON(r, &change); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	if change.CurrentPassword == "" {
+		writeFieldError(w, &fieldError{Message: "currentPassword required", Field: "currentPassword"})
+		return
+	}
+	if err := checkPasswordPolicy(change.NewPassword, currentSettings()); err != nil {
+		writeFieldError(w, err)
+		return
+	}
+	if change.NewPassword == change.CurrentPassword {
+		writeFieldError(w, &fieldError{Message: "newPassword must differ from currentPassword", Field: "newPassword"})
+		return
+	}
+
+	session, _ := contextSession(r.Context())
+	storage.Lock()
+	user, ok := storage.Users[session.User]
+	storage.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Account not found")
+		return
+	}
+	if until, locked := accountLocked(user.Username, time.Now()); locked {
+		writeAccountLocked(w, until)
+		return
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(change.CurrentPassword)) != nil {
+		recordLoginFailure(user.Username, time.Now())
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid current password")
+		return
+	}
+	resetLoginFailures(user.Username)
+	hash, err := bcrypt.GenerateFromPassword([]byte(change.NewPassword), bcryptCost)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "Failed to hash password")
+		return
+	}
+
+	revoked := 0
+	current, _ := requestToken(r)
+	storage.Lock()
+	user.PasswordHash = hash
+	storage.Users[user.Username] = user
+	if change.RevokeOtherSessions {
+		for token, other := range storage.Tokens {
+			if other.ID == session.ID && token != current {
+				revokeToken(token)
+				revoked++
+			}
+		}
+	}
+	storage.Unlock()
+
+	writeEncoded(w, r, map[string]interface{}{"revokedSessions": revoked})
+}
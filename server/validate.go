@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Payload structs declare their static rules in validate tags, e.g.
+// `validate:"required,max=16"`. The rules, separated by commas, are:
+//
+//	required   the field may not be empty
+//	min=N      a non-empty string has at least N characters
+//	max=N      a string has at most N characters
+//	pattern=RE a non-empty string matches RE, which may not contain commas
+//	enum=A|B   a non-empty string is one of the alternatives
+//
+// Rules depending on the config, such as max_plate_length, are checked by
+// validateRecord and validateList instead.
+
+// fieldErrors are all the violations found in a payload.
+type fieldErrors []*fieldError
+
+func (e fieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// fieldRule is a validate tag compiled for one struct field.
+type fieldRule struct {
+	index    int
+	name     string // JSON name of the field
+	required bool
+	min, max int // Zero is unbounded
+	pattern  *regexp.Regexp
+	enum     []string
+}
+
+// fieldRules caches the compiled rules of each struct type.
+var fieldRules sync.Map // reflect.Type to []fieldRule
+
+// rulesOf compiles the validate tags of a struct type. Malformed tags are
+// programming errors and panic.
+func rulesOf(t reflect.Type) []fieldRule {
+	if cached, ok := fieldRules.Load(t); ok {
+		return cached.([]fieldRule)
+	}
+	var rules []fieldRule
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+		rule := fieldRule{index: i, name: field.Name}
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+			rule.name = name
+		}
+		for _, part := range strings.Split(tag, ",") {
+			key, value, _ := strings.Cut(part, "=")
+			var err error
+			switch key {
+			case "required":
+				rule.required = true
+			case "min":
+				rule.min, err = strconv.Atoi(value)
+			case "max":
+				rule.max, err = strconv.Atoi(value)
+			case "pattern":
+				rule.pattern, err = regexp.Compile(value)
+			case "enum":
+				rule.enum = strings.Split(value, "|")
+			default:
+				err = fmt.Errorf("unknown rule %q", key)
+			}
+			if err != nil {
+				panic(fmt.Sprintf("validate tag of %s.%s: %v", t.Name(), field.Name, err))
+			}
+		}
+		rules = append(rules, rule)
+	}
+	fieldRules.Store(t, rules)
+	return rules
+}
+
+// validateStruct checks v, a pointer to a struct, against its validate tags
+// and returns every violation, at most one per field.
+func validateStruct(v interface{}) fieldErrors {
+	value := reflect.ValueOf(v).Elem()
+	var errs fieldErrors
+	for _, rule := range rulesOf(value.Type()) {
+		if err := rule.check(value.Field(rule.index)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (rule fieldRule) check(value reflect.Value) *fieldError {
+	if value.IsZero() || (value.Kind() == reflect.Slice && value.Len() == 0) {
+		if rule.required {
+			return &fieldError{Message: rule.name + " is required", Field: rule.name}
+		}
+		return nil
+	}
+	if value.Kind() != reflect.String {
+		return nil
+	}
+	s := value.String()
+	n := utf8.RuneCountInString(s)
+	switch {
+	case rule.min > 0 && n < rule.min:
+		return &fieldError{Message: fmt.Sprintf("%s is shorter than %d characters", rule.name, rule.min), Field: rule.name}
+	case rule.max > 0 && n > rule.max:
+		return &fieldError{Message: fmt.Sprintf("%s is longer than %d characters", rule.name, rule.max), Field: rule.name}
+	case rule.pattern != nil && !rule.pattern.MatchString(s):
+		return &fieldError{Message: fmt.Sprintf("%s does not match %s", rule.name, rule.pattern), Field: rule.name}
+	case rule.enum != nil && !containsString(rule.enum, s):
+		return &fieldError{Message: fmt.Sprintf("%s must be one of %s", rule.name, strings.Join(rule.enum, ", ")), Field: rule.name}
+	}
+	return nil
+}
+
+// writeFieldErrors sends the violations found in a payload as a 400 apiError
+// listing each of them.
+func writeFieldErrors(w http.ResponseWriter, errs fieldErrors) {
+	writeAPIError(w, http.StatusBadRequest, apiError{Error: errorDetail{Code: "invalid", Message: errs.Error(), Fields: errs}})
+}
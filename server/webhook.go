@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Delivery policy of the record webhook.
+const (
+	webhookQueueSize       = 256
+	webhookRetries         = 5
+	webhookRetryBackoff    = time.Second
+	maxWebhookRetryBackoff = time.Minute
+)
+
+// recordEvent is posted to the webhook when a record is created, updated
+// or deleted. Type is the audit action.
+type recordEvent struct {
+	Type   string `json:"type"`
+	ListID int64  `json:"listId"`
+	Record Record `json:"record"`
+}
+
+// webhook posts record events to a URL from a background goroutine, in the
+// order they happened. Failed deliveries are retried with exponential
+// backoff and dropped with a log line once the retries are exhausted, so
+// a slow or failing receiver never holds up a request.
+type webhook struct {
+	url     string
+	client  *http.Client
+	events  chan recordEvent
+	retries int
+	backoff time.Duration
+}
+
+// recordWebhook is nil unless webhook_url is configured.
+var recordWebhook *webhook
+
+func newWebhook(url string) *webhook {
+	return &webhook{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		events:  make(chan recordEvent, webhookQueueSize),
+		retries: webhookRetries,
+		backoff: webhookRetryBackoff,
+	}
+}
+
+// Send queues an event for delivery. When the queue is full the event is
+// dropped rather than blocking the caller.
+func (h *webhook) Send(event recordEvent) {
+	select {
+	case h.events <- event:
+	default:
+		log.Printf("Webhook queue full, dropped %s event of record %d in list %d", event.Type, event.Record.ID, event.ListID)
+	}
+}
+
+func (h *webhook) run() {
+	for event := range h.events {
+		h.deliver(event)
+	}
+}
+
+// deliver posts one event, retrying failures. It reports whether the event
+// was accepted.
+func (h *webhook) deliver(event recordEvent) bool {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Webhook failed to encode event: %v", err)
+		return false
+	}
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		err := h.post(body)
+		if err == nil {
+			return true
+		}
+		if attempt >= h.retries {
+			log.Printf("Webhook dropped %s event of record %d in list %d after %d retries: %v", event.Type, event.Record.ID, event.ListID, attempt, err)
+			return false
+		}
+		log.Printf("Webhook failed, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxWebhookRetryBackoff {
+			backoff = maxWebhookRetryBackoff
+		}
+	}
+}
+
+func (h *webhook) post(body []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timing of WebSocket connections. Clients answer pings automatically, a
+// connection silent for longer than wsPongWait is considered gone.
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxMessage = 64 << 10
+)
+
+// Commands a WebSocket client can send.
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsAdd         = "add"
+	wsDelete      = "delete"
+)
+
+// wsCommand is a message from a WebSocket client, e.g.
+// {"type":"subscribe","listId":1} or
+// {"type":"add","listId":1,"record":{"plate":"AB123"}}.
+type wsCommand struct {
+	Type     string `json:"type"`
+	ListID   int64  `json:"listId"`
+	RecordID int64  `json:"recordId,omitempty"`
+	Record   Record `json:"record"`
+}
+
+// wsReply answers a wsCommand. Type is "ok" or "error"; Command repeats the
+// type of the command. Changes of subscribed lists are sent as
+// recordEvents, whose type is the change.
+type wsReply struct {
+	Type    string  `json:"type"`
+	Command string  `json:"command"`
+	ListID  int64   `json:"listId"`
+	Record  *Record `json:"record,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// wsUpgrader keeps the default same-origin check: the upgrade request is
+// authenticated by the session cookie, which any site could make a browser
+// send otherwise.
+var wsUpgrader = websocket.Upgrader{
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, status, "bad_handshake", reason.Error())
+	},
+}
+
+// wsClient is one WebSocket connection and its list subscriptions.
+type wsClient struct {
+	conn    *websocket.Conn
+	session Session
+	send    chan interface{}
+	done    chan struct{}
+
+	mu   sync.Mutex
+	subs map[int64]func()
+}
+
+// wsHandler upgrades an authenticated request to a WebSocket carrying
+// record changes of the subscribed lists to the client, and record add
+// and delete commands from it.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := contextSession(r.Context())
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the request.
+		return
+	}
+	c := &wsClient{
+		conn:    conn,
+		session: session,
+		send:    make(chan interface{}, streamBufferSize),
+		done:    make(chan struct{}),
+		subs:    make(map[int64]func()),
+	}
+	go c.writeLoop()
+	c.readLoop()
+
+	close(c.done)
+	c.mu.Lock()
+	for _, unsubscribe := range c.subs {
+		unsubscribe()
+	}
+	c.subs = nil
+	c.mu.Unlock()
+	conn.Close()
+}
+
+func (c *wsClient) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var cmd wsCommand
+		if err := c.conn.ReadJSON(&cmd); err != nil {
+			return
+		}
+		c.queue(c.handle(cmd))
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.conn.Close()
+				return
+			}
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				// Closing the connection ends readLoop as well.
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// queue sends a message to the client. Like streams, a client too slow to
+// keep up misses messages rather than blocking others.
+func (c *wsClient) queue(msg interface{}) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	default:
+	}
+}
+
+// handle runs a command and returns the reply to it.
+func (c *wsClient) handle(cmd wsCommand) wsReply {
+	reply := wsReply{Type: "ok", Command: cmd.Type, ListID: cmd.ListID}
+	if cmd.Type != wsUnsubscribe && !listAllowed(c.session, cmd.ListID) {
+		reply.Type, reply.Error = "error", "Forbidden"
+		return reply
+	}
+	var err error
+	switch cmd.Type {
+	case wsSubscribe:
+		err = c.subscribe(cmd.ListID)
+	case wsUnsubscribe:
+		c.unsubscribe(cmd.ListID)
+	case wsAdd, wsDelete:
+		if !hasRole(c.session, roleAdmin) {
+			err = errors.New("Forbidden")
+			break
+		}
+		// Commands skip tokenMiddleware, so they are audited here.
+		event := mutationEvent{
+			UserID:   c.session.ID,
+			User:     c.session.User,
+			Method:   cmd.Type,
+			Endpoint: "/ws",
+			ListID:   cmd.ListID,
+			Before:   listState(cmd.ListID),
+		}
+		since := auditLength()
+		var rec Record
+		if cmd.Type == wsAdd {
+			rec, err = createRecord(cmd.ListID, cmd.Record, c.session.User)
+		} else {
+			rec, err = deleteRecord(cmd.ListID, cmd.RecordID, c.session.User)
+		}
+		event.Time, event.Status, event.After = time.Now(), http.StatusOK, listState(cmd.ListID)
+		event.Changes = auditSince(since, c.session.User)
+		if err != nil {
+			event.Status = http.StatusBadRequest
+		} else {
+			reply.Record = &rec
+		}
+		appendMutation(event)
+	default:
+		err = errors.New("Unknown command")
+	}
+	if err != nil {
+		reply.Type = "error"
+		reply.Error = err.Error()
+	}
+	return reply
+}
+
+func (c *wsClient) subscribe(listID int64) error {
+	storage.Lock()
+	_, isList := storage.Lists[listID]
+	storage.Unlock()
+	if !isList {
+		return errListNotFound
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[listID]; ok {
+		return nil
+	}
+	events, unsubscribe := changes.Subscribe(listID)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case event := <-events:
+				c.queue(event)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	c.subs[listID] = func() {
+		unsubscribe()
+		close(stop)
+	}
+	return nil
+}
+
+func (c *wsClient) unsubscribe(listID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if unsubscribe, ok := c.subs[listID]; ok {
+		unsubscribe()
+		delete(c.subs, listID)
+	}
+}